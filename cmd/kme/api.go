@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/web"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+func api() *cli.Command {
+	flags := append(libraryFlags(),
+		&cli.StringFlag{
+			Name:    "addr",
+			Sources: cli.EnvVars("KME_ADDR"),
+			Usage:   "Address to listen on, e.g. :8080 for other computers to reach it",
+			Value:   "localhost:8080",
+		},
+		&cli.IntFlag{
+			Name:    "quality",
+			Sources: cli.EnvVars("KME_QUALITY"),
+			Usage:   "Quality of the markup images. [1,100] higher is better",
+			Value:   75,
+		},
+	)
+
+	return &cli.Command{
+		Name: "api",
+		Usage: "Serve the bookmarks as a read-only JSON API, read again whenever the Kobo DB changes. " +
+			"Responses have ETags, poll with If-None-Match",
+		Action: handleAPI,
+		Before: applyProfile,
+		Flags:  flags,
+	}
+}
+
+func handleAPI(ctx context.Context, cmd *cli.Command) error {
+	cacheDir, err := os.MkdirTemp("", "kme-markups")
+	if err != nil {
+		return cli.Exit("Error creating temporary directory for markups", 1)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	// the files whose changes mean the bookmarks may have changed
+	watched := []string{cmd.String("archive")}
+	if !cmd.Bool("from-archive") {
+		// found once, not on every reload
+		dev, err := deviceOrDiscover(ctx, cmd, true)
+		if err != nil {
+			return err
+		}
+		cmd.Set("device", dev)
+		dbPath := filepath.Join(dev, DB_DIR)
+		watched = []string{dbPath, dbPath + "-wal"}
+	}
+
+	source := web.Source{
+		Load: func() ([]*bookmark.Bookmarks, string, error) {
+			return loadLibrary(ctx, cmd, cacheDir)
+		},
+		Version: func() string {
+			return filesVersion(watched)
+		},
+	}
+	// read once before listening, so a bad device or archive is told right away
+	if _, _, err := source.Load(); err != nil {
+		return err
+	}
+
+	return listenAndServe(ctx, cmd.String("addr"), web.NewAPI(source, cmd.Int("quality")).Handler(), "Serving the API")
+}
+
+// Modification time and size of the files, missing ones included
+func filesVersion(paths []string) string {
+	parts := []string{}
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			parts = append(parts, "-")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d:%d", fi.ModTime().UnixNano(), fi.Size()))
+	}
+	return strings.Join(parts, ",")
+}
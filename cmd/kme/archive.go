@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/device"
+	"os"
+	"path/filepath"
+)
+
+// $XDG_DATA_HOME/kme/archive.sqlite, or ~/.local/share/kme/archive.sqlite if not set
+func defaultArchivePath() string {
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ARCHIVE_FILE
+		}
+		dataDir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataDir, "kme", ARCHIVE_FILE)
+}
+
+// Keeps a copy of the bookmarks of the selected books in the archive. Failing to archive does not
+// stop the extraction, it's reported and we move on
+func archiveBookmarks(archivePath string, books []string, devicePath string, markPath string) {
+	adb, err := bookmark.OpenArchive(archivePath)
+	if err != nil {
+		fmt.Println("Could not archive bookmarks:", err)
+		return
+	}
+	defer adb.Close()
+
+	count, err := adb.Upsert(books, device.Id(devicePath), markPath)
+	if err != nil {
+		fmt.Println("Could not archive bookmarks:", err)
+		return
+	}
+	fmt.Printf("Archived %d bookmarks in %s\n", count, archivePath)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kme/internal/backup"
+	"kme/internal/bookmark"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+func backupCmd() *cli.Command {
+	return &cli.Command{
+		Name:   "backup",
+		Usage:  "Back up the Kobo DB, markups and version file of the device into a zip with a manifest",
+		Action: handleBackup,
+		Before: applyProfile,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "device",
+				Sources: cli.EnvVars("KME_DEVICE"),
+				Usage:   "Location to the Kobo device. Defaults to the only Kobo mounted",
+				Action:  validateDevice(true),
+			},
+			&cli.StringFlag{
+				Name:    "out",
+				Sources: cli.EnvVars("KME_OUT"),
+				Usage:   "Directory where the backup is written",
+				Value:   OUT_DIR,
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "verify",
+				Usage:     "Check a backup against its manifest",
+				ArgsUsage: "<backup.zip>",
+				Action:    handleBackupVerify,
+			},
+		},
+	}
+}
+
+func handleBackup(ctx context.Context, cmd *cli.Command) error {
+	out := cmd.String("out")
+	device, err := deviceOrDiscover(ctx, cmd, true)
+	if err != nil {
+		return err
+	}
+
+	if err := bookmark.ConnectKoboDB(filepath.Join(device, DB_DIR)); err != nil {
+		return cli.Exit(err, 1)
+	}
+	entries, err := bookmark.Entries()
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	// closed before copying, so the DB isn't read while it's being written to the zip
+	bookmark.CloseKoboDB()
+
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return cli.Exit("Error creating output directory", 1)
+	}
+	outPath := filepath.Join(out, backup.FileName(time.Now()))
+	file, err := os.Create(outPath)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error creating %s: %v", outPath, err), 1)
+	}
+	defer file.Close()
+
+	manifest, err := backup.Write(file, device, entries)
+	if err != nil {
+		os.Remove(outPath)
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Printf("Backed up %d files and %d bookmarks to %s\n", len(manifest.Files), len(manifest.Bookmarks), outPath)
+	return nil
+}
+
+func handleBackupVerify(ctx context.Context, cmd *cli.Command) error {
+	if cmd.Args().Len() != 1 {
+		return cli.Exit("Provide the backup to verify", 1)
+	}
+
+	report, err := backup.Verify(cmd.Args().First())
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	m := report.Manifest
+	if m.Device != nil {
+		fmt.Printf("Backup of %s (firmware %s) from %s\n", m.Device.Serial, m.Device.Firmware, m.Created.Local().Format(time.DateTime))
+	}
+	fmt.Printf("%d/%d files match the manifest, %d bookmarks listed\n", report.Checked, len(m.Files), len(m.Bookmarks))
+	for _, f := range report.Missing {
+		fmt.Println("\t- missing: ", f)
+	}
+	for _, f := range report.Corrupted {
+		fmt.Println("\t- checksum mismatch: ", f)
+	}
+	for _, f := range report.Unlisted {
+		fmt.Println("\t- not in manifest: ", f)
+	}
+	for _, b := range report.Incomplete {
+		fmt.Println("\t- markup without images on the device: ", b)
+	}
+
+	if !report.Ok() {
+		return cli.Exit("Backup is incomplete or damaged", 1)
+	}
+	fmt.Println("Backup is complete")
+	return nil
+}
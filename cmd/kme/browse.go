@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/browse"
+	"kme/internal/export"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/urfave/cli/v3"
+)
+
+// Clipboard programs tried in order, the first one installed wins
+var clipboardCmds = [][]string{
+	{"wl-copy"},
+	{"xclip", "-selection", "clipboard"},
+	{"xsel", "--clipboard", "--input"},
+	{"pbcopy"},
+	{"clip.exe"},
+}
+
+func browseCmd() *cli.Command {
+	flags := append(libraryFlags(),
+		&cli.StringFlag{
+			Name:    "out",
+			Sources: cli.EnvVars("KME_OUT"),
+			Usage:   "Output directory for the exported highlights",
+			Value:   OUT_DIR,
+		},
+		&cli.StringFlag{
+			Name:    "format",
+			Sources: cli.EnvVars("KME_FORMAT"),
+			Usage:   fmt.Sprintf("Format of the exported highlights, one of %v", formats),
+			Value:   FORMAT_MARKDOWN,
+			Action: func(ctx context.Context, cmd *cli.Command, value string) error {
+				return validateFormat(ctx, cmd, []string{value})
+			},
+		},
+		&cli.StringFlag{
+			Name:    "template",
+			Sources: cli.EnvVars("KME_TEMPLATE"),
+			Usage:   "Go text/template file to use for the markdown format instead of the default one",
+		},
+		&cli.StringFlag{
+			Name:    "palette",
+			Sources: cli.EnvVars("KME_PALETTE"),
+			Usage: fmt.Sprintf(
+				"Highlight colors on screen and for the html format, one of %v or a JSON file",
+				export.PaletteNames(),
+			),
+			Value: export.DEFAULT_PALETTE,
+		},
+	)
+
+	return &cli.Command{
+		Name:   "browse",
+		Usage:  "Browse books, highlights and notes in the terminal",
+		Action: handleBrowse,
+		Before: applyProfile,
+		Flags:  flags,
+	}
+}
+
+func handleBrowse(ctx context.Context, cmd *cli.Command) error {
+	out := cmd.String("out")
+	format := cmd.String("format")
+	tmplPath := cmd.String("template")
+	paletteName := cmd.String("palette")
+
+	palette, err := export.LoadPalette(paletteName)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	// markups of the archive are written here, so html exports get their images
+	cacheDir, err := os.MkdirTemp("", "kme-markups")
+	if err != nil {
+		return cli.Exit("Error creating temporary directory for markups", 1)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	bookmarks, markPath, err := loadLibrary(ctx, cmd, cacheDir)
+	if err != nil {
+		return err
+	}
+	if len(bookmarks) == 0 {
+		return cli.Exit("No bookmarks to browse", 1)
+	}
+
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return cli.Exit(fmt.Errorf("Could not open the terminal: %w", err), 1)
+	}
+	if err := screen.Init(); err != nil {
+		return cli.Exit(fmt.Errorf("Could not open the terminal: %w", err), 1)
+	}
+	defer screen.Fini()
+
+	b := browse.New(screen, bookmarks, browse.Options{
+		Palette: palette,
+		Export: func(selection []*bookmark.Bookmarks) (string, error) {
+			if err := os.MkdirAll(out, 0755); err != nil {
+				return "", fmt.Errorf("Could not create %s: %w", out, err)
+			}
+			err := processHighlights(selection, markPath, nil, out, format, tmplPath, paletteName, export.AnkiOptions{})
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Exported %d books as %s to %s", len(selection), format, out), nil
+		},
+		Copy: copyToClipboard,
+	})
+	return b.Run()
+}
+
+// Copies with the first clipboard program found, or asks the terminal to do it with OSC 52, which
+// also works over ssh in most terminals
+func copyToClipboard(text string) error {
+	for _, c := range clipboardCmds {
+		path, err := exec.LookPath(c[0])
+		if err != nil {
+			continue
+		}
+		cmd := exec.Command(path, c[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Could not copy with %s: %w", c[0], err)
+		}
+		return nil
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Could not copy, no clipboard program found: %w", err)
+	}
+	defer tty.Close()
+	_, err = fmt.Fprintf(tty, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+	return err
+}
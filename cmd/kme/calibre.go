@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/calibre"
+	"kme/internal/epub"
+	"kme/internal/export"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v3"
+)
+
+func calibreCmd() *cli.Command {
+	return &cli.Command{
+		Name:   "calibre",
+		Usage:  "Export highlights and notes for the matching books of a Calibre library",
+		Action: handleCalibre,
+		Before: applyProfile,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "device",
+				Sources: cli.EnvVars("KME_DEVICE"),
+				Usage:   "Location to the Kobo device. Defaults to the only Kobo mounted",
+				Action:  validateDevice(true),
+			},
+			&cli.StringFlag{
+				Name:     "library",
+				Sources:  cli.EnvVars("KME_LIBRARY"),
+				Usage:    "Location of the Calibre library (the folder containing metadata.db)",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:    "out",
+				Sources: cli.EnvVars("KME_OUT"),
+				Usage:   "Output directory for the Calibre highlights files",
+				Value:   OUT_DIR,
+			},
+		},
+	}
+}
+
+func handleCalibre(ctx context.Context, cmd *cli.Command) error {
+	device, err := deviceOrDiscover(ctx, cmd, true)
+	if err != nil {
+		return err
+	}
+	dbPath := filepath.Join(device, DB_DIR)
+	outDir := filepath.Join(cmd.String("out"), "calibre")
+
+	if _, err := os.Stat(filepath.Join(cmd.String("library"), calibre.METADATA_DB)); os.IsNotExist(err) {
+		return cli.Exit("provided Calibre library does not have a metadata.db", 1)
+	}
+	lib, err := calibre.OpenLibrary(cmd.String("library"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return cli.Exit("Error creating output directory", 1)
+	}
+
+	if err := bookmark.ConnectKoboDB(dbPath); err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer bookmark.CloseKoboDB()
+
+	fmt.Println("Finding all bookmarks...")
+	bookmarks := allBookmarks(bookmark.AllBooks())
+
+	for _, bm := range bookmarks {
+		if len(bm.Highlights) == 0 {
+			continue
+		}
+		cb, how := lib.Match(bm.Book, bm.Author, bm.ISBN)
+		if cb == nil {
+			fmt.Printf("\t- %s: no match in the Calibre library\n", bm.Book)
+			continue
+		}
+		if err := exportCalibre(bm, cb, device, outDir); err != nil {
+			fmt.Printf("\t- %s: %s\n", bm.Book, err)
+			continue
+		}
+		fmt.Printf("\t- %s => Calibre book %d (matched by %s)\n", bm.Book, cb.Id, how)
+	}
+
+	return nil
+}
+
+func exportCalibre(bm *bookmark.Bookmarks, cb *calibre.Book, device string, outDir string) error {
+	bookPath := bm.DevicePath(device)
+	if bookPath == "" {
+		return fmt.Errorf("book is not a readable file in the device, can't compute positions")
+	}
+	book, err := epub.Open(bookPath)
+	if err != nil {
+		return err
+	}
+	defer book.Close()
+
+	fname := fmt.Sprintf("%d - %s%s", cb.Id, bm.Book, export.CALIBRE_EXT)
+	filePath := filepath.Join(outDir, fname)
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("Could not create Calibre highlights file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	skipped, err := export.WriteCalibre(file, bm, book)
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		fmt.Printf("\t  %d highlights could not be located in the book file\n", skipped)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/config"
+	"os"
+	"slices"
+
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// Profile values that mean something else in some commands
+var profileSkip = map[string][]string{
+	"list-books":  {"format"},
+	"search":      {"format"},
+	"browse":      {"format"},
+	"annotations": {"format"},
+	// the site cleans up its directory, it must not be where extractions go
+	"site": {"out"},
+}
+
+// Flags of the root command, every command can use them
+func configFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Config file with the profiles",
+			Value:   config.DefaultPath(),
+			Sources: cli.EnvVars("KME_CONFIG"),
+		},
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "Profile of the config file to use, instead of its default one",
+			Sources: cli.EnvVars("KME_PROFILE"),
+		},
+	}
+}
+
+func configCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "config",
+		Usage: "Config file and profiles",
+		Commands: []*cli.Command{
+			{
+				Name:   "show",
+				Usage:  "Show the config file and the profile in use",
+				Action: handleConfigShow,
+			},
+		},
+	}
+}
+
+func loadProfile(cmd *cli.Command) (*config.Config, *config.Profile, error) {
+	conf, err := config.Load(cmd.String("config"))
+	if err != nil {
+		return nil, nil, err
+	}
+	profile, err := conf.Profile(cmd.String("profile"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return conf, profile, nil
+}
+
+// Before of the commands: fills the flags that were not given, neither as flag nor as environment
+// variable, with the values of the profile
+func applyProfile(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+	_, profile, err := loadProfile(cmd)
+	if err != nil {
+		return ctx, cli.Exit(err, 1)
+	}
+	if profile == nil {
+		return ctx, nil
+	}
+
+	for name, values := range profile.Flags() {
+		if !hasLocalFlag(cmd, name) || cmd.IsSet(name) || slices.Contains(profileSkip[cmd.Name], name) {
+			continue
+		}
+		for _, v := range values {
+			if err := cmd.Set(name, v); err != nil {
+				return ctx, cli.Exit(fmt.Sprintf("Invalid %s %s in profile: %v", name, v, err), 1)
+			}
+		}
+	}
+	meanings := map[string]bookmark.ColorMeaning{}
+	for kobo, c := range profile.Colors {
+		meanings[kobo] = bookmark.ColorMeaning{Name: c.Name, Tag: c.Tag, Label: c.Label, CSS: c.CSS}
+	}
+	if err := bookmark.SetColorMeanings(meanings); err != nil {
+		return ctx, cli.Exit(err, 1)
+	}
+	return ctx, nil
+}
+
+func hasLocalFlag(cmd *cli.Command, name string) bool {
+	for _, f := range cmd.Flags {
+		if slices.Contains(f.Names(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleConfigShow(ctx context.Context, cmd *cli.Command) error {
+	path := cmd.String("config")
+	conf, profile, err := loadProfile(cmd)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		fmt.Printf("Config: %s (not found)\n", path)
+		return nil
+	}
+	fmt.Println("Config:", path)
+	for _, name := range conf.ProfileNames() {
+		if name == conf.Default {
+			name += " (default)"
+		}
+		fmt.Println("\t- ", name)
+	}
+
+	if profile == nil {
+		fmt.Println("No profile in use, pick one with --profile or set a default")
+		return nil
+	}
+	name := cmd.String("profile")
+	if name == "" {
+		name = conf.Default
+	}
+	data, err := yaml.Marshal(profile)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Printf("Profile %s:\n%s", name, data)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kme/internal/device"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v3"
+)
+
+func devices() *cli.Command {
+	return &cli.Command{
+		Name:   "devices",
+		Usage:  "List the Kobo devices currently mounted",
+		Action: handleDevices,
+	}
+}
+
+func handleDevices(ctx context.Context, cmd *cli.Command) error {
+	found := device.Discover()
+	if len(found) == 0 {
+		fmt.Println("No Kobo found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tMODEL\tSERIAL\tFIRMWARE\tFREE")
+	for _, d := range found {
+		free := "?"
+		if bytes, err := device.FreeSpace(d.Path); err == nil {
+			free = humanSize(bytes)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Path, d.Model(), d.Serial, d.Firmware, free)
+	}
+	return w.Flush()
+}
+
+// The --device given, otherwise the only Kobo mounted. isList as in validateDevice
+func deviceOrDiscover(ctx context.Context, cmd *cli.Command, isList bool) (string, error) {
+	if dev := cmd.String("device"); dev != "" {
+		return dev, nil
+	}
+	dev, err := discoverDevice()
+	if err != nil {
+		return "", err
+	}
+	if err := validateDevice(isList)(ctx, cmd, dev); err != nil {
+		return "", err
+	}
+	return dev, nil
+}
+
+func discoverDevice() (string, error) {
+	found := device.Discover()
+	switch len(found) {
+	case 0:
+		return "", cli.Exit("No Kobo found, plug it in or use --device", 1)
+	case 1:
+		// stderr, stdout may be JSON
+		fmt.Fprintf(os.Stderr, "Using %s in %s\n", found[0].Model(), found[0].Path)
+		return found[0].Path, nil
+	default:
+		paths := []string{}
+		for _, d := range found {
+			paths = append(paths, d.Path)
+		}
+		return "", cli.Exit("Found several Kobos, choose one with --device: "+strings.Join(paths, ", "), 1)
+	}
+}
+
+func humanSize(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
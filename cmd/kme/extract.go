@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"kme/internal/bookmark"
 	"kme/internal/convert"
+	"kme/internal/device"
+	"kme/internal/export"
+	"kme/internal/utils"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,131 +23,579 @@ import (
 	"github.com/urfave/cli/v3"
 )
 
+const (
+	FORMAT_TXT      = "txt"
+	FORMAT_READWISE = "readwise-csv"
+	FORMAT_MARKDOWN = "markdown"
+	FORMAT_JSON     = "json"
+	FORMAT_NDJSON   = "ndjson"
+	FORMAT_HTML     = "html"
+	FORMAT_ORG      = "org"
+	FORMAT_ANKI     = "anki"
+)
+
+// Formats for the highlights output
+var formats = []string{FORMAT_TXT, FORMAT_READWISE, FORMAT_MARKDOWN, FORMAT_JSON, FORMAT_NDJSON, FORMAT_HTML, FORMAT_ORG, FORMAT_ANKI}
+
 func extract() *cli.Command {
 	cmd := &cli.Command{
 		Name:   "extract",
 		Usage:  "Extract bookmarks from the Kobo device",
 		Action: handleExtract,
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:     "device",
-				Usage:    "Location to the Kobo device",
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:  "out",
-				Usage: "Output directory for temporary images and final PDF",
-				Value: OUT_DIR,
-			},
-			&cli.IntFlag{
-				Name:  "quality",
-				Usage: "Sets the quality of the images in the final PDF. [1,100] higher is better",
-				Value: 35,
-			},
-			&cli.BoolFlag{ // By default images are deleted
-				Name:  "keep",
-				Usage: "Keep temporary images",
-				Value: false,
-			},
-			&cli.BoolFlag{
-				Name:  "select",
-				Usage: "Select the book(s) to extract from, instead of doing all",
-				Value: false,
-			},
-			&cli.BoolFlag{
-				Name:  "markups",
-				Usage: "Extract just markups",
-				Value: false,
-			},
-			&cli.BoolFlag{
-				Name:  "highlights",
-				Usage: "Extract just highlights",
-				Value: false,
-			},
-			&cli.BoolFlag{
-				Name:  "copy",
-				Usage: "Copy the Kobo DB and markups folder to a temporary location",
-				Value: false,
+		Before: applyProfile,
+		Flags:  extractFlags(),
+	}
+
+	return cmd
+}
+
+func extractFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "device",
+			Sources: cli.EnvVars("KME_DEVICE"),
+			Usage: "Location to the Kobo device, or a copy of it. Repeat it to merge the bookmarks " +
+				"of several devices. Defaults to the only Kobo mounted",
+		},
+		&cli.StringFlag{
+			Name:    "out",
+			Sources: cli.EnvVars("KME_OUT"),
+			Usage:   "Output directory for temporary images and final PDF",
+			Value:   OUT_DIR,
+		},
+		&cli.IntFlag{
+			Name:    "quality",
+			Sources: cli.EnvVars("KME_QUALITY"),
+			Usage:   "Sets the quality of the images in the final PDF. [1,100] higher is better",
+			Value:   35,
+		},
+		&cli.StringFlag{
+			Name:  "vector",
+			Usage: "Write the markups with vector ink instead of JPEGs: svg for an SVG per markup, pdf for a PDF per book",
+			Validator: func(vector string) error {
+				if vector != "" && vector != "svg" && vector != "pdf" {
+					return fmt.Errorf("Unknown vector output %s, use svg or pdf", vector)
+				}
+				return nil
 			},
 		},
+		&cli.BoolFlag{ // By default images are deleted
+			Name:  "keep",
+			Usage: "Keep temporary images",
+			Value: false,
+		},
+		&cli.BoolFlag{
+			Name:  "select",
+			Usage: "Select the book(s) to extract from, instead of doing all",
+			Value: false,
+		},
+		&cli.BoolFlag{
+			Name:  "markups",
+			Usage: "Extract just markups",
+			Value: false,
+		},
+		&cli.BoolFlag{
+			Name:  "highlights",
+			Usage: "Extract just highlights",
+			Value: false,
+		},
+		&cli.StringSliceFlag{
+			Name:    "format",
+			Usage:   fmt.Sprintf("Output format for highlights, one of %v. Can be repeated", formats),
+			Value:   []string{FORMAT_TXT},
+			Sources: cli.EnvVars("KME_FORMAT"),
+			Action:  validateFormat,
+		},
+		&cli.StringSliceFlag{
+			Name:  "color",
+			Usage: "Only highlights of these colors, e.g. yellow,blue or the names given in the config. Leaves markups out",
+		},
+		&cli.BoolFlag{
+			Name:  "split-colors",
+			Usage: "Write the highlights of each color apart, in a folder per color inside --out",
+			Value: false,
+		},
+		&cli.StringSliceFlag{
+			Name:    "shelf",
+			Usage:   "Only the books in this shelf (collection). Can be repeated",
+			Sources: cli.EnvVars("KME_SHELF"),
+		},
+		&cli.StringFlag{
+			Name:    "template",
+			Sources: cli.EnvVars("KME_TEMPLATE"),
+			Usage:   "Go text/template file to use for the markdown format instead of the default one",
+		},
+		&cli.StringFlag{
+			Name:    "palette",
+			Sources: cli.EnvVars("KME_PALETTE"),
+			Usage: fmt.Sprintf(
+				"Highlight colors for the html format, one of %v or a JSON file",
+				export.PaletteNames(),
+			),
+			Value: export.DEFAULT_PALETTE,
+		},
+		&cli.BoolFlag{
+			Name:  "anki-cloze",
+			Usage: "For the anki format, make cloze cards from highlights that have a note",
+			Value: false,
+		},
+		&cli.StringSliceFlag{
+			Name:  "anki-deck",
+			Usage: "For the anki format, deck for the highlights of a color, e.g. blue=Definitions. Can be repeated",
+		},
+		&cli.StringFlag{
+			Name:    "archive",
+			Sources: cli.EnvVars("KME_ARCHIVE"),
+			Usage:   "kme archive database, where every extraction keeps a copy of the bookmarks",
+			Value:   defaultArchivePath(),
+		},
+		&cli.BoolFlag{
+			Name:  "no-archive",
+			Usage: "Don't copy the bookmarks to the archive",
+			Value: false,
+		},
+		&cli.BoolFlag{
+			Name:  "from-archive",
+			Usage: "Read the bookmarks from the archive instead of a device",
+			Value: false,
+		},
+		&cli.BoolFlag{
+			Name:  "copy",
+			Usage: "Copy the Kobo DB and markups folder to a temporary location",
+			Value: false,
+		},
 	}
+}
 
-	return cmd
+// Everything an extraction needs, so it can also run outside of the extract command (see watch)
+type extractOptions struct {
+	devices     []string
+	out         string
+	keep        bool
+	sel         bool
+	marks       bool
+	highs       bool
+	quality     int
+	formats     []string
+	shelves     []string
+	tmplPath    string
+	palette     string
+	archivePath string
+	noArchive   bool
+	fromArchive bool
+	anki        export.AnkiOptions
+	// Color codes of the highlights to extract, all of them if empty
+	colors      []int
+	splitColors bool
+	// svg or pdf to write the markups with vector ink, rendered to JPEGs if empty
+	vector string
+	// Only books with bookmarks created or modified after this, all of them if zero
+	since time.Time
+	// Books already written by an earlier try, skipped unless they changed after that
+	written map[string]time.Time
+}
+
+func extractOptionsFrom(cmd *cli.Command) (*extractOptions, error) {
+	anki, err := ankiOptions(cmd)
+	if err != nil {
+		return nil, err
+	}
+	colors := []int{}
+	for _, c := range cmd.StringSlice("color") {
+		code, ok := (&bookmark.Highlight{}).ColorCode(c)
+		if !ok {
+			return nil, cli.Exit("Unknown color "+c, 1)
+		}
+		colors = append(colors, code)
+	}
+	// markups have no color, so there would be nothing left to extract
+	if cmd.Bool("markups") && len(colors) > 0 {
+		return nil, cli.Exit("--color only applies to highlights, it can't be used with --markups", 1)
+	}
+	if cmd.Bool("markups") && cmd.Bool("split-colors") {
+		return nil, cli.Exit("--split-colors only applies to highlights, it can't be used with --markups", 1)
+	}
+	return &extractOptions{
+		devices:     cmd.StringSlice("device"),
+		out:         cmd.String("out"),
+		keep:        cmd.Bool("keep"),
+		sel:         cmd.Bool("select"),
+		marks:       cmd.Bool("markups"),
+		highs:       cmd.Bool("highlights"),
+		quality:     cmd.Int("quality"),
+		vector:      cmd.String("vector"),
+		formats:     cmd.StringSlice("format"),
+		shelves:     cmd.StringSlice("shelf"),
+		tmplPath:    cmd.String("template"),
+		palette:     cmd.String("palette"),
+		archivePath: cmd.String("archive"),
+		noArchive:   cmd.Bool("no-archive"),
+		fromArchive: cmd.Bool("from-archive"),
+		anki:        anki,
+		colors:      colors,
+		splitColors: cmd.Bool("split-colors"),
+	}, nil
 }
 
 func handleExtract(ctx context.Context, cmd *cli.Command) error {
-	device := cmd.String("device")
-	dbPath := filepath.Join(device, DB_DIR)
-	markPath := filepath.Join(device, MARK_DIR)
-	out := cmd.String("out")
-	keep := cmd.Bool("keep")
-	sel := cmd.Bool("select")
-	marks := cmd.Bool("markups")
-	highs := cmd.Bool("highlights")
-	quality := cmd.Int("quality")
+	opts, err := extractOptionsFrom(cmd)
+	if err != nil {
+		return err
+	}
 	// cpy := cmd.Bool("copy")
 
-	if err := validate(device, dbPath, markPath, out, keep, sel); err != nil {
-		return err
+	if len(opts.devices) == 0 && !opts.fromArchive {
+		dev, err := discoverDevice()
+		if err != nil {
+			return err
+		}
+		opts.devices = []string{dev}
 	}
 
-	// if cpy {
-	// 	ctime := time.Now().Local()
-	// 	cpyDir := fmt.Sprintf("/tmp/%s_kobodevice", ctime.Format("2006-01-02"))
-	// 	os.CopyFS(cpyDir, dbPath)
-	// }
+	_, err = runExtract(opts)
+	return err
+}
 
-	if err := bookmark.ConnectKoboDB(dbPath); err != nil {
-		cli.Exit(err, 1)
-	}
+// How far an extraction got, so a later run can continue from there (see watch)
+type extractRun struct {
+	// when the most recent of the extracted bookmarks was created or modified, for opts.since
+	latest time.Time
+	// last change of each book whose files were all written, for opts.written. Empty when something
+	// other than a book failed
+	written map[string]time.Time
+}
 
-	var books []string
-	fmt.Println("Finding all Books with bookmarks...")
-	books = bookmark.AllBooks()
+func runExtract(opts *extractOptions) (*extractRun, error) {
+	var markPath string
+	var bookmarks []*bookmark.Bookmarks
+	var err error
 
-	if sel {
-		selection, err := fuzzyFind(books)
+	if opts.fromArchive {
+		// markup images live in the archive, they are written here so they can be rendered
+		cacheDir, err := os.MkdirTemp("", "kme-markups")
 		if err != nil {
-			cli.Exit(err, 1)
+			return nil, cli.Exit("Error creating temporary directory for markups", 1)
+		}
+		defer os.RemoveAll(cacheDir)
+		markPath = cacheDir
+
+		if err := os.Mkdir(opts.out, 0755); err != nil && !os.IsExist(err) {
+			return nil, cli.Exit("Error creating output directory", 1)
+		}
+		if err := bookmark.ConnectArchive(opts.archivePath, cacheDir); err != nil {
+			return nil, cli.Exit(err, 1)
+		}
+
+		if len(opts.shelves) > 0 {
+			return nil, cli.Exit("Shelves are only known to the device, --shelf can't be used with --from-archive", 1)
+		}
+		fmt.Println("Finding all Books with bookmarks...")
+		books := bookmark.AllBooks()
+		details := []*bookmark.Bookmarks{}
+		if opts.sel {
+			details = allBookmarks(books)
+		}
+		books, err = selectBooks(books, opts.sel, details)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Finding all bookmarks...")
+		bookmarks = allBookmarks(books)
+	} else {
+		if len(opts.devices) == 0 {
+			return nil, cli.Exit("--device is required unless reading --from-archive", 1)
+		}
+		for _, device := range opts.devices {
+			dbPath := filepath.Join(device, DB_DIR)
+			if err := validate(device, dbPath, filepath.Join(device, MARK_DIR), opts.out, opts.keep, opts.sel); err != nil {
+				return nil, err
+			}
+		}
+
+		// if cpy {
+		// 	ctime := time.Now().Local()
+		// 	cpyDir := fmt.Sprintf("/tmp/%s_kobodevice", ctime.Format("2006-01-02"))
+		// 	os.CopyFS(cpyDir, dbPath)
+		// }
+
+		// markup paths are resolved per device when loading, this is only a fallback
+		markPath = filepath.Join(opts.devices[0], MARK_DIR)
+		bookmarks, err = loadDevices(opts.devices, opts.shelves, opts.sel, opts.archivePath, !opts.noArchive)
+		if err != nil {
+			return nil, err
 		}
-		books = selection
 	}
 
-	if len(books) == 0 {
-		cli.Exit("No books found or selected", 1)
+	run := &extractRun{latest: lastChange(bookmarks), written: map[string]time.Time{}}
+	if !opts.since.IsZero() {
+		bookmarks = changedSince(bookmarks, opts.since)
+		if len(bookmarks) == 0 {
+			fmt.Println("No new bookmarks since", opts.since.Local().Format(time.DateTime))
+			return run, nil
+		}
+		fmt.Printf("%d books with new bookmarks since %s\n", len(bookmarks), opts.since.Local().Format(time.DateTime))
+	}
+	if len(opts.written) > 0 {
+		bookmarks = slices.DeleteFunc(bookmarks, func(bm *bookmark.Bookmarks) bool {
+			written, ok := opts.written[bm.Book]
+			return ok && !lastChange([]*bookmark.Bookmarks{bm}).After(written)
+		})
+		if len(bookmarks) == 0 {
+			fmt.Println("No books left to extract")
+			return run, nil
+		}
+	}
+
+	if len(opts.colors) > 0 {
+		bookmarks = withColors(bookmarks, opts.colors)
+		if len(bookmarks) == 0 {
+			fmt.Println("No highlights of the colors asked for")
+			return run, nil
+		}
 	}
 
-	fmt.Println("Finding all bookmarks...")
-	bookmarks := bookmark.AllBookmarks(books)
 	fmt.Println("Processing bookmarks...")
 
+	// the file each markup ended up in, by id, so the exports can link to it
+	markupFiles := map[string]string{}
+
+	// If no switch used for markups / highlights we do both (like if there was an --all). Markups
+	// have no color, filtering by color is only about highlights
+	if !opts.highs && len(opts.colors) == 0 {
+		for _, bm := range bookmarks {
+			var files map[string]string
+			if opts.vector != "" {
+				files, err = processVectorMarkups(bm, markPath, opts.out, opts.vector)
+			} else {
+				files, err = processMarkups(bm, markPath, opts.out, opts.keep, opts.quality)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+			maps.Copy(markupFiles, files)
+		}
+	}
+	errs := []error{}
+	if !opts.marks {
+		outs := map[string][]*bookmark.Bookmarks{opts.out: bookmarks}
+		if opts.splitColors {
+			if outs, err = splitColors(bookmarks, opts.out); err != nil {
+				return run, cli.Exit(err, 1)
+			}
+		}
+		for _, out := range slices.Sorted(maps.Keys(outs)) {
+			for _, format := range opts.formats {
+				err := processHighlights(outs[out], markPath, markupFiles, out, format, opts.tmplPath, opts.palette, opts.anki)
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	err = errors.Join(errs...)
+	if failed, onlyBooks := failedBooks(err); onlyBooks {
+		for _, bm := range bookmarks {
+			if !slices.Contains(failed, bm.Book) {
+				run.written[bm.Book] = lastChange([]*bookmark.Bookmarks{bm})
+			}
+		}
+	}
+	if err != nil {
+		return run, cli.Exit(err, 1)
+	}
+	return run, nil
+}
+
+// The books whose files could not be written, and whether that's all that went wrong
+func failedBooks(err error) ([]string, bool) {
+	if err == nil {
+		return nil, true
+	}
+	if be, ok := err.(*bookError); ok {
+		return []string{be.book}, true
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return nil, false
+	}
+	books := []string{}
+	for _, e := range joined.Unwrap() {
+		failed, ok := failedBooks(e)
+		if !ok {
+			return nil, false
+		}
+		books = append(books, failed...)
+	}
+	return books, true
+}
+
+// The books with highlights of the colors, with only those
+func withColors(bookmarks []*bookmark.Bookmarks, codes []int) []*bookmark.Bookmarks {
+	filtered := []*bookmark.Bookmarks{}
 	for _, bm := range bookmarks {
-		switch {
-		case marks:
-			processMarkups(bm, markPath, out, keep, quality)
-		case highs:
-			processHighlights(bm, out)
-		default:
-			processMarkups(bm, markPath, out, keep, quality)
-			processHighlights(bm, out)
+		if colored := bm.WithColors(codes); colored != nil {
+			filtered = append(filtered, colored)
 		}
 	}
+	return filtered
+}
 
-	return nil
+// The highlights of each color, by the folder inside out they go to. Named after the color tag, as
+// set in the config, with / made - so it's always a single folder. Colors with the same tag share it
+func splitColors(bookmarks []*bookmark.Bookmarks, out string) (map[string][]*bookmark.Bookmarks, error) {
+	h := &bookmark.Highlight{}
+	dirs := map[string][]int{}
+	for _, bm := range bookmarks {
+		for _, code := range bm.ColorCodes() {
+			name := strings.Trim(strings.ReplaceAll(h.ColorTag(code), "/", "-"), "-.")
+			if name == "" {
+				name = h.KoboColorName(code)
+			}
+			dir := filepath.Join(out, name)
+			if !slices.Contains(dirs[dir], code) {
+				dirs[dir] = append(dirs[dir], code)
+			}
+		}
+	}
+	outs := map[string][]*bookmark.Bookmarks{}
+	for dir, codes := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("Error creating output directory for color %s: %w", filepath.Base(dir), err)
+		}
+		outs[dir] = withColors(bookmarks, codes)
+	}
+	return outs, nil
 }
 
-func processMarkups(bm *bookmark.Bookmarks, markPath string, out string, keep bool, quality int) error {
+func lastChange(bookmarks []*bookmark.Bookmarks) time.Time {
+	latest := time.Time{}
+	for _, bm := range bookmarks {
+		for _, h := range bm.Highlights {
+			latest = maxTime(latest, h.Created, h.Modified)
+		}
+		for _, m := range bm.Markups {
+			latest = maxTime(latest, m.Created, m.Modified)
+		}
+	}
+	return latest
+}
+
+// Books with at least one bookmark created or modified after since, with all their bookmarks
+func changedSince(bookmarks []*bookmark.Bookmarks, since time.Time) []*bookmark.Bookmarks {
+	changed := []*bookmark.Bookmarks{}
+	for _, bm := range bookmarks {
+		if lastChange([]*bookmark.Bookmarks{bm}).After(since) {
+			changed = append(changed, bm)
+		}
+	}
+	return changed
+}
+
+func maxTime(times ...time.Time) time.Time {
+	latest := time.Time{}
+	for _, t := range times {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// Reads the bookmarks of every device and merges them by book. Books are selected from all the
+// devices at once, and each device is archived with its own id
+func loadDevices(devices []string, shelves []string, sel bool, archivePath string, archive bool) ([]*bookmark.Bookmarks, error) {
+	fmt.Println("Finding all Books with bookmarks...")
+	books := []string{}
+	// bookmarks of every device, only to show them when selecting
+	details := [][]*bookmark.Bookmarks{}
+	for _, device := range devices {
+		if err := bookmark.ConnectKoboDB(filepath.Join(device, DB_DIR)); err != nil {
+			return nil, cli.Exit(err, 1)
+		}
+		onShelves := []string{}
+		if len(shelves) > 0 {
+			var err error
+			if onShelves, err = bookmark.BooksOnShelves(shelves); err != nil {
+				return nil, cli.Exit(err, 1)
+			}
+		}
+		devBooks := []string{}
+		for _, b := range bookmark.AllBooks() {
+			if len(shelves) > 0 && !slices.Contains(onShelves, b) {
+				continue
+			}
+			devBooks = append(devBooks, b)
+			if !slices.Contains(books, b) {
+				books = append(books, b)
+			}
+		}
+		if sel {
+			details = append(details, allBookmarks(devBooks))
+		}
+		bookmark.CloseKoboDB()
+	}
+
+	books, err := selectBooks(books, sel, bookmark.Merge(details...))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Finding all bookmarks...")
+	sets := [][]*bookmark.Bookmarks{}
+	for _, dev := range devices {
+		markPath := filepath.Join(dev, MARK_DIR)
+		if err := bookmark.ConnectKoboDB(filepath.Join(dev, DB_DIR)); err != nil {
+			return nil, cli.Exit(err, 1)
+		}
+		if archive {
+			archiveBookmarks(archivePath, books, dev, markPath)
+		}
+
+		bms := allBookmarks(books)
+		for _, bm := range bms {
+			bm.SetOrigin(device.Id(dev), markPath)
+		}
+		sets = append(sets, bms)
+		bookmark.CloseKoboDB()
+	}
+
+	merged := bookmark.Merge(sets...)
+	if len(devices) > 1 {
+		fmt.Printf("Merged bookmarks of %d books from %d devices\n", len(merged), len(devices))
+	}
+	return merged, nil
+}
+
+// Lets the user pick some of the books when sel is set, details has their bookmarks to show
+func selectBooks(books []string, sel bool, details []*bookmark.Bookmarks) ([]string, error) {
+	if sel {
+		selection, err := fuzzyFind(books, details)
+		if err != nil {
+			return nil, cli.Exit(err, 1)
+		}
+		books = selection
+	}
+
+	if len(books) == 0 {
+		return nil, cli.Exit("No books found or selected", 1)
+	}
+	return books, nil
+}
+
+// Renders the markups of the book and puts them in a PDF. Returns the file each markup ended up in,
+// by markup id: its image with keep, the PDF otherwise
+func processMarkups(bm *bookmark.Bookmarks, markPath string, out string, keep bool, quality int) (map[string]string, error) {
 	// If no switch used for markups / highlights we do both (like if there was an --all)
 	wg := sync.WaitGroup{}
 	bookOutDir := filepath.Join(out, bm.Book)
 	fmt.Println("Extracting markups to ", bookOutDir)
 
 	if err := os.Mkdir(bookOutDir, 0755); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("Error creating output directory for book %s: %s", bm.Book, err)
+		return nil, fmt.Errorf("Error creating output directory for book %s: %s", bm.Book, err)
 	}
 
 	fmt.Println("Book: ", bm.Book, "Total bookmarks: ", len(bm.Markups), "generating images...")
 
+	files := map[string]string{}
 	wg.Add(1)
 	go func() error {
 		for i, m := range bm.Marks() {
@@ -146,7 +603,9 @@ func processMarkups(bm *bookmark.Bookmarks, markPath string, out string, keep bo
 
 			if err := convert.OverlayMarkup(m, markPath, bookOutDir, quality); err != nil {
 				fmt.Println(err)
+				continue
 			}
+			files[m.Id] = filepath.Join(bookOutDir, m.Outfile())
 		}
 		wg.Done()
 		return nil
@@ -156,32 +615,264 @@ func processMarkups(bm *bookmark.Bookmarks, markPath string, out string, keep bo
 	bookmark.CloseKoboDB()
 
 	fmt.Println("Generating PDF ...")
-	err := convert.BuildPDF(bm, bookOutDir, keep)
+	pdfPath, err := convert.BuildPDF(bm, bookOutDir, keep)
 	if err != nil {
-		fmt.Errorf("Error generating PDF: %w", err)
+		return nil, fmt.Errorf("Error generating PDF: %w", err)
 	}
-	return nil
+	if !keep {
+		for id := range files {
+			files[id] = pdfPath
+		}
+	}
+	return files, nil
+}
+
+// Same as processMarkups, but the ink stays vector: an SVG per markup or a PDF with all of them
+func processVectorMarkups(bm *bookmark.Bookmarks, markPath string, out string, vector string) (map[string]string, error) {
+	if len(bm.Markups) == 0 {
+		return nil, nil
+	}
+	bookOutDir := filepath.Join(out, bm.Book)
+	fmt.Println("Extracting markups to ", bookOutDir)
+
+	if err := os.Mkdir(bookOutDir, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("Error creating output directory for book %s: %s", bm.Book, err)
+	}
+
+	// rendered in memory first, so a markup that fails doesn't leave an empty file behind. A PDF
+	// without some of the markups is still written
+	write := func(name string, fn func(w io.Writer) error) error {
+		buf := &bytes.Buffer{}
+		err := fn(buf)
+		if err != nil && !errors.Is(err, convert.ErrSkippedMarkups) {
+			return err
+		}
+		if werr := os.WriteFile(filepath.Join(bookOutDir, name), buf.Bytes(), 0644); werr != nil {
+			return fmt.Errorf("Error writing %s: %w", name, werr)
+		}
+		return err
+	}
+
+	files := map[string]string{}
+	if vector == "pdf" {
+		name := convert.PDFName(bm)
+		err := write(name, func(w io.Writer) error { return convert.WriteVectorPDF(w, bm, markPath) })
+		if errors.Is(err, convert.ErrSkippedMarkups) {
+			warn(err)
+		} else if err != nil {
+			return nil, fmt.Errorf("Error generating PDF: %w", err)
+		}
+		fmt.Println("PDF saved: ", filepath.Join(bookOutDir, name))
+		// the ones skipped are those without their files
+		for _, m := range bm.Markups {
+			if m.HasImagePair(markPath) {
+				files[m.Id] = filepath.Join(bookOutDir, name)
+			}
+		}
+		return files, nil
+	}
+
+	errs := []error{}
+	for i, m := range bm.Marks() {
+		fmt.Printf("\tBookmark [%d/%d] - Book: %s, \n", i, len(bm.Markups), bm.Book)
+		name := strings.TrimSuffix(m.Outfile(), filepath.Ext(m.Outfile())) + ".svg"
+		if err := write(name, func(w io.Writer) error { return convert.WriteMarkupSVG(w, m, markPath) }); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		files[m.Id] = filepath.Join(bookOutDir, name)
+	}
+	return files, errors.Join(errs...)
+}
+
+// markupFiles are the files the markups were written to by this run, by markup id, for the formats
+// that link to them. nil when there are none
+func processHighlights(
+	bookmarks []*bookmark.Bookmarks,
+	markPath string,
+	markupFiles map[string]string,
+	out string,
+	format string,
+	tmplPath string,
+	paletteName string,
+	anki export.AnkiOptions,
+) error {
+	// books that could not be written, the others still are
+	errs := []error{}
+	switch format {
+	case FORMAT_ANKI:
+		return writeLibraryFile(out, "highlights.apkg", func(file *os.File) error {
+			return export.WriteAnki(file, bookmarks, anki)
+		})
+	case FORMAT_HTML:
+		palette, err := export.LoadPalette(paletteName)
+		if err != nil {
+			return err
+		}
+		for _, bm := range bookmarks {
+			err := writeBookFile(bm, out, "html", func(file *os.File) error {
+				return export.WriteHTML(file, bm, palette, markPath)
+			})
+			errs = append(errs, err)
+		}
+	case FORMAT_JSON:
+		return writeLibraryFile(out, "library.json", func(file *os.File) error {
+			return export.WriteJSON(file, bookmarks, markPath, true)
+		})
+	case FORMAT_NDJSON:
+		return writeLibraryFile(out, "library.ndjson", func(file *os.File) error {
+			return export.WriteNDJSON(file, bookmarks, markPath, true)
+		})
+	case FORMAT_READWISE:
+		return writeLibraryFile(out, "readwise.csv", func(file *os.File) error {
+			return export.WriteReadwiseCSV(file, bookmarks)
+		})
+	case FORMAT_ORG:
+		for _, bm := range bookmarks {
+			err := writeBookFile(bm, out, "org", func(file *os.File) error {
+				return export.WriteOrg(file, bm, markupLinks(bm, filepath.Join(out, bm.Book), markupFiles))
+			})
+			errs = append(errs, err)
+		}
+	case FORMAT_MARKDOWN:
+		tmpl, err := export.MarkdownTemplate(tmplPath)
+		if err != nil {
+			return err
+		}
+		for _, bm := range bookmarks {
+			err := writeBookFile(bm, out, "md", func(file *os.File) error {
+				return export.WriteMarkdown(file, bm, tmpl, markupLinks(bm, filepath.Join(out, bm.Book), markupFiles))
+			})
+			errs = append(errs, err)
+		}
+	default:
+		for _, bm := range bookmarks {
+			// markups don't go in text files
+			if len(bm.Highlights) == 0 {
+				continue
+			}
+			if err := writeBookFile(bm, out, "txt", func(file *os.File) error {
+				return writeTxt(file, bm)
+			}); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func processHighlights(bm *bookmark.Bookmarks, out string) error {
+// The files of the markups of the book, relative to dir, where the exported file goes
+func markupLinks(bm *bookmark.Bookmarks, dir string, markupFiles map[string]string) export.MarkupFiles {
+	links := export.MarkupFiles{}
+	for _, m := range bm.Markups {
+		if f, ok := markupFiles[m.Id]; ok {
+			if rel, err := filepath.Rel(dir, f); err == nil {
+				links[m.Id] = filepath.ToSlash(rel)
+			}
+		}
+	}
+	return links
+}
+
+// Formats that put every book in a single file, named after the extraction time
+func writeLibraryFile(out string, name string, write func(*os.File) error) error {
 	ctime := time.Now().Local()
-	fname := fmt.Sprintf("%s-highlights.txt", ctime.Format("200601021504"))
-	filePath := filepath.Join(out, bm.Book, fname)
+	filePath := filepath.Join(out, fmt.Sprintf("%s-%s", ctime.Format("200601021504"), name))
 	fmt.Println("Extracting highlights to ", filePath)
 
 	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("Could not create highlights file %s: %s", filePath, err)
+	}
 	defer file.Close()
 
+	if err := write(file); err != nil {
+		return err
+	}
+	fmt.Println("All highlights extracted to", filePath)
+	return nil
+}
+
+// Formats that write a file per book, inside the book output directory
+func writeBookFile(bm *bookmark.Bookmarks, out string, ext string, write func(*os.File) error) error {
+	if len(bm.Highlights) == 0 && len(bm.Markups) == 0 {
+		return nil
+	}
+	ctime := time.Now().Local()
+	fname := fmt.Sprintf("%s-highlights.%s", ctime.Format("200601021504"), ext)
+	bookOutDir := filepath.Join(out, bm.Book)
+	filePath := filepath.Join(bookOutDir, fname)
+	fmt.Println("Extracting highlights to ", filePath)
+
+	if err := os.Mkdir(bookOutDir, 0755); err != nil && !os.IsExist(err) {
+		return &bookError{bm.Book, fmt.Errorf("Error creating output directory for book %s: %s", bm.Book, err)}
+	}
+	file, err := os.Create(filePath)
 	if err != nil {
-		return fmt.Errorf("Could not create highlights file for book %s: %s", bm.Book, err)
+		return &bookError{bm.Book, fmt.Errorf("Could not create highlights file for book %s: %s", bm.Book, err)}
+	}
+	defer file.Close()
+
+	if err := write(file); err != nil {
+		return &bookError{bm.Book, err}
 	}
+	fmt.Println("All highlights extracted for book", bm.Book)
+	return nil
+}
+
+// A book whose file could not be written, the other books still are
+type bookError struct {
+	book string
+	err  error
+}
+
+func (self *bookError) Error() string {
+	return self.err.Error()
+}
+
+func (self *bookError) Unwrap() error {
+	return self.err
+}
 
+func writeTxt(file *os.File, bm *bookmark.Bookmarks) error {
 	for _, h := range bm.Highs() {
 		if _, err := file.WriteString(fmt.Sprintf("- %s\n", h.Format())); err != nil {
-			return fmt.Errorf("Error writing to highlights file %s: %s", filePath, err)
+			return fmt.Errorf("Error writing to highlights file %s: %s", file.Name(), err)
+		}
+	}
+	return nil
+}
+
+func ankiOptions(cmd *cli.Command) (export.AnkiOptions, error) {
+	opts := export.AnkiOptions{
+		Cloze:       cmd.Bool("anki-cloze"),
+		Decks:       map[int]string{},
+		DefaultDeck: export.ANKI_DEFAULT_DECK,
+	}
+	for _, d := range cmd.StringSlice("anki-deck") {
+		color, deck, ok := strings.Cut(d, "=")
+		code, known := (&bookmark.Highlight{}).ColorCode(color)
+		if !ok || !known || deck == "" {
+			return opts, cli.Exit("Invalid --anki-deck "+d+", must be <color>=<deck>", 1)
+		}
+		opts.Decks[code] = deck
+	}
+	// colors with a label in the config get their own deck, unless given one above
+	h := &bookmark.Highlight{}
+	for code := range 4 {
+		if m, ok := h.ColorMeaning(code); ok && m.Label != "" && opts.Decks[code] == "" {
+			opts.Decks[code] = opts.DefaultDeck + "::" + m.Label
+		}
+	}
+	return opts, nil
+}
+
+func validateFormat(ctx context.Context, cmd *cli.Command, values []string) error {
+	for _, format := range values {
+		if !slices.Contains(formats, format) {
+			return cli.Exit(fmt.Sprintf("Unknown format %s, must be one of %v", format, formats), 1)
 		}
 	}
-	fmt.Println("All highlights extracted for book", bm.Book)
 	return nil
 }
 
@@ -213,14 +904,31 @@ func validate(
 	return nil
 }
 
-func fuzzyFind(books []string) ([]string, error) {
+// Picker of the books, with their author, counts and last annotation, and a preview of their first
+// highlights. Nothing selected is an error, not everything
+func fuzzyFind(books []string, details []*bookmark.Bookmarks) ([]string, error) {
+	byBook := map[string]*bookmark.Bookmarks{}
+	for _, bm := range details {
+		byBook[bm.Book] = bm
+	}
 
 	idx, err := fuzzyfinder.FindMulti(
 		books,
 		func(i int) string {
-			return books[i]
+			return bookLabel(books[i], byBook[books[i]])
 		},
+		fuzzyfinder.WithHeader("Tab to select several books, Enter to extract, Esc to cancel"),
+		fuzzyfinder.WithPreviewWindow(func(i, width, height int) string {
+			if i < 0 {
+				return ""
+			}
+			// the preview is the right half of the terminal, inside a border
+			return bookPreview(byBook[books[i]], width/2-4, height-2)
+		}),
 	)
+	if errors.Is(err, fuzzyfinder.ErrAbort) {
+		return nil, fmt.Errorf("Selection cancelled, nothing extracted")
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Error with fuzzy finder: %w\n", err)
 	}
@@ -229,9 +937,56 @@ func fuzzyFind(books []string) ([]string, error) {
 	for _, i := range idx {
 		selected = append(selected, books[i])
 	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("No books selected, nothing extracted")
+	}
+	return selected, nil
+}
 
-	if len(selected) > 0 {
-		return selected, nil
+// e.g. Dune — Frank Herbert · 12 highlights, 3 markups · 2024-03-02
+func bookLabel(book string, bm *bookmark.Bookmarks) string {
+	if bm == nil {
+		return book
 	}
-	return books, nil
+	label := book
+	if bm.Author != "" {
+		label += " — " + bm.Author
+	}
+	label += fmt.Sprintf(" · %d highlights, %d markups", len(bm.Highlights), len(bm.Markups))
+	if last := lastChange([]*bookmark.Bookmarks{bm}); !last.IsZero() {
+		label += " · " + last.Local().Format("2006-01-02")
+	}
+	return label
+}
+
+// The first highlights of the book, as many as fit
+func bookPreview(bm *bookmark.Bookmarks, width int, height int) string {
+	if bm == nil {
+		return ""
+	}
+	width = max(width, 10)
+	lines := []string{bm.Book}
+	if bm.Author != "" {
+		lines = append(lines, bm.Author)
+	}
+	lines = append(lines, "")
+	if len(bm.Highlights) == 0 {
+		lines = append(lines, fmt.Sprintf("No highlights, %d markups", len(bm.Markups)))
+	}
+chapters:
+	for _, c := range export.Chapters(bm) {
+		for _, h := range c.Highlights {
+			if len(lines) >= height {
+				break chapters
+			}
+			text := utils.Wrap(fmt.Sprintf("%c %s", h.Colors(h.Color()), h.Text()), width)
+			if h.Note != "" {
+				text = append(text, utils.Wrap("✎ "+h.Note, width)...)
+			}
+			lines = append(lines, text...)
+			lines = append(lines, "")
+		}
+	}
+	// the last highlight may not fit whole
+	return strings.Join(lines[:min(len(lines), max(height, 0))], "\n")
 }
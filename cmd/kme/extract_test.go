@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/export"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBookLabel(t *testing.T) {
+	local := time.Local
+	time.Local = time.UTC
+	defer func() { time.Local = local }()
+
+	h := bookmark.NewHighlight("Fear is the mind-killer.", 0)
+	h.Created = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	h.Modified = time.Date(2024, 3, 2, 23, 0, 0, 0, time.UTC)
+	bm := &bookmark.Bookmarks{
+		Book:       "Dune",
+		Author:     "Frank Herbert",
+		Highlights: []*bookmark.Highlight{h},
+		Markups:    []*bookmark.Markup{{Id: "m1"}, {Id: "m2"}},
+	}
+	if got := bookLabel("Dune", bm); got != "Dune — Frank Herbert · 1 highlights, 2 markups · 2024-03-02" {
+		t.Errorf("bookLabel = %q", got)
+	}
+	if got := bookLabel("Emma", &bookmark.Bookmarks{Book: "Emma"}); got != "Emma · 0 highlights, 0 markups" {
+		t.Errorf("bookLabel without author nor dates = %q", got)
+	}
+	if got := bookLabel("Emma", nil); got != "Emma" {
+		t.Errorf("bookLabel without bookmarks = %q", got)
+	}
+}
+
+func TestBookPreview(t *testing.T) {
+	bm := &bookmark.Bookmarks{Book: "Dune", Author: "Frank Herbert"}
+	for i := range 10 {
+		h := bookmark.NewHighlight(strings.Repeat(fmt.Sprintf("word%d ", i), 12), i%4)
+		h.Id, h.Section, h.OrderId = fmt.Sprint(i), fmt.Sprintf("ch%d", i/3), float64(i)
+		h.Note = "a note"
+		bm.Highlights = append(bm.Highlights, h)
+	}
+
+	for _, height := range []int{0, 1, 3, 4, 7, 20, 1000} {
+		preview := bookPreview(bm, 30, height)
+		lines := strings.Split(preview, "\n")
+		if preview == "" {
+			lines = nil
+		}
+		if len(lines) > height {
+			t.Errorf("Preview of height %d has %d lines:\n%s", height, len(lines), preview)
+		}
+		if height >= 3 && (lines[0] != "Dune" || lines[1] != "Frank Herbert") {
+			t.Errorf("Preview of height %d doesn't start with the book:\n%s", height, preview)
+		}
+	}
+	if !strings.Contains(bookPreview(bm, 30, 1000), "word9") {
+		t.Errorf("A tall preview should have every highlight")
+	}
+	if got := bookPreview(&bookmark.Bookmarks{Book: "Emma", Markups: []*bookmark.Markup{{}}}, 30, 10); !strings.Contains(got, "No highlights, 1 markups") {
+		t.Errorf("Preview without highlights = %q", got)
+	}
+}
+
+func TestFailedBooks(t *testing.T) {
+	out := t.TempDir()
+	// a file where the book folder should be, so its highlights can't be written
+	if err := os.WriteFile(filepath.Join(out, "Emma"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	bookmarks := []*bookmark.Bookmarks{}
+	for _, book := range []string{"Dune", "Emma"} {
+		bookmarks = append(bookmarks, &bookmark.Bookmarks{
+			Book:       book,
+			Highlights: []*bookmark.Highlight{bookmark.NewHighlight("Some text.", 0)},
+		})
+	}
+
+	err := processHighlights(bookmarks, "", nil, out, FORMAT_TXT, "", "", export.AnkiOptions{})
+	failed, onlyBooks := failedBooks(errors.Join(err, nil))
+	if !onlyBooks || !slices.Equal(failed, []string{"Emma"}) {
+		t.Errorf("Failed books = %q, %v, want only Emma: %v", failed, onlyBooks, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(out, "Dune", "*.txt")); len(files) != 1 {
+		t.Errorf("Dune files = %q, want one", files)
+	}
+
+	if _, onlyBooks := failedBooks(errors.Join(err, fmt.Errorf("Could not load the palette"))); onlyBooks {
+		t.Errorf("Want an error that isn't about a book to fail them all")
+	}
+	if failed, onlyBooks := failedBooks(nil); !onlyBooks || len(failed) != 0 {
+		t.Errorf("Failed books without an error = %q, %v", failed, onlyBooks)
+	}
+}
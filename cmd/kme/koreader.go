@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/epub"
+	"kme/internal/export"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+func koreader() *cli.Command {
+	return &cli.Command{
+		Name:   "koreader",
+		Usage:  "Write highlights and notes into KOReader sidecar files next to each book in the device",
+		Action: handleKOReader,
+		Before: applyProfile,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "device",
+				Sources: cli.EnvVars("KME_DEVICE"),
+				Usage:   "Location to the Kobo device. Defaults to the only Kobo mounted",
+				Action:  validateDevice(true),
+			},
+			&cli.BoolFlag{
+				Name:  "overwrite",
+				Usage: "Add the highlights to existing KOReader sidecar files too, merged with their annotations (a dated .old copy is kept)",
+				Value: false,
+			},
+		},
+	}
+}
+
+func handleKOReader(ctx context.Context, cmd *cli.Command) error {
+	device, err := deviceOrDiscover(ctx, cmd, true)
+	if err != nil {
+		return err
+	}
+	dbPath := filepath.Join(device, DB_DIR)
+	overwrite := cmd.Bool("overwrite")
+
+	if err := bookmark.ConnectKoboDB(dbPath); err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer bookmark.CloseKoboDB()
+
+	fmt.Println("Finding all bookmarks...")
+	bookmarks := allBookmarks(bookmark.AllBooks())
+
+	for _, bm := range bookmarks {
+		if len(bm.Highlights) == 0 {
+			continue
+		}
+		if err := exportKOReader(bm, device, overwrite); err != nil {
+			fmt.Printf("\t- %s: %s\n", bm.Book, err)
+		}
+	}
+
+	return nil
+}
+
+func exportKOReader(bm *bookmark.Bookmarks, device string, overwrite bool) error {
+	bookPath := bm.DevicePath(device)
+	if bookPath == "" {
+		return fmt.Errorf("book is not a readable file in the device, KOReader can't open it")
+	}
+
+	sidecar := export.KOReaderSidecar(bookPath)
+	existing, err := os.ReadFile(sidecar)
+	if err == nil && !overwrite {
+		return fmt.Errorf("KOReader sidecar already exists, skipping (use --overwrite to add the highlights to it)")
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not read the existing sidecar: %w", err)
+	}
+
+	book, err := epub.Open(bookPath)
+	if err != nil {
+		return err
+	}
+	defer book.Close()
+
+	// everything is done in memory first, the sidecar is only touched once it's all ready
+	out := bytes.Buffer{}
+	docPath := strings.TrimPrefix(bm.ContentId, "file://")
+	skipped, err := export.WriteKOReader(&out, bm, book, docPath, existing)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sidecar), 0755); err != nil {
+		return fmt.Errorf("Could not create sidecar directory: %w", err)
+	}
+	if existing != nil {
+		// a copy per run, an older one is never replaced
+		old := fmt.Sprintf("%s.%s.old", sidecar, time.Now().Format("20060102150405"))
+		if _, err := os.Stat(old); os.IsNotExist(err) {
+			if err := os.WriteFile(old, existing, 0644); err != nil {
+				return fmt.Errorf("Could not keep a copy of the existing sidecar: %w", err)
+			}
+		}
+	}
+	tmp := sidecar + ".kme"
+	if err := os.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Could not create KOReader sidecar %s: %w", sidecar, err)
+	}
+	if err := os.Rename(tmp, sidecar); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Could not create KOReader sidecar %s: %w", sidecar, err)
+	}
+
+	fmt.Printf("\t- %s => %s\n", bm.Book, sidecar)
+	if skipped > 0 {
+		fmt.Printf("\t  %d highlights could not be located in the book file\n", skipped)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kme/internal/bookmark"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Flags of the commands that read the whole library, from a device or from the archive
+func libraryFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "device",
+			Usage:   "Location to the Kobo device. Defaults to the only Kobo mounted",
+			Sources: cli.EnvVars("KME_DEVICE"),
+			Action:  validateDevice(true),
+		},
+		&cli.BoolFlag{
+			Name:  "from-archive",
+			Usage: "Read the bookmarks from the archive instead of a device",
+		},
+		&cli.StringFlag{
+			Name:    "archive",
+			Usage:   "Location of the archive database",
+			Value:   defaultArchivePath(),
+			Sources: cli.EnvVars("KME_ARCHIVE"),
+		},
+	}
+}
+
+// Every book with bookmarks, from the device or the archive as the libraryFlags say. markPath is
+// where their markup images are. When reading the archive they are written to cacheDir, or not at
+// all if it's empty
+func loadLibrary(ctx context.Context, cmd *cli.Command, cacheDir string) (bookmarks []*bookmark.Bookmarks, markPath string, err error) {
+	if cmd.Bool("from-archive") {
+		if err := bookmark.ConnectArchive(cmd.String("archive"), cacheDir); err != nil {
+			return nil, "", cli.Exit(err, 1)
+		}
+		defer bookmark.CloseKoboDB()
+		return allBookmarks(bookmark.AllBooks()), cacheDir, nil
+	}
+
+	device, err := deviceOrDiscover(ctx, cmd, true)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := bookmark.ConnectKoboDB(filepath.Join(device, DB_DIR)); err != nil {
+		return nil, "", cli.Exit(err, 1)
+	}
+	defer bookmark.CloseKoboDB()
+	return allBookmarks(bookmark.AllBooks()), filepath.Join(device, MARK_DIR), nil
+}
+
+// bookmark.AllBookmarks, with what couldn't be read reported as a warning. Whatever could be read
+// is still worth exporting
+func allBookmarks(books []string) []*bookmark.Bookmarks {
+	bookmarks, err := bookmark.AllBookmarks(books)
+	warn(err)
+	return bookmarks
+}
+
+// Problems that don't stop a command, e.g. a markup whose images are missing. They go to stderr,
+// so they don't end up in the middle of --format json output
+func warn(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
@@ -4,39 +4,70 @@ import (
 	"context"
 	"fmt"
 	"kme/internal/bookmark"
+	"kme/internal/export"
 	"os"
 	"path/filepath"
+	"slices"
 
 	"github.com/urfave/cli/v3"
 )
 
+var listFormats = []string{FORMAT_TXT, FORMAT_JSON, FORMAT_NDJSON}
+
 func list() *cli.Command {
 	return &cli.Command{
 		Name:   "list-books",
 		Usage:  "List books with bookmarks",
 		Action: handleList,
+		Before: applyProfile,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:   "device",
-				Required: true,
-				Action: validateDevice(true),
+				Name:    "device",
+				Sources: cli.EnvVars("KME_DEVICE"),
+				Usage:   "Location to the Kobo device. Defaults to the only Kobo mounted",
+				Action:  validateDevice(true),
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: fmt.Sprintf("Output format, one of %v", listFormats),
+				Value: FORMAT_TXT,
+				Validator: func(format string) error {
+					if !slices.Contains(listFormats, format) {
+						return fmt.Errorf("Unknown format %s, must be one of %v", format, listFormats)
+					}
+					return nil
+				},
 			},
 		},
 	}
 }
 
 func handleList(ctx context.Context, cmd *cli.Command) error {
-	device := cmd.String("device")
+	device, err := deviceOrDiscover(ctx, cmd, true)
+	if err != nil {
+		return err
+	}
 	dbPath := filepath.Join(device, DB_DIR)
+	markPath := filepath.Join(device, MARK_DIR)
 
 	if err := bookmark.ConnectKoboDB(dbPath); err != nil {
-		cli.Exit(err, 1)
+		return cli.Exit(err, 1)
 	}
 
 	books := bookmark.AllBooks()
-	fmt.Printf("Found %d books:\n", len(books))
-	for _, b := range books {
-		fmt.Println("\t- ", b)
+
+	switch cmd.String("format") {
+	case FORMAT_JSON:
+		return export.WriteJSON(os.Stdout, allBookmarks(books), markPath, false)
+	case FORMAT_NDJSON:
+		return export.WriteNDJSON(os.Stdout, allBookmarks(books), markPath, false)
+	case FORMAT_TXT:
+		fmt.Printf("Found %d books:\n", len(books))
+		for _, b := range books {
+			fmt.Println("\t- ", b)
+		}
+	default:
+		return cli.Exit("Unknown format "+cmd.String("format"), 1)
 	}
 
 	return nil
@@ -48,14 +79,15 @@ func validateDevice(isList bool) func(context.Context, *cli.Command, string) err
 		dbPath := filepath.Join(device, DB_DIR)
 		markPath := filepath.Join(device, MARK_DIR)
 
-		if fi, err := os.Stat(device); os.IsNotExist(err) || !fi.IsDir() {
+		if fi, err := os.Stat(device); err != nil || !fi.IsDir() {
 			return cli.Exit("Provided device does not exist or is not a directory", 1)
 		}
 		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
 			return cli.Exit("provided Kobo database does not exist", 1)
 		}
 
-		if fi, err := os.Stat(markPath); (os.IsNotExist(err) && !isList) || !fi.IsDir() {
+		// Kobos that never had a stylus have no markups directory, which is fine when only reading
+		if fi, err := os.Stat(markPath); (os.IsNotExist(err) && !isList) || (err == nil && !fi.IsDir()) {
 			return cli.Exit("provided markups directory does not exist or is not a directory", 1)
 		}
 
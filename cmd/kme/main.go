@@ -9,17 +9,32 @@ import (
 )
 
 const (
-	DB_DIR      = ".kobo/KoboReader.sqlite"
-	MARK_DIR    = ".kobo/markups"
-	TMP_IMG_DIR = "tempimg"
-	OUT_DIR     = "./kme-out"
+	DB_DIR       = ".kobo/KoboReader.sqlite"
+	MARK_DIR     = ".kobo/markups"
+	TMP_IMG_DIR  = "tempimg"
+	OUT_DIR      = "./kme-out"
+	ARCHIVE_FILE = "archive.sqlite"
 )
 
 func main() {
 	rootCmd := &cli.Command{
+		Flags: configFlags(),
 		Commands: []*cli.Command{
 			extract(),
 			list(),
+			devices(),
+			calibreCmd(),
+			koreader(),
+			backupCmd(),
+			restore(),
+			watch(),
+			searchCmd(),
+			browseCmd(),
+			serve(),
+			site(),
+			api(),
+			statsCmd(),
+			configCmd(),
 		},
 	}
 
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kme/internal/backup"
+	"kme/internal/bookmark"
+	"kme/internal/utils"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+func restore() *cli.Command {
+	return &cli.Command{
+		Name: "restore",
+		Usage: "Restore bookmarks from a backup or the archive into the books of a device. " +
+			"Runs on a copy of the Kobo DB unless --apply is given",
+		Action: handleRestore,
+		Before: applyProfile,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "device",
+				Sources:  cli.EnvVars("KME_DEVICE"),
+				Usage:    "Location to the Kobo device to restore into",
+				Required: true,
+				Action:   validateDevice(true),
+			},
+			&cli.StringFlag{
+				Name:  "backup",
+				Usage: "Backup made with 'kme backup' to restore from",
+			},
+			&cli.BoolFlag{
+				Name:  "from-archive",
+				Usage: "Restore from the archive instead of a backup",
+			},
+			&cli.StringFlag{
+				Name:    "archive",
+				Sources: cli.EnvVars("KME_ARCHIVE"),
+				Usage:   "Location of the archive database",
+				Value:   defaultArchivePath(),
+			},
+			&cli.BoolFlag{
+				Name:  "apply",
+				Usage: "Replace the Kobo DB of the device with the restored copy (the current one is kept as .bak)",
+			},
+			&cli.BoolFlag{
+				Name:  "verbose",
+				Usage: "List every skipped bookmark, not only the conflicts",
+			},
+		},
+	}
+}
+
+func handleRestore(ctx context.Context, cmd *cli.Command) error {
+	device := cmd.String("device")
+	backupPath := cmd.String("backup")
+	fromArchive := cmd.Bool("from-archive")
+	apply := cmd.Bool("apply")
+	dbPath := filepath.Join(device, DB_DIR)
+	markPath := filepath.Join(device, MARK_DIR)
+
+	if (backupPath == "") == !fromArchive {
+		return cli.Exit("Restore from either --backup or --from-archive", 1)
+	}
+
+	workDir, err := os.MkdirTemp("", "kme-restore")
+	if err != nil {
+		return cli.Exit("Error creating temporary directory", 1)
+	}
+	defer os.RemoveAll(workDir)
+
+	// everything is restored into a copy, the device is only touched with --apply
+	workDb := filepath.Join(workDir, "KoboReader.sqlite")
+	workMarks := filepath.Join(workDir, "markups")
+	if err := bookmark.CopyKoboDB(dbPath, workDb); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var report *bookmark.RestoreReport
+	if fromArchive {
+		fmt.Println("Restoring from", cmd.String("archive"))
+		report, err = bookmark.RestoreFromArchive(cmd.String("archive"), filepath.Join(workDir, "archived"), workDb, workMarks)
+	} else {
+		fmt.Println("Restoring from", backupPath)
+		srcDir := filepath.Join(workDir, "backup")
+		if err := backup.Extract(backupPath, srcDir); err != nil {
+			return cli.Exit(err, 1)
+		}
+		report, err = bookmark.RestoreFromKoboDB(
+			filepath.Join(srcDir, DB_DIR), filepath.Join(srcDir, MARK_DIR), workDb, workMarks,
+		)
+	}
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	printRestoreReport(report, cmd.Bool("verbose"))
+
+	if len(report.Restored) == 0 {
+		fmt.Println("Nothing to restore, the device was not changed")
+		return nil
+	}
+	if !apply {
+		fmt.Println("Nothing was changed on the device, run again with --apply to write the restored bookmarks")
+		return nil
+	}
+
+	bakPath, err := replaceKoboDB(dbPath, workDb)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Println("Previous Kobo DB kept as", bakPath)
+	if err := copyDir(workMarks, markPath); err != nil {
+		return cli.Exit(fmt.Sprintf("Error copying markups to the device: %v", err), 1)
+	}
+	fmt.Println("Restored bookmarks written to the device, eject it so the Kobo picks them up")
+	return nil
+}
+
+func printRestoreReport(report *bookmark.RestoreReport, verbose bool) {
+	fmt.Printf("Restored %d, skipped %d, conflicted %d bookmarks\n",
+		len(report.Restored), len(report.Skipped), len(report.Conflicted))
+
+	for _, item := range report.Conflicted {
+		fmt.Printf("\t- conflict %s (%s): %s\n", item.Id, item.Book, item.Reason)
+	}
+	if !verbose {
+		return
+	}
+	for _, item := range report.Skipped {
+		fmt.Printf("\t- skipped %s (%s): %s\n", item.Id, item.Book, item.Reason)
+	}
+}
+
+// Moves the current DB (and its WAL, which belongs to it) aside as .bak and puts the restored copy
+// in its place. Returns where the old DB was kept
+func replaceKoboDB(dbPath string, restored string) (string, error) {
+	bakPath := fmt.Sprintf("%s.%s.bak", dbPath, time.Now().Format("200601021504"))
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if _, err := os.Stat(dbPath + suffix); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(dbPath+suffix, bakPath+suffix); err != nil {
+			return "", fmt.Errorf("Could not back up %s: %w", dbPath+suffix, err)
+		}
+	}
+	if err := utils.CopyFile(restored, dbPath); err != nil {
+		return "", fmt.Errorf("Could not write restored Kobo DB, the previous one is in %s: %w", bakPath, err)
+	}
+	return bakPath, nil
+}
+
+// Copies the files of src into dst, not recursive (markups are a flat directory)
+func copyDir(src string, dst string) error {
+	entries, err := os.ReadDir(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err := utils.CopyFile(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
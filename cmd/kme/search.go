@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/search"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+func searchCmd() *cli.Command {
+	flags := append(libraryFlags(),
+		&cli.StringFlag{
+			Name:  "book",
+			Usage: "Only books with this in the title",
+		},
+		&cli.StringSliceFlag{
+			Name:  "color",
+			Usage: "Only highlights of this color. Can be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "Only highlights made on or after this date (YYYY-MM-DD)",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "Only highlights made before this date (YYYY-MM-DD)",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "Maximum number of results, 0 for all",
+			Value: 20,
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: fmt.Sprintf("Output format, one of %v", []string{FORMAT_TXT, FORMAT_JSON}),
+			Value: FORMAT_TXT,
+		},
+	)
+
+	return &cli.Command{
+		Name: "search",
+		Usage: "Search highlights, notes and book titles. Words must all match, use \"quotes\" for " +
+			"phrases and a trailing * for prefixes",
+		ArgsUsage: "<query>",
+		Action:    handleSearch,
+		Before:    applyProfile,
+		Flags:     flags,
+	}
+}
+
+func handleSearch(ctx context.Context, cmd *cli.Command) error {
+	query := strings.Join(cmd.Args().Slice(), " ")
+	if strings.TrimSpace(query) == "" {
+		return cli.Exit("Provide something to search for", 1)
+	}
+	filter, err := searchFilter(cmd)
+	if err != nil {
+		return err
+	}
+
+	bookmarks, _, err := loadLibrary(ctx, cmd, "")
+	if err != nil {
+		return err
+	}
+	idx, err := search.NewIndex(bookmarks)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer idx.Close()
+
+	results, err := idx.Search(query, filter)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	switch cmd.String("format") {
+	case FORMAT_JSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]any{"query": query, "results": results})
+	case FORMAT_TXT:
+		printResults(results)
+	default:
+		return cli.Exit("Unknown format "+cmd.String("format"), 1)
+	}
+	return nil
+}
+
+func searchFilter(cmd *cli.Command) (search.Filter, error) {
+	filter := search.Filter{Book: cmd.String("book"), Limit: cmd.Int("limit")}
+
+	h := &bookmark.Highlight{}
+	for _, c := range cmd.StringSlice("color") {
+		code, ok := h.ColorCode(c)
+		if !ok {
+			return filter, cli.Exit("Unknown color "+c, 1)
+		}
+		filter.Colors = append(filter.Colors, code)
+	}
+
+	var err error
+	if filter.Since, err = parseDay(cmd.String("since")); err != nil {
+		return filter, cli.Exit("Invalid --since, must be YYYY-MM-DD", 1)
+	}
+	if filter.Until, err = parseDay(cmd.String("until")); err != nil {
+		return filter, cli.Exit("Invalid --until, must be YYYY-MM-DD", 1)
+	}
+	return filter, nil
+}
+
+// Local midnight of the day, zero for an empty string
+func parseDay(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(time.DateOnly, s, time.Local)
+}
+
+func printResults(results []*search.Result) {
+	if len(results) == 0 {
+		fmt.Println("No highlights found")
+		return
+	}
+	h := &bookmark.Highlight{}
+	for _, r := range results {
+		fmt.Printf("%c %s — %s (%d%%)\n", h.Colors(r.Color), r.Book, r.Section, int(r.ChapterProgress*100))
+		fmt.Println("\t", strings.Join(strings.Fields(r.Snippet), " "))
+		if r.Note != "" {
+			fmt.Println("\t note:", r.Note)
+		}
+	}
+	fmt.Printf("%d highlights found\n", len(results))
+}
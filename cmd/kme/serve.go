@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kme/internal/export"
+	"kme/internal/web"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+func serve() *cli.Command {
+	flags := append(libraryFlags(),
+		&cli.StringFlag{
+			Name:    "addr",
+			Sources: cli.EnvVars("KME_ADDR"),
+			Usage:   "Address to listen on. Keep it on localhost unless you want others to see your notes",
+			Value:   "localhost:8080",
+		},
+		&cli.StringFlag{
+			Name:    "palette",
+			Sources: cli.EnvVars("KME_PALETTE"),
+			Usage:   fmt.Sprintf("Highlight colors, one of %v or a JSON file", export.PaletteNames()),
+			Value:   export.DEFAULT_PALETTE,
+		},
+		&cli.IntFlag{
+			Name:    "quality",
+			Sources: cli.EnvVars("KME_QUALITY"),
+			Usage:   "Quality of the markup images and PDFs. [1,100] higher is better",
+			Value:   75,
+		},
+	)
+
+	return &cli.Command{
+		Name:   "serve",
+		Usage:  "Browse the library in a web browser, served from this computer",
+		Action: handleServe,
+		Before: applyProfile,
+		Flags:  flags,
+	}
+}
+
+func handleServe(ctx context.Context, cmd *cli.Command) error {
+	palette, err := export.LoadPalette(cmd.String("palette"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	// markups of the archive are rendered from here
+	cacheDir, err := os.MkdirTemp("", "kme-markups")
+	if err != nil {
+		return cli.Exit("Error creating temporary directory for markups", 1)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	bookmarks, markPath, err := loadLibrary(ctx, cmd, cacheDir)
+	if err != nil {
+		return err
+	}
+	server, err := web.New(bookmarks, markPath, palette, cmd.Int("quality"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer server.Close()
+
+	return listenAndServe(ctx, cmd.String("addr"), server.Handler(), fmt.Sprintf("Serving %d books", len(bookmarks)))
+}
+
+// Serves until Ctrl+C, what tells what is served
+func listenAndServe(ctx context.Context, addr string, handler http.Handler, what string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("Could not listen on %s: %w", addr, err), 1)
+	}
+	httpServer := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdown)
+	}()
+
+	fmt.Printf("%s on http://%s, Ctrl+C to stop\n", what, listener.Addr())
+	if err := httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return cli.Exit(err, 1)
+	}
+	return nil
+}
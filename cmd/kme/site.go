@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/export"
+	"kme/internal/web"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v3"
+)
+
+func site() *cli.Command {
+	flags := append(libraryFlags(),
+		&cli.StringFlag{
+			Name:     "out",
+			Usage:    "Directory of the site. Pages of books no longer in the library are removed from it",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "palette",
+			Sources: cli.EnvVars("KME_PALETTE"),
+			Usage:   fmt.Sprintf("Highlight colors, one of %v or a JSON file", export.PaletteNames()),
+			Value:   export.DEFAULT_PALETTE,
+		},
+		&cli.IntFlag{
+			Name:    "quality",
+			Sources: cli.EnvVars("KME_QUALITY"),
+			Usage:   "Quality of the markup images. [1,100] higher is better",
+			Value:   75,
+		},
+	)
+
+	return &cli.Command{
+		Name:   "site",
+		Usage:  "Write the library as a static HTML site, to publish it or keep it in git",
+		Action: handleSite,
+		Before: applyProfile,
+		Flags:  flags,
+	}
+}
+
+func handleSite(ctx context.Context, cmd *cli.Command) error {
+	out := cmd.String("out")
+	palette, err := export.LoadPalette(cmd.String("palette"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	cacheDir, err := os.MkdirTemp("", "kme-markups")
+	if err != nil {
+		return cli.Exit("Error creating temporary directory for markups", 1)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	// only the device knows the shelves
+	var shelves map[string][]string
+	if !cmd.Bool("from-archive") {
+		dev, err := deviceOrDiscover(ctx, cmd, true)
+		if err != nil {
+			return err
+		}
+		cmd.Set("device", dev)
+		if shelves, err = readShelves(dev); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	bookmarks, markPath, err := loadLibrary(ctx, cmd, cacheDir)
+	if err != nil {
+		return err
+	}
+	server, err := web.New(bookmarks, markPath, palette, cmd.Int("quality"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer server.Close()
+
+	fmt.Printf("Writing the site of %d books to %s\n", len(bookmarks), out)
+	if err := server.WriteSite(out, shelves); errors.Is(err, web.ErrMissingImages) {
+		warn(err)
+	} else if err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Println("Site written, open", filepath.Join(out, web.SITE_INDEX))
+	return nil
+}
+
+func readShelves(dev string) (map[string][]string, error) {
+	if err := bookmark.ConnectKoboDB(filepath.Join(dev, DB_DIR)); err != nil {
+		return nil, err
+	}
+	defer bookmark.CloseKoboDB()
+	return bookmark.Shelves()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/epub"
+	"kme/internal/export"
+	"kme/internal/stats"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v3"
+)
+
+func statsCmd() *cli.Command {
+	flags := append(libraryFlags(),
+		&cli.StringFlag{
+			Name:    "out",
+			Sources: cli.EnvVars("KME_OUT"),
+			Usage:   "Output directory, the charts are written to its stats folder",
+			Value:   OUT_DIR,
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: fmt.Sprintf("Format of the summary, %s or %s", FORMAT_TXT, FORMAT_JSON),
+			Value: FORMAT_TXT,
+			Validator: func(format string) error {
+				if format != FORMAT_TXT && format != FORMAT_JSON {
+					return fmt.Errorf("Unknown summary format %s, use %s or %s", format, FORMAT_TXT, FORMAT_JSON)
+				}
+				return nil
+			},
+		},
+		&cli.StringFlag{
+			Name:    "palette",
+			Sources: cli.EnvVars("KME_PALETTE"),
+			Usage:   fmt.Sprintf("Colors of the highlight color chart, one of %v or a JSON file", export.PaletteNames()),
+			Value:   export.DEFAULT_PALETTE,
+		},
+	)
+
+	return &cli.Command{
+		Name:  "stats",
+		Usage: "Statistics of the library",
+		Commands: []*cli.Command{
+			{
+				Name: "annotations",
+				Usage: "Highlights and markups per book, chapter, color and month, with SVG charts of them, " +
+					"of where they are through each book and of the days they were made",
+				Action: handleStatsAnnotations,
+				Before: applyProfile,
+				Flags:  flags,
+			},
+		},
+	}
+}
+
+func handleStatsAnnotations(ctx context.Context, cmd *cli.Command) error {
+	palette, err := export.LoadPalette(cmd.String("palette"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	// the book files are only on the device, without them density is spread over the chapters
+	var locate stats.Locator
+	if !cmd.Bool("from-archive") {
+		dev, err := deviceOrDiscover(ctx, cmd, true)
+		if err != nil {
+			return err
+		}
+		cmd.Set("device", dev)
+		books := &bookFiles{device: dev, open: map[*bookmark.Bookmarks]*epub.Book{}}
+		defer books.Close()
+		locate = books.locate
+	}
+
+	bookmarks, _, err := loadLibrary(ctx, cmd, "")
+	if err != nil {
+		return err
+	}
+	summary := stats.Compute(bookmarks, locate)
+
+	dir := filepath.Join(cmd.String("out"), "stats")
+	paths, err := summary.WriteCharts(dir, palette)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if cmd.String("format") == FORMAT_JSON {
+		data, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	if err := printStats(summary); err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Println()
+	fmt.Println("Charts written to", dir)
+	for _, p := range paths {
+		fmt.Println(" ", filepath.Base(p))
+	}
+	return nil
+}
+
+func printStats(summary *stats.Stats) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "BOOK\tAUTHOR\tCHAPTERS\tHIGHLIGHTS\tMARKUPS\n")
+	for _, b := range summary.Books {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", b.Book, b.Author, len(b.Chapters), b.Highlights, b.Markups)
+	}
+	fmt.Fprintf(w, "TOTAL\t\t\t%d\t%d\n", summary.Total.Highlights, summary.Total.Markups)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "COLOR\tHIGHLIGHTS\n")
+	for _, c := range summary.Colors {
+		fmt.Fprintf(w, "%s\t%d\n", c.Name, c.Highlights)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "MONTH\tHIGHLIGHTS\tMARKUPS\n")
+	for _, m := range summary.Months {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", m.Month, m.Highlights, m.Markups)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if summary.Undated > 0 {
+		fmt.Printf("%d annotations have no date\n", summary.Undated)
+	}
+	return nil
+}
+
+// The book files of the device, opened once each to place annotations through them
+type bookFiles struct {
+	device string
+	open   map[*bookmark.Bookmarks]*epub.Book
+}
+
+func (self *bookFiles) locate(bm *bookmark.Bookmarks, chapterHref string, chapterProgress float64) (float64, bool) {
+	book, ok := self.open[bm]
+	if !ok {
+		// nil too when it can't be opened, not to try again
+		if bookPath := bm.DevicePath(self.device); bookPath != "" {
+			book, _ = epub.Open(bookPath)
+		}
+		self.open[bm] = book
+	}
+	if book == nil || len(book.Spine) == 0 {
+		return 0, false
+	}
+	i := book.SpineIndex(chapterHref)
+	if i < 0 {
+		return 0, false
+	}
+	return (float64(i) + min(max(chapterProgress, 0), 1)) / float64(len(book.Spine)), true
+}
+
+func (self *bookFiles) Close() {
+	for _, book := range self.open {
+		if book != nil {
+			book.Close()
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kme/internal/device"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+const WATCH_STATE_FILE = "watch.json"
+
+// Longest wait before trying again a device whose extraction failed
+const WATCH_MAX_BACKOFF = 5 * time.Minute
+
+// Flags of extract that make no sense without someone at the keyboard, or are replaced by --mount
+var watchSkipFlags = []string{"device", "select", "from-archive", "copy"}
+
+func watch() *cli.Command {
+	flags := []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "mount",
+			Usage: "Where the Kobo gets mounted. Can be repeated. If not given, any Kobo found as in 'kme devices'",
+		},
+		&cli.DurationFlag{
+			Name:  "interval",
+			Usage: "How often to look for the device",
+			Value: 5 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "state",
+			Usage: "File where watch remembers what was already extracted from each device",
+			Value: defaultStatePath(),
+		},
+	}
+	for _, f := range extractFlags() {
+		if !slices.Contains(watchSkipFlags, f.Names()[0]) {
+			flags = append(flags, f)
+		}
+	}
+
+	return &cli.Command{
+		Name:   "watch",
+		Usage:  "Wait for the Kobo to be mounted and extract the bookmarks new since the last time",
+		Action: handleWatch,
+		Before: applyProfile,
+		Flags:  flags,
+	}
+}
+
+// $XDG_STATE_HOME/kme/watch.json, or ~/.local/state/kme/watch.json if not set
+func defaultStatePath() string {
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return WATCH_STATE_FILE
+		}
+		stateDir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateDir, "kme", WATCH_STATE_FILE)
+}
+
+func handleWatch(ctx context.Context, cmd *cli.Command) error {
+	mounts := cmd.StringSlice("mount")
+	interval := cmd.Duration("interval")
+	statePath := cmd.String("state")
+
+	opts, err := extractOptionsFrom(cmd)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(mounts) > 0 {
+		fmt.Println("Waiting for a Kobo in", mounts)
+	} else {
+		fmt.Println("Waiting for a Kobo to be mounted")
+	}
+
+	// devices already handled, until they go away
+	seen := map[string]bool{}
+	// devices whose extraction failed, tried again later and later while they stay plugged in
+	retries := map[string]*watchRetry{}
+	for {
+		found, err := findKobos(mounts)
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		for path := range seen {
+			if !slices.Contains(found, path) {
+				fmt.Println("Kobo removed from", path)
+				delete(seen, path)
+			}
+		}
+		for path := range retries {
+			if !slices.Contains(found, path) {
+				delete(retries, path)
+			}
+		}
+		for _, path := range found {
+			retry := retries[path]
+			if seen[path] || (retry != nil && time.Now().Before(retry.next)) {
+				continue
+			}
+			if retry == nil {
+				fmt.Println("Kobo found in", path)
+			}
+			var written map[string]time.Time
+			if retry != nil {
+				written = retry.written
+			}
+			written, err := watchExtract(opts, path, statePath, written)
+			if err != nil {
+				if retry == nil {
+					retry = &watchRetry{wait: interval}
+					retries[path] = retry
+				} else {
+					retry.wait = min(2*retry.wait, WATCH_MAX_BACKOFF)
+				}
+				retry.next = time.Now().Add(retry.wait)
+				retry.written = written
+				fmt.Printf("Extraction failed, trying again in %s: %v\n", retry.wait, err)
+				continue
+			}
+			delete(retries, path)
+			seen[path] = true
+		}
+
+		select {
+		case <-ctx.Done():
+			fmt.Println("Stopped watching")
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+type watchRetry struct {
+	wait time.Duration
+	next time.Time
+	// books already written by the failed tries, so trying again doesn't write them twice
+	written map[string]time.Time
+}
+
+func findKobos(mounts []string) ([]string, error) {
+	found := []string{}
+	if len(mounts) == 0 {
+		for _, d := range device.Discover() {
+			found = append(found, d.Path)
+		}
+		return found, nil
+	}
+	for _, m := range mounts {
+		if device.IsKobo(m) {
+			found = append(found, m)
+		}
+	}
+	return found, nil
+}
+
+// Extracts the books with bookmarks changed since the last extraction from this device, but the
+// ones already written by an earlier try. The state only moves on once every book is written, until
+// then the books written so far are returned to skip them when trying again
+func watchExtract(opts *extractOptions, path string, statePath string, written map[string]time.Time) (map[string]time.Time, error) {
+	state, err := readWatchState(statePath)
+	if err != nil {
+		return written, err
+	}
+	id := device.Id(path)
+
+	run := *opts
+	run.devices = []string{path}
+	run.since = state[id]
+	run.written = written
+	extracted, err := runExtract(&run)
+	if extracted != nil {
+		written = maps.Clone(written)
+		if written == nil {
+			written = map[string]time.Time{}
+		}
+		maps.Copy(written, extracted.written)
+	}
+	if err != nil {
+		return written, err
+	}
+
+	if extracted.latest.After(state[id]) {
+		state[id] = extracted.latest
+		if err := writeWatchState(statePath, state); err != nil {
+			return written, err
+		}
+	}
+	return nil, nil
+}
+
+// When the latest extracted bookmark was created or modified, by device id
+func readWatchState(statePath string) (map[string]time.Time, error) {
+	state := map[string]time.Time{}
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read watch state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Could not read watch state %s: %w", statePath, err)
+	}
+	return state, nil
+}
+
+func writeWatchState(statePath string, state map[string]time.Time) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not write watch state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return fmt.Errorf("Could not write watch state: %w", err)
+	}
+	if err := os.WriteFile(statePath, data, 0644); err != nil {
+		return fmt.Errorf("Could not write watch state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package backup
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kme/internal/bookmark"
+	"kme/internal/device"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	MANIFEST_FILE    = "manifest.json"
+	MANIFEST_VERSION = 1
+
+	dbFile    = ".kobo/KoboReader.sqlite"
+	markDir   = ".kobo/markups"
+	backupExt = ".zip"
+)
+
+// Describes everything in a backup. Paths are relative to the root of the device, so the zip can be
+// extracted right over it. Bookmarks lists every row of the Bookmark table in the Kobo DB, dogears
+// included, and markups with the
+// checksums of their SVG/JPG pair; a missing pair means the device didn't have it either
+type Manifest struct {
+	Version   int         `json:"version"`
+	Created   time.Time   `json:"created"`
+	Device    *DeviceInfo `json:"device,omitempty"`
+	Files     []*File     `json:"files"`
+	Bookmarks []*Bookmark `json:"bookmarks"`
+}
+
+type DeviceInfo struct {
+	Serial   string `json:"serial"`
+	Firmware string `json:"firmware"`
+	ModelId  string `json:"model_id"`
+}
+
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type Bookmark struct {
+	Id   string `json:"id"`
+	Book string `json:"book"`
+	Type string `json:"type"`
+	Svg  *File  `json:"svg,omitempty"`
+	Jpg  *File  `json:"jpg,omitempty"`
+}
+
+func FileName(now time.Time) string {
+	return now.Format("200601021504") + "-kobo-backup" + backupExt
+}
+
+// Writes the Kobo DB, the markups directory and the version file of the device as a zip, with its
+// manifest as the last entry. entries are the rows of the Bookmark table, read from the same Kobo DB
+func Write(w io.Writer, devicePath string, entries []*bookmark.Entry) (*Manifest, error) {
+	manifest := &Manifest{
+		Version:   MANIFEST_VERSION,
+		Created:   time.Now().UTC().Truncate(time.Second),
+		Files:     []*File{},
+		Bookmarks: []*Bookmark{},
+	}
+	if info, err := device.ReadVersion(devicePath); err == nil {
+		manifest.Device = &DeviceInfo{Serial: info.Serial, Firmware: info.Firmware, ModelId: info.ModelId}
+	}
+
+	paths := []string{dbFile, device.VERSION_FILE}
+	// changes not yet checkpointed into the DB live in the WAL
+	for _, p := range []string{dbFile + "-wal", dbFile + "-shm"} {
+		if _, err := os.Stat(filepath.Join(devicePath, p)); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	marks, err := markupFiles(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	paths = append(paths, marks...)
+
+	zw := zip.NewWriter(w)
+	files := map[string]*File{}
+	for _, p := range paths {
+		f, err := addFile(zw, devicePath, p)
+		if os.IsNotExist(err) && p == device.VERSION_FILE {
+			// copies of the .kobo folder may not have it
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, f)
+		files[p] = f
+	}
+
+	markPath := filepath.Join(devicePath, markDir)
+	for _, e := range entries {
+		b := &Bookmark{Id: e.Id, Book: e.Book, Type: e.Type}
+		if e.Type == bookmark.MARKUP {
+			m := &bookmark.Markup{Id: e.Id}
+			b.Svg = files[relPath(devicePath, m.SvgFile(markPath))]
+			b.Jpg = files[relPath(devicePath, m.JpgFile(markPath))]
+		}
+		manifest.Bookmarks = append(manifest.Bookmarks, b)
+	}
+
+	mw, err := zw.Create(MANIFEST_FILE)
+	if err != nil {
+		return nil, fmt.Errorf("Error writing backup manifest: %w", err)
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return nil, fmt.Errorf("Error writing backup manifest: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("Error writing backup: %w", err)
+	}
+	return manifest, nil
+}
+
+// Every file under the markups directory, relative to the device and sorted
+func markupFiles(devicePath string) ([]string, error) {
+	files := []string{}
+	root := filepath.Join(devicePath, markDir)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return files, nil
+	}
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, relPath(devicePath, path))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not read markups directory: %w", err)
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+func relPath(devicePath string, path string) string {
+	rel, err := filepath.Rel(devicePath, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+func addFile(zw *zip.Writer, devicePath string, name string) (*File, error) {
+	f, err := os.Open(filepath.Join(devicePath, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s: %w", name, err)
+	}
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return nil, fmt.Errorf("Could not back up %s: %w", name, err)
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("Could not back up %s: %w", name, err)
+	}
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, sum), f)
+	if err != nil {
+		return nil, fmt.Errorf("Could not back up %s: %w", name, err)
+	}
+	return &File{Path: name, Size: size, SHA256: hex.EncodeToString(sum.Sum(nil))}, nil
+}
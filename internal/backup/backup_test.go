@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"kme/internal/bookmark"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testDevice(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		dbFile:                  "not really a sqlite db",
+		".kobo/version":         "N418TEST,4.1.15,4.38.21908,4.1.15,4.1.15,00000000-0000-0000-0000-000000000390",
+		markDir + "/m1.svg":     "<svg/>",
+		markDir + "/m1.jpg":     "jpg",
+		markDir + "/orphan.svg": "<svg/>",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Could not create test device: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestWriteAndVerify(t *testing.T) {
+	dev := testDevice(t)
+	entries := []*bookmark.Entry{
+		{Id: "m1", Book: "Test Book", Type: bookmark.MARKUP},
+		{Id: "m2", Book: "Test Book", Type: bookmark.MARKUP},
+		{Id: "d1", Book: "Test Book", Type: bookmark.DOGEAR},
+	}
+
+	var buf bytes.Buffer
+	manifest, err := Write(&buf, dev, entries)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if len(manifest.Files) != 5 || manifest.Device == nil || manifest.Device.Serial != "N418TEST" {
+		t.Fatalf("Unexpected manifest: %+v", manifest)
+	}
+	if len(manifest.Bookmarks) != 3 || manifest.Bookmarks[0].Svg == nil || manifest.Bookmarks[1].Svg != nil {
+		t.Errorf("Want images for m1 only, got %+v and %+v", manifest.Bookmarks[0], manifest.Bookmarks[1])
+	}
+
+	backupPath := filepath.Join(t.TempDir(), "backup.zip")
+	os.WriteFile(backupPath, buf.Bytes(), 0644)
+	report, err := Verify(backupPath)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !report.Ok() || report.Checked != 5 || len(report.Incomplete) != 1 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	// same entries, one of them changed and another dropped
+	zr, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	var damaged bytes.Buffer
+	zw := zip.NewWriter(&damaged)
+	for _, f := range zr.File {
+		if f.Name == markDir+"/m1.jpg" {
+			continue
+		}
+		w, _ := zw.Create(f.Name)
+		r, _ := f.Open()
+		io.Copy(w, r)
+		r.Close()
+		if f.Name == dbFile {
+			w.Write([]byte("!"))
+		}
+	}
+	zw.Close()
+	os.WriteFile(backupPath, damaged.Bytes(), 0644)
+
+	report, err = Verify(backupPath)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if report.Ok() || len(report.Missing) != 1 || len(report.Corrupted) != 1 || report.Corrupted[0] != dbFile {
+		t.Errorf("Want one missing and one corrupted file, got %+v", report)
+	}
+}
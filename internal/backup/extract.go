@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Writes the files of a backup into dir, laid out as a device (dir/.kobo/KoboReader.sqlite...).
+// The backup is verified first, a damaged one is not extracted
+func Extract(backupPath string, dir string) error {
+	report, err := Verify(backupPath)
+	if err != nil {
+		return err
+	}
+	if !report.Ok() {
+		return fmt.Errorf("Backup %s is incomplete or damaged, check it with 'kme backup verify'", backupPath)
+	}
+
+	zr, err := zip.OpenReader(backupPath)
+	if err != nil {
+		return fmt.Errorf("Could not open backup %s: %w", backupPath, err)
+	}
+	defer zr.Close()
+
+	listed := map[string]bool{}
+	for _, f := range report.Manifest.Files {
+		listed[f.Path] = true
+	}
+	for _, f := range zr.File {
+		if !listed[f.Name] {
+			continue
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(dest, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("Backup %s has an invalid path %s", backupPath, f.Name)
+		}
+		if err := extractFile(f, dest); err != nil {
+			return fmt.Errorf("Could not extract %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func extractFile(f *zip.File, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kme/internal/bookmark"
+)
+
+// Result of checking a backup against its manifest. Missing and Corrupted are files listed in the
+// manifest, Unlisted are files in the zip the manifest doesn't know about, and Incomplete are
+// markups that had no SVG/JPG pair when the backup was made
+type Report struct {
+	Manifest   *Manifest
+	Checked    int
+	Missing    []string
+	Corrupted  []string
+	Unlisted   []string
+	Incomplete []string
+}
+
+func (self *Report) Ok() bool {
+	return len(self.Missing) == 0 && len(self.Corrupted) == 0
+}
+
+func Verify(backupPath string) (*Report, error) {
+	zr, err := zip.OpenReader(backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open backup %s: %w", backupPath, err)
+	}
+	defer zr.Close()
+
+	entries := map[string]*zip.File{}
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+
+	mf, ok := entries[MANIFEST_FILE]
+	if !ok {
+		return nil, fmt.Errorf("Backup %s has no %s", backupPath, MANIFEST_FILE)
+	}
+	manifest, err := readManifest(mf)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Version > MANIFEST_VERSION {
+		return nil, fmt.Errorf("Backup manifest version %d is newer than this kme (%d)", manifest.Version, MANIFEST_VERSION)
+	}
+
+	report := &Report{Manifest: manifest}
+	listed := map[string]bool{MANIFEST_FILE: true}
+	for _, f := range manifest.Files {
+		listed[f.Path] = true
+		entry, ok := entries[f.Path]
+		if !ok {
+			report.Missing = append(report.Missing, f.Path)
+			continue
+		}
+		sum, err := checksum(entry)
+		if err != nil || sum != f.SHA256 {
+			report.Corrupted = append(report.Corrupted, f.Path)
+			continue
+		}
+		report.Checked++
+	}
+
+	for _, f := range zr.File {
+		if !listed[f.Name] {
+			report.Unlisted = append(report.Unlisted, f.Name)
+		}
+	}
+
+	for _, b := range manifest.Bookmarks {
+		if b.Type != bookmark.MARKUP {
+			continue
+		}
+		if b.Svg == nil || b.Jpg == nil {
+			report.Incomplete = append(report.Incomplete, fmt.Sprintf("%s (%s)", b.Id, b.Book))
+		}
+	}
+
+	return report, nil
+}
+
+func readManifest(f *zip.File) (*Manifest, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read backup manifest: %w", err)
+	}
+	defer r.Close()
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("Could not read backup manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+func checksum(f *zip.File) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	sum := sha256.New()
+	// zip checks its own CRC at EOF, a damaged entry fails here
+	if _, err := io.Copy(sum, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
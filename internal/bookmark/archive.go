@@ -0,0 +1,316 @@
+package bookmark
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const archiveSchema = `
+CREATE TABLE IF NOT EXISTS devices (
+	id TEXT PRIMARY KEY,
+	first_seen TEXT NOT NULL,
+	last_seen TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS books (
+	volume_id TEXT PRIMARY KEY,
+	title TEXT NOT NULL,
+	author TEXT,
+	isbn TEXT,
+	content_id TEXT,
+	first_seen TEXT NOT NULL,
+	last_seen TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS bookmarks (
+	id TEXT PRIMARY KEY,
+	volume_id TEXT NOT NULL REFERENCES books(volume_id),
+	device_id TEXT NOT NULL REFERENCES devices(id),
+	content_id TEXT,
+	section TEXT,
+	start_path TEXT,
+	start_offset INTEGER,
+	end_path TEXT,
+	end_offset INTEGER,
+	type TEXT,
+	text TEXT,
+	annotation TEXT,
+	color INTEGER,
+	chapter_progress REAL,
+	date_created TEXT,
+	date_modified TEXT,
+	first_seen TEXT NOT NULL,
+	last_seen TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS ix_bookmarks_volume ON bookmarks (volume_id);
+CREATE TABLE IF NOT EXISTS markup_images (
+	bookmark_id TEXT PRIMARY KEY REFERENCES bookmarks(id),
+	svg BLOB,
+	jpg BLOB
+);
+`
+
+// kme's own copy of the bookmarks, so they survive books being deleted or devices reset. It keeps
+// the same raw values as the Kobo DB, plus the markup images and when/where each bookmark was seen.
+// When used as source (ConnectArchive) markup images are written to cacheDir as <id>.svg/.jpg, so
+// that directory works as the markups path of a device
+type ArchiveDB struct {
+	db       *sql.DB
+	cacheDir string
+}
+
+func OpenArchive(archivePath string) (*ArchiveDB, error) {
+	if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+		return nil, fmt.Errorf("Could not create archive directory: %w", err)
+	}
+	db, err := sql.Open("sqlite", archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open archive %s: %w", archivePath, err)
+	}
+	if _, err := db.Exec(archiveSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not create archive %s: %w", archivePath, err)
+	}
+	return &ArchiveDB{db: db}, nil
+}
+
+func (self *ArchiveDB) Close() error {
+	return self.db.Close()
+}
+
+// Read bookmarks from the archive instead of a Kobo DB, AllBooks and AllBookmarks work the same
+func ConnectArchive(archivePath string, cacheDir string) error {
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		return fmt.Errorf("Archive %s does not exist", archivePath)
+	}
+	adb, err := OpenArchive(archivePath)
+	if err != nil {
+		return err
+	}
+	adb.cacheDir = cacheDir
+	kdb = adb
+	return nil
+}
+
+// Copies the bookmarks of the given books, from the currently connected source into the archive.
+// Bookmarks already archived are updated, keeping when they were first seen and on which device
+func (self *ArchiveDB) Upsert(books []string, deviceId string, markPath string) (int, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	tx, err := self.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("Could not write to archive: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	INSERT INTO devices (id, first_seen, last_seen) VALUES (?1, ?2, ?2)
+	ON CONFLICT (id) DO UPDATE SET last_seen = excluded.last_seen
+	`, deviceId, now)
+	if err != nil {
+		return 0, fmt.Errorf("Could not archive device %s: %w", deviceId, err)
+	}
+
+	count := 0
+	for _, b := range books {
+		raws, err := kdb.fetchBookmarks(b)
+		if err != nil {
+			return count, err
+		}
+		if len(raws) == 0 || !raws[0].volumeId.Valid {
+			continue
+		}
+		if err := archiveBook(tx, b, raws[0].volumeId.String, now); err != nil {
+			return count, err
+		}
+		for _, r := range raws {
+			if err := archiveBookmark(tx, r, deviceId, markPath, now); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return count, fmt.Errorf("Could not write to archive: %w", err)
+	}
+	return count, nil
+}
+
+func archiveBook(tx *sql.Tx, title string, volumeId string, now string) error {
+	book, err := kdb.fetchBook(volumeId)
+	if err != nil {
+		// still worth keeping the bookmarks, with the title we know
+		book = koboBook{}
+	}
+	_, err = tx.Exec(`
+	INSERT INTO books (volume_id, title, author, isbn, content_id, first_seen, last_seen)
+	VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?6)
+	ON CONFLICT (volume_id) DO UPDATE SET
+		title = excluded.title,
+		author = COALESCE(excluded.author, books.author),
+		isbn = COALESCE(excluded.isbn, books.isbn),
+		content_id = COALESCE(excluded.content_id, books.content_id),
+		last_seen = excluded.last_seen
+	`, volumeId, title, book.author, book.isbn, book.contentId, now)
+	if err != nil {
+		return fmt.Errorf("Could not archive book %s: %w", title, err)
+	}
+	return nil
+}
+
+func archiveBookmark(tx *sql.Tx, r koboBookmark, deviceId string, markPath string, now string) error {
+	// bookmarks read from the archive already know where they come from
+	if r.device.Valid && r.device.String != "" {
+		deviceId = r.device.String
+	}
+	_, err := tx.Exec(`
+	INSERT INTO bookmarks (id, volume_id, device_id, content_id, section, start_path, start_offset,
+		end_path, end_offset, type, text, annotation, color, chapter_progress, date_created,
+		date_modified, first_seen, last_seen)
+	VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16, ?17, ?17)
+	ON CONFLICT (id) DO UPDATE SET
+		content_id = excluded.content_id,
+		section = excluded.section,
+		start_path = excluded.start_path,
+		start_offset = excluded.start_offset,
+		end_path = excluded.end_path,
+		end_offset = excluded.end_offset,
+		type = excluded.type,
+		text = excluded.text,
+		annotation = excluded.annotation,
+		color = excluded.color,
+		chapter_progress = excluded.chapter_progress,
+		date_created = excluded.date_created,
+		date_modified = excluded.date_modified,
+		last_seen = excluded.last_seen
+	`,
+		r.id, r.volumeId, deviceId, r.contentId, r.section, r.location, r.startOffset,
+		r.endPath, r.endOffset, r.kind, r.text, r.annotation, r.color, r.chapterProgress,
+		r.dateCreated, r.dateModified, now,
+	)
+	if err != nil {
+		return fmt.Errorf("Could not archive bookmark %s: %w", r.id.String, err)
+	}
+
+	if r.kind.String != MARKUP {
+		return nil
+	}
+	m := &Markup{Id: r.id.String}
+	if !m.HasImagePair(markPath) {
+		return nil
+	}
+	svg, err := os.ReadFile(m.SvgFile(markPath))
+	if err != nil {
+		return fmt.Errorf("Could not read markup %s: %w", m.Id, err)
+	}
+	jpg, err := os.ReadFile(m.JpgFile(markPath))
+	if err != nil {
+		return fmt.Errorf("Could not read markup %s: %w", m.Id, err)
+	}
+	_, err = tx.Exec(`
+	INSERT INTO markup_images (bookmark_id, svg, jpg) VALUES (?1, ?2, ?3)
+	ON CONFLICT (bookmark_id) DO UPDATE SET svg = excluded.svg, jpg = excluded.jpg
+	`, m.Id, svg, jpg)
+	if err != nil {
+		return fmt.Errorf("Could not archive markup images %s: %w", m.Id, err)
+	}
+	return nil
+}
+
+func (self *ArchiveDB) fetchBooksWithBookmark() ([]string, error) {
+	rows, err := self.db.Query(`
+	SELECT DISTINCT books.title
+	FROM books
+	INNER JOIN bookmarks ON bookmarks.volume_id = books.volume_id
+	ORDER BY books.title
+	`)
+	if err != nil {
+		return []string{}, fmt.Errorf("Could not fetch Books from archive: %w", err)
+	}
+	defer rows.Close()
+
+	books := []string{}
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err == nil {
+			books = append(books, title)
+		}
+	}
+	return books, nil
+}
+
+// Also writes the images of the markups to the cache dir. The bookmarks are returned even if some
+// of those can't be, with the error of each one
+func (self *ArchiveDB) fetchBookmarks(book string) ([]koboBookmark, error) {
+	// same columns and order as the Kobo DB query, so fromRows works for both
+	rows, err := self.db.Query(`
+	SELECT bookmarks.id, books.title, section, start_path, type, text, color,
+		bookmarks.volume_id, bookmarks.content_id, start_offset, end_path, end_offset,
+		annotation, date_created, date_modified, chapter_progress, device_id
+	FROM bookmarks
+	INNER JOIN books ON books.volume_id = bookmarks.volume_id
+	WHERE books.title = ?1
+	`, book)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch Bookmarks of %s from archive: %w", book, err)
+	}
+	defer rows.Close()
+
+	raws := fromRows(rows)
+	errs := []error{}
+	for _, r := range raws {
+		if r.kind.String == MARKUP {
+			errs = append(errs, self.extractMarkupImages(r.id.String))
+		}
+	}
+	return raws, errors.Join(errs...)
+}
+
+func (self *ArchiveDB) fetchBook(volumeId string) (koboBook, error) {
+	book := koboBook{}
+	err := self.db.QueryRow(
+		`SELECT content_id, author, isbn FROM books WHERE volume_id = ?1`, volumeId,
+	).Scan(&book.contentId, &book.author, &book.isbn)
+	if err != nil {
+		return book, fmt.Errorf("Could not fetch Book %s from archive: %w", volumeId, err)
+	}
+	return book, nil
+}
+
+func (self *ArchiveDB) close() error {
+	return self.Close()
+}
+
+// Writes the archived images of a markup into the cache dir, where Markup.SvgFile/JpgFile find them
+func (self *ArchiveDB) extractMarkupImages(id string) error {
+	if self.cacheDir == "" {
+		return nil
+	}
+	m := &Markup{Id: id}
+	if m.HasImagePair(self.cacheDir) {
+		return nil
+	}
+
+	var svg, jpg []byte
+	err := self.db.QueryRow(`SELECT svg, jpg FROM markup_images WHERE bookmark_id = ?1`, id).Scan(&svg, &jpg)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Could not read archived markup %s: %w", id, err)
+	}
+
+	if err := os.MkdirAll(self.cacheDir, 0755); err != nil {
+		return fmt.Errorf("Could not create markups cache directory: %w", err)
+	}
+	if err := os.WriteFile(m.SvgFile(self.cacheDir), svg, 0644); err != nil {
+		return fmt.Errorf("Could not write archived markup %s: %w", id, err)
+	}
+	if err := os.WriteFile(m.JpgFile(self.cacheDir), jpg, 0644); err != nil {
+		return fmt.Errorf("Could not write archived markup %s: %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package bookmark
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Just the tables and columns kme reads from the Kobo DB
+const testKoboSchema = `
+CREATE TABLE content (ContentID TEXT NOT NULL, ContentType TEXT NOT NULL, MimeType TEXT NOT NULL,
+	BookID TEXT, BookTitle TEXT, Title TEXT, Attribution TEXT, ISBN TEXT, PRIMARY KEY (ContentID));
+CREATE TABLE Bookmark (BookmarkID TEXT NOT NULL, VolumeID TEXT NOT NULL, ContentID TEXT NOT NULL,
+	StartContainerPath TEXT NOT NULL, StartOffset INTEGER NOT NULL, EndContainerPath TEXT NOT NULL,
+	EndOffset INTEGER NOT NULL, Text TEXT, Annotation TEXT, DateCreated TEXT,
+	ChapterProgress REAL NOT NULL DEFAULT 0, DateModified TEXT, Type TEXT, Color INTEGER DEFAULT 0,
+	PRIMARY KEY (BookmarkID));
+`
+
+const testVolume = "file:///mnt/onboard/Books/test.kepub.epub"
+
+// Creates a Kobo DB with a book, two highlights and a markup, and its markup files
+func testKoboDevice(t *testing.T) (dbPath string, markPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	dbPath = filepath.Join(dir, "KoboReader.sqlite")
+	markPath = filepath.Join(dir, "markups")
+
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Could not create test Kobo DB: %v", err)
+	}
+	defer db.Close()
+
+	chapter := testVolume + "!OEBPS!Text/chapter1.xhtml"
+	stmts := []struct {
+		query string
+		args  []any
+	}{
+		{testKoboSchema, nil},
+		{`INSERT INTO content VALUES (?, 6, 'application/x-kobo-epub+zip', NULL, NULL, 'Test Book', 'Jane Doe', '9781234567897')`,
+			[]any{testVolume}},
+		{`INSERT INTO content VALUES (?, 9, 'application/xhtml+xml', ?, 'Test Book', 'Text/chapter1.xhtml', NULL, NULL)`,
+			[]any{chapter, testVolume}},
+		{`INSERT INTO Bookmark VALUES ('h1', ?, ?, 'span#kobo\.2\.1', 0, 'span#kobo\.2\.1', 5, 'Hello', 'A note',
+			'2024-03-01T10:00:00.000', 0.2, '2024-03-01T10:00:00.000', 'note', 0)`, []any{testVolume, chapter}},
+		{`INSERT INTO Bookmark VALUES ('h2', ?, ?, 'span#kobo\.3\.1', 0, 'span#kobo\.3\.1', 5, 'World', NULL,
+			'2024-03-02T10:00:00Z', 0.4, '2024-03-02T10:00:00Z', 'highlight', 2)`, []any{testVolume, chapter}},
+		{`INSERT INTO Bookmark VALUES ('m1', ?, ?, 'span#kobo\.4\.1', 0, 'span#kobo\.4\.1', 0, NULL, NULL,
+			'2024-03-03T10:00:00Z', 0.6, '2024-03-03T10:00:00Z', 'markup', 0)`, []any{testVolume, chapter}},
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s.query, s.args...); err != nil {
+			t.Fatalf("Could not create test Kobo DB: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(markPath, 0755); err != nil {
+		t.Fatalf("Could not create test markups: %v", err)
+	}
+	os.WriteFile(filepath.Join(markPath, "m1.svg"), []byte("<svg/>"), 0644)
+	os.WriteFile(filepath.Join(markPath, "m1.jpg"), []byte("jpg"), 0644)
+
+	return dbPath, markPath
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	dbPath, markPath := testKoboDevice(t)
+	archivePath := filepath.Join(t.TempDir(), "archive.sqlite")
+
+	if err := ConnectKoboDB(dbPath); err != nil {
+		t.Fatalf("Could not connect to test Kobo DB: %v", err)
+	}
+	books := AllBooks()
+	fromDevice, err := AllBookmarks(books)
+	if err != nil {
+		t.Fatalf("Could not read the test Kobo DB: %v", err)
+	}
+
+	adb, err := OpenArchive(archivePath)
+	if err != nil {
+		t.Fatalf("Could not open archive: %v", err)
+	}
+	// twice, the second time must update instead of duplicating
+	for range 2 {
+		if count, err := adb.Upsert(books, "N418TEST", markPath); err != nil || count != 3 {
+			t.Fatalf("Upsert: want 3 bookmarks, got %d (%v)", count, err)
+		}
+	}
+	adb.Close()
+	CloseKoboDB()
+
+	cacheDir := t.TempDir()
+	if err := ConnectArchive(archivePath, cacheDir); err != nil {
+		t.Fatalf("Could not connect to archive: %v", err)
+	}
+	defer CloseKoboDB()
+
+	fromArchive, err := AllBookmarks(AllBooks())
+	if err != nil {
+		t.Fatalf("Could not read the archive: %v", err)
+	}
+	if len(fromArchive) != 1 || len(fromDevice) != 1 {
+		t.Fatalf("Want 1 book from device and archive, got %d and %d", len(fromDevice), len(fromArchive))
+	}
+	dev, arc := fromDevice[0], fromArchive[0]
+	if arc.Book != dev.Book || arc.Author != dev.Author || arc.ISBN != dev.ISBN {
+		t.Errorf("Book differs: device %+v, archive %+v", dev, arc)
+	}
+	if len(arc.Highlights) != 2 || len(arc.Markups) != 1 {
+		t.Fatalf("Want 2 highlights and 1 markup, got %d and %d", len(arc.Highlights), len(arc.Markups))
+	}
+	for i, h := range arc.Highlights {
+		d := dev.Highlights[i]
+		if h.Id != d.Id || h.Text() != d.Text() || h.Note != d.Note || h.OrderId != d.OrderId || !h.Created.Equal(d.Created) {
+			t.Errorf("Highlight differs: device %+v, archive %+v", d, h)
+		}
+	}
+	if !arc.Markups[0].HasImagePair(cacheDir) {
+		t.Errorf("Archived markup images were not written to the cache dir")
+	}
+}
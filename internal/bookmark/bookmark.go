@@ -2,12 +2,16 @@ package bookmark
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"iter"
 	"math"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -25,6 +29,19 @@ var (
 	chapterRgx   = regexp.MustCompile(`(chapter|ch|c)(\d+)|([a-z]+)(\d+)$`)
 )
 
+// The Kobo DB stores dates as text, and depending on the firmware that wrote them they come with
+// or without milliseconds and timezone.
+var dateLayouts = []string{
+	"2006-01-02T15:04:05.000",
+	"2006-01-02T15:04:05Z",
+	"2006-01-02T15:04:05",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+}
+
+// Books in the device storage are referenced with this prefix in the Kobo DB
+const onboardPrefix = "file:///mnt/onboard/"
+
 // Bookmarks are ordered by section and then location. However the location resets with every
 // chapter, and sections coming before the book chapters (such as prefaces, introductions) have its
 // own number. This means you can have
@@ -52,10 +69,41 @@ var sectionOrder = map[string]float64{
 
 type Bookmarks struct {
 	Book       string
+	Author     string
+	ISBN       string
+	VolumeId   string
+	ContentId  string
 	Markups    []*Markup
 	Highlights []*Highlight
 }
 
+// Path of the book file inside the device, or empty if the book is not a file we can read (e.g.
+// books bought in the Kobo store are kept encrypted under .kobo/kepub)
+func (self *Bookmarks) DevicePath(device string) string {
+	if !strings.HasPrefix(self.ContentId, onboardPrefix) {
+		return ""
+	}
+	return filepath.Join(device, filepath.FromSlash(strings.TrimPrefix(self.ContentId, onboardPrefix)))
+}
+
+// Records the device the bookmarks were read from, for the ones that don't know it yet, and
+// resolves the markup files in that device. Once resolved, the markup paths don't depend on the
+// markPath given later, which is what allows mixing bookmarks from several devices
+func (self *Bookmarks) SetOrigin(device string, markPath string) {
+	for _, h := range self.Highlights {
+		if h.Device == "" {
+			h.Device = device
+		}
+	}
+	for _, m := range self.Markups {
+		if m.Device == "" {
+			m.Device = device
+		}
+		m.SvgFile(markPath)
+		m.JpgFile(markPath)
+	}
+}
+
 func (self *Bookmarks) Marks() iter.Seq2[int, *Markup] {
 	return func(yield func(idx int, mark *Markup) bool) {
 		for i, m := range self.Markups {
@@ -76,13 +124,46 @@ func (self *Bookmarks) Highs() iter.Seq2[int, *Highlight] {
 	}
 }
 
+// Copy of the book with just the highlights of the given color codes. Markups have no color, so
+// they are left out. nil if no highlight is of those colors
+func (self *Bookmarks) WithColors(codes []int) *Bookmarks {
+	highlights := []*Highlight{}
+	for _, h := range self.Highlights {
+		if slices.Contains(codes, h.Color()) {
+			highlights = append(highlights, h)
+		}
+	}
+	if len(highlights) == 0 {
+		return nil
+	}
+	book := *self
+	book.Highlights = highlights
+	book.Markups = nil
+	return &book
+}
+
+// Codes of the colors used by the highlights, sorted
+func (self *Bookmarks) ColorCodes() []int {
+	codes := []int{}
+	for _, h := range self.Highlights {
+		if !slices.Contains(codes, h.Color()) {
+			codes = append(codes, h.Color())
+		}
+	}
+	slices.Sort(codes)
+	return codes
+}
+
 // Dummy interface to be able have fromRawValues returning either a Highlight or a Markup
 type bookmark interface {
 	Kind() string
 }
 
-func AllBookmarks(books []string) []*Bookmarks {
+// The bookmarks of the books, and what went wrong reading them. Books that can't be read are left
+// out, but a markup whose images are missing doesn't leave its book out
+func AllBookmarks(books []string) ([]*Bookmarks, error) {
 	all := make([]*Bookmarks, 0, 50)
+	errs := []error{}
 
 	for _, b := range books {
 		bms := &Bookmarks{
@@ -91,7 +172,21 @@ func AllBookmarks(books []string) []*Bookmarks {
 			Highlights: []*Highlight{},
 		}
 
-		raws := kdb.fetchBookmarks(b)
+		raws, err := kdb.fetchBookmarks(b)
+		if err != nil {
+			errs = append(errs, err)
+			if raws == nil {
+				continue
+			}
+		}
+		if len(raws) > 0 && raws[0].volumeId.Valid {
+			bms.VolumeId = raws[0].volumeId.String
+			if book, err := kdb.fetchBook(bms.VolumeId); err == nil {
+				bms.ContentId = book.contentId.String
+				bms.Author = book.author.String
+				bms.ISBN = book.isbn.String
+			}
+		}
 
 		for _, r := range raws {
 			bm := fromRawValues(r)
@@ -108,7 +203,7 @@ func AllBookmarks(books []string) []*Bookmarks {
 		all = append(all, bms)
 	}
 
-	return all
+	return all, errors.Join(errs...)
 }
 
 func AllBooks() []string {
@@ -141,6 +236,13 @@ func fromRawValues(kbm koboBookmark) bookmark {
 	// see "sectionOrder"
 	bm.OrderId = orderId
 
+	bm.VolumeId = kbm.volumeId.String
+	bm.ContentId = kbm.contentId.String
+	bm.ChapterProgress = kbm.chapterProgress.Float64
+	bm.Created = parseDate(kbm.dateCreated)
+	bm.Modified = parseDate(kbm.dateModified)
+	bm.Device = kbm.device.String
+
 	switch kbm.kind.String {
 	case MARKUP:
 		return bm
@@ -150,12 +252,23 @@ func fromRawValues(kbm koboBookmark) bookmark {
 			text := kbm.text.String
 			col := kbm.color.Int64
 			return &Highlight{
-				Id:       bm.Id,
-				Section:  bm.Section,
-				Location: bm.Location,
-				OrderId:  bm.OrderId,
-				text:     text,
-				color:    int(col),
+				Id:              bm.Id,
+				Section:         bm.Section,
+				Location:        bm.Location,
+				OrderId:         bm.OrderId,
+				VolumeId:        bm.VolumeId,
+				ContentId:       bm.ContentId,
+				StartPath:       kbm.location.String,
+				StartOffset:     int(kbm.startOffset.Int64),
+				EndPath:         kbm.endPath.String,
+				EndOffset:       int(kbm.endOffset.Int64),
+				ChapterProgress: bm.ChapterProgress,
+				Note:            strings.TrimSpace(kbm.annotation.String),
+				Created:         bm.Created,
+				Modified:        bm.Modified,
+				Device:          bm.Device,
+				text:            text,
+				color:           int(col),
 			}
 		}
 	default:
@@ -242,3 +355,16 @@ func parseLocation(l sql.NullString) (string, float64) {
 
 	return loc, numloc
 }
+
+// Zero time if the date is missing or in a format we don't know about
+func parseDate(d sql.NullString) time.Time {
+	if !d.Valid {
+		return time.Time{}
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, d.String); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -191,3 +191,50 @@ func TestParseSection(t *testing.T) {
 		}
 	}
 }
+
+func TestWithColors(t *testing.T) {
+	bm := &Bookmarks{
+		Book:       "Dune",
+		Highlights: []*Highlight{{Id: "a", color: 0}, {Id: "b", color: 2}, {Id: "c", color: 1}, {Id: "d", color: 2}},
+		Markups:    []*Markup{{Id: "m"}},
+	}
+	blue := bm.WithColors([]int{2})
+	if blue == nil || len(blue.Highlights) != 2 || blue.Highlights[0].Id != "b" || len(blue.Markups) != 0 {
+		t.Errorf("WithColors(blue) = %+v", blue)
+	}
+	if len(bm.Highlights) != 4 || len(bm.Markups) != 1 {
+		t.Errorf("WithColors changed the original book")
+	}
+	if bm.WithColors([]int{3}) != nil {
+		t.Errorf("WithColors(green) should be nil, there are no green highlights")
+	}
+	if codes := bm.ColorCodes(); len(codes) != 3 || codes[0] != 0 || codes[2] != 2 {
+		t.Errorf("ColorCodes() = %v", codes)
+	}
+}
+
+func TestColorMeanings(t *testing.T) {
+	defer SetColorMeanings(nil)
+	if err := SetColorMeanings(map[string]ColorMeaning{
+		"yellow": {Name: "Key idea"},
+		"blue":   {Name: "definition", Tag: "#def", Label: "Definitions"},
+		"green":  {Tag: "#To Read/Later!"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	h := &Highlight{}
+	if h.ColorTag(0) != "key-idea" || h.ColorTag(2) != "def" || h.ColorTag(1) != "red" || h.ColorTag(3) != "to-read/later" {
+		t.Errorf("Tags = %s, %s, %s, %s", h.ColorTag(0), h.ColorTag(2), h.ColorTag(1), h.ColorTag(3))
+	}
+	if h.ColorLabel(2) != "Definitions" || h.ColorLabel(0) != "Key idea" {
+		t.Errorf("Labels = %s, %s", h.ColorLabel(2), h.ColorLabel(0))
+	}
+	for name, want := range map[string]int{"def": 2, "#def": 2, "Definition": 2, "blue": 2, "key idea": 0, "#to-read/later": 3} {
+		if code, ok := h.ColorCode(name); !ok || code != want {
+			t.Errorf("ColorCode(%s) = %d, %v", name, code, ok)
+		}
+	}
+	if err := SetColorMeanings(map[string]ColorMeaning{"purple": {Name: "x"}}); err == nil {
+		t.Errorf("Want an error for an unknown Kobo color")
+	}
+}
@@ -2,7 +2,9 @@ package bookmark
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
+	"time"
 )
 
 const (
@@ -19,14 +21,34 @@ type Highlight struct {
 	Part      string
 	Location  string
 	OrderId   float64
-	text      string
-	color     int
+	VolumeId  string
+	ContentId string
+	// Raw Kobo position, e.g. span#kobo\.40\.9 and the character offset inside that span
+	StartPath   string
+	StartOffset int
+	EndPath     string
+	EndOffset   int
+	// [0,1] how far into the chapter the highlight is
+	ChapterProgress float64
+	// Text typed with the keyboard for the highlight, if any
+	Note     string
+	Created  time.Time
+	Modified time.Time
+	// Device the highlight was made on
+	Device string
+	text   string
+	color  int
 }
 
 func (self *Highlight) Kind() string {
 	return HIGHLIGHT
 }
 
+// For highlights that don't come from a Kobo DB, e.g. in tests
+func NewHighlight(text string, color int) *Highlight {
+	return &Highlight{text: text, color: color}
+}
+
 // The Kobo DB only provides with the color code as int, and the name does not seem available in
 // any other table. So I'm hardoding the colors here, since it is small enough and quicker than
 // going for it to the DB anyways if it was even possible.
@@ -50,6 +72,128 @@ func (self *Highlight) Colors(code int) rune {
 	return colors[code]
 }
 
+var colorNames = map[int]string{
+	0: "yellow",
+	1: "red",
+	2: "blue",
+	3: "green",
+}
+
+// What a color means to the reader, e.g. from the config. Empty fields fall back to the name
+type ColorMeaning struct {
+	Name  string
+	Tag   string
+	Label string
+	CSS   string
+}
+
+// Meanings given to the colors instead of the Kobo names, e.g. from the config file
+var colorMeanings = map[int]ColorMeaning{}
+
+var tagRgx = regexp.MustCompile(`[^\p{L}\p{N}_/]+`)
+
+// Gives the colors a meaning in the exports, by Kobo name (blue: {Name: definition, Tag: def})
+func SetColorMeanings(meanings map[string]ColorMeaning) error {
+	custom := map[int]ColorMeaning{}
+	for kobo, meaning := range meanings {
+		code, ok := koboColorCode(kobo)
+		if !ok {
+			return fmt.Errorf("Unknown Kobo color %s, must be one of yellow, red, blue or green", kobo)
+		}
+		custom[code] = meaning
+	}
+	colorMeanings = custom
+	return nil
+}
+
+// Name of the color for the given code, as the Kobo UI calls them unless renamed with SetColorMeanings
+func (self *Highlight) ColorName(code int) string {
+	if name := colorMeanings[code].Name; name != "" {
+		return name
+	}
+	return colorNames[code]
+}
+
+// Tag for the highlights of the color, without #. The one set or else the name, either way made a
+// tag: lower case, words joined by -
+func (self *Highlight) ColorTag(code int) string {
+	if tag := asTag(colorMeanings[code].Tag); tag != "" {
+		return tag
+	}
+	return asTag(self.ColorName(code))
+}
+
+func asTag(s string) string {
+	return strings.Trim(tagRgx.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// Heading for the highlights of the color, the name unless set
+func (self *Highlight) ColorLabel(code int) string {
+	if label := colorMeanings[code].Label; label != "" {
+		return label
+	}
+	return self.ColorName(code)
+}
+
+// CSS color given to the color, empty unless set
+func (self *Highlight) ColorCSS(code int) string {
+	return colorMeanings[code].CSS
+}
+
+// The meaning given to the color as is, without falling back to the name. false if none
+func (self *Highlight) ColorMeaning(code int) (ColorMeaning, bool) {
+	m, ok := colorMeanings[code]
+	return m, ok
+}
+
+// Name of the color as the Kobo UI calls them, for other readers that know the same colors
+func (self *Highlight) KoboColorName(code int) string {
+	return colorNames[code]
+}
+
+// Code for the given color name or tag, the opposite of ColorName. Kobo names always work
+func (self *Highlight) ColorCode(name string) (int, bool) {
+	name = strings.TrimSpace(name)
+	for code, m := range colorMeanings {
+		if m.Name != "" && strings.EqualFold(m.Name, name) {
+			return code, true
+		}
+		if m.Tag != "" && asTag(m.Tag) == asTag(name) {
+			return code, true
+		}
+	}
+	return koboColorCode(name)
+}
+
+func koboColorCode(name string) (int, bool) {
+	for code, n := range colorNames {
+		if strings.EqualFold(n, strings.TrimSpace(name)) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+func (self *Highlight) Text() string {
+	return strings.TrimSpace(self.text)
+}
+
+func (self *Highlight) Color() int {
+	return self.color
+}
+
+// Path of the chapter file inside the book, e.g. OEBPS/Text/ch01.xhtml
+// The Kobo DB keeps it in the ContentID, prefixed by the VolumeID and separated by "!"
+func (self *Highlight) ChapterHref() string {
+	href := strings.TrimPrefix(self.ContentId, self.VolumeId)
+	href = strings.Trim(href, "!")
+	href = strings.ReplaceAll(href, "!", "/")
+	if i := strings.Index(href, "#"); i >= 0 {
+		href = href[:i]
+	}
+	return href
+}
+
 func (self *Highlight) Format() string {
 	format := `%c %s --- %s`
 	loc := fmt.Sprintf("%s.%s", self.Section, self.Location)
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 
 	_ "modernc.org/sqlite"
 )
@@ -18,13 +19,40 @@ type koboBookmark struct {
 	kind      sql.NullString
 	text      sql.NullString
 	color     sql.NullInt64
+	// Everything below is only needed by the exporters, to point back at the original book
+	volumeId        sql.NullString
+	contentId       sql.NullString
+	startOffset     sql.NullInt64
+	endPath         sql.NullString
+	endOffset       sql.NullInt64
+	annotation      sql.NullString
+	dateCreated     sql.NullString
+	dateModified    sql.NullString
+	chapterProgress sql.NullFloat64
+	device          sql.NullString
+}
+
+// Book level metadata, taken from the content row where ContentID = VolumeID
+type koboBook struct {
+	contentId sql.NullString
+	author    sql.NullString
+	isbn      sql.NullString
+}
+
+// Where bookmarks are read from: the Kobo DB itself or the kme archive (see archive.go). Both keep
+// the Kobo raw values so they go through the same parsing
+type source interface {
+	fetchBooksWithBookmark() ([]string, error)
+	fetchBookmarks(book string) ([]koboBookmark, error)
+	fetchBook(volumeId string) (koboBook, error)
+	close() error
 }
 
 type KoboDB struct {
 	db *sql.DB
 }
 
-var kdb *KoboDB
+var kdb source
 
 func ConnectKoboDB(dbPath string) error {
 	db, err := sql.Open("sqlite", dbPath)
@@ -36,7 +64,11 @@ func ConnectKoboDB(dbPath string) error {
 }
 
 func CloseKoboDB() {
-	kdb.db.Close()
+	kdb.close()
+}
+
+func (self *KoboDB) close() error {
+	return self.db.Close()
 }
 
 // PDFs not supported for now
@@ -74,32 +106,40 @@ func (self *KoboDB) fetchBooksWithBookmark() ([]string, error) {
 	return books, nil
 }
 
-func (self *KoboDB) fetchBookmarks(book string) []koboBookmark {
+func (self *KoboDB) fetchBookmarks(book string) ([]koboBookmark, error) {
 	// adobe_location is relevant only to PDFs, not supported for now
 	// TODO Add PDF support
+	// The Kobo DB does not know which device it is, Bookmarks.SetOrigin fills that in
 	query := `
-	SELECT BookmarkID, BookTitle, Title, StartContainerPath, Type, Text, Color
+	SELECT BookmarkID, BookTitle, Title, StartContainerPath, Type, Text, Color,
+		Bookmark.VolumeID, Bookmark.ContentID, StartOffset, EndContainerPath, EndOffset,
+		Annotation, Bookmark.DateCreated, Bookmark.DateModified, ChapterProgress, NULL
 	FROM content
 	INNER JOIN Bookmark ON content.BookID = Bookmark.VolumeID
 		AND content.ContentID = bookmark.ContentID
 	WHERE BookTitle = ?1
 	`
-	stmt, err := self.db.Prepare(query)
-	if err != nil {
-		log.Fatalf("Error preparing Bookmarks query: %v", err)
-	}
-
-	rows, err := stmt.Query(book)
+	rows, err := self.db.Query(query, book)
 	if err != nil {
-		log.Fatalf("Error executing Bookmarks query: %v", err)
+		return nil, fmt.Errorf("Could not fetch Bookmarks of %s from Kobo database: %w", book, err)
 	}
 	defer rows.Close()
 
+	return fromRows(rows), nil
+}
+
+func (self *KoboDB) fetchBook(volumeId string) (koboBook, error) {
+	book := koboBook{}
+	query := `
+	SELECT ContentID, Attribution, ISBN
+	FROM content
+	WHERE ContentID = ?1 AND ContentType = 6
+	`
+	err := self.db.QueryRow(query, volumeId).Scan(&book.contentId, &book.author, &book.isbn)
 	if err != nil {
-		log.Fatalf("Error finding Bookmarks: %v", err)
+		return book, fmt.Errorf("Could not fetch Book %s from Kobo database: %w", volumeId, err)
 	}
-
-	return fromRows(rows)
+	return book, nil
 }
 
 func fromRows(rows *sql.Rows) []koboBookmark {
@@ -114,6 +154,16 @@ func fromRows(rows *sql.Rows) []koboBookmark {
 			&bm.kind,
 			&bm.text,
 			&bm.color,
+			&bm.volumeId,
+			&bm.contentId,
+			&bm.startOffset,
+			&bm.endPath,
+			&bm.endOffset,
+			&bm.annotation,
+			&bm.dateCreated,
+			&bm.dateModified,
+			&bm.chapterProgress,
+			&bm.device,
 		); err != nil {
 			log.Fatalf("Could not extract Bookmark info from DB: %v", err)
 		}
@@ -122,3 +172,105 @@ func fromRows(rows *sql.Rows) []koboBookmark {
 
 	return bmList
 }
+
+// Titles of the books in any of the given shelves (collections). Only the Kobo DB knows them
+func BooksOnShelves(shelves []string) ([]string, error) {
+	k, ok := kdb.(*KoboDB)
+	if !ok {
+		return nil, fmt.Errorf("Shelves can only be read from a Kobo device")
+	}
+
+	args := []any{}
+	for _, s := range shelves {
+		args = append(args, s)
+	}
+	query := fmt.Sprintf(`
+	SELECT DISTINCT content.Title
+	FROM ShelfContent
+	INNER JOIN content ON content.ContentID = ShelfContent.ContentId AND content.ContentType = 6
+	WHERE ShelfContent.ShelfName IN (%s)
+		AND IFNULL(ShelfContent._IsDeleted, 'false') NOT IN ('true', 1)
+	`, strings.TrimSuffix(strings.Repeat("?, ", len(shelves)), ", "))
+
+	rows, err := k.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch shelves from Kobo database: %w", err)
+	}
+	defer rows.Close()
+
+	books := []string{}
+	for rows.Next() {
+		var title sql.NullString
+		if err := rows.Scan(&title); err == nil && title.Valid {
+			books = append(books, title.String)
+		}
+	}
+	return books, nil
+}
+
+// Titles of the books in each shelf (collection), by shelf name. Like BooksOnShelves, only the
+// Kobo DB knows them
+func Shelves() (map[string][]string, error) {
+	k, ok := kdb.(*KoboDB)
+	if !ok {
+		return nil, fmt.Errorf("Shelves can only be read from a Kobo device")
+	}
+
+	rows, err := k.db.Query(`
+	SELECT DISTINCT ShelfContent.ShelfName, content.Title
+	FROM ShelfContent
+	INNER JOIN content ON content.ContentID = ShelfContent.ContentId AND content.ContentType = 6
+	WHERE IFNULL(ShelfContent._IsDeleted, 'false') NOT IN ('true', 1)
+	ORDER BY ShelfContent.ShelfName, content.Title
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch shelves from Kobo database: %w", err)
+	}
+	defer rows.Close()
+
+	shelves := map[string][]string{}
+	for rows.Next() {
+		var shelf, title sql.NullString
+		if err := rows.Scan(&shelf, &title); err == nil && shelf.Valid && title.Valid {
+			shelves[shelf.String] = append(shelves[shelf.String], title.String)
+		}
+	}
+	return shelves, nil
+}
+
+// A row of the Bookmark table as it is, whatever its type. AllBookmarks leaves out what it can't
+// export (dogears, highlights without text), Entries is for when everything counts, e.g. backups
+type Entry struct {
+	Id   string
+	Book string
+	Type string
+}
+
+// Every row of the Bookmark table, by book
+func Entries() ([]*Entry, error) {
+	k, ok := kdb.(*KoboDB)
+	if !ok {
+		return nil, fmt.Errorf("Every bookmark can only be read from a Kobo device")
+	}
+
+	rows, err := k.db.Query(`
+	SELECT Bookmark.BookmarkID, IFNULL(content.Title, ''), IFNULL(Bookmark.Type, '')
+	FROM Bookmark
+	LEFT JOIN content ON content.ContentID = Bookmark.VolumeID AND content.ContentType = 6
+	ORDER BY content.Title, Bookmark.DateCreated, Bookmark.BookmarkID
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch Bookmarks from Kobo database: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []*Entry{}
+	for rows.Next() {
+		e := &Entry{}
+		if err := rows.Scan(&e.Id, &e.Book, &e.Type); err != nil {
+			return nil, fmt.Errorf("Could not read Bookmark from Kobo database: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
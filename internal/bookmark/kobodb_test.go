@@ -0,0 +1,43 @@
+package bookmark
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestEntries(t *testing.T) {
+	dbPath, _ := testKoboDevice(t)
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a dogear and an empty highlight, AllBookmarks has nothing to do with them
+	_, err = db.Exec(`INSERT INTO Bookmark (BookmarkID, VolumeID, ContentID, StartContainerPath, StartOffset,
+		EndContainerPath, EndOffset, DateCreated, Type) VALUES
+		('d1', ?1, ?1, '', 0, '', 0, '2024-03-04T10:00:00Z', 'dogear'),
+		('h3', ?1, ?1, '', 0, '', 0, '2024-03-05T10:00:00Z', 'highlight')`, testVolume)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ConnectKoboDB(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseKoboDB()
+
+	entries, err := Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]string{}
+	for _, e := range entries {
+		if e.Book != "Test Book" {
+			t.Errorf("Entry %s of book %q", e.Id, e.Book)
+		}
+		types[e.Id] = e.Type
+	}
+	if len(entries) != 5 || types["d1"] != DOGEAR || types["h3"] != HIGHLIGHT || types["m1"] != MARKUP {
+		t.Errorf("Entries = %v", types)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Markup struct {
@@ -13,8 +14,16 @@ type Markup struct {
 	Part      string
 	Location  string
 	OrderId   float64
-	svgPath   string
-	jpgPath   string
+	VolumeId  string
+	ContentId string
+	// [0,1] how far into the chapter the markup is
+	ChapterProgress float64
+	Created         time.Time
+	Modified        time.Time
+	// Device the markup was made on
+	Device  string
+	svgPath string
+	jpgPath string
 }
 
 func (self *Markup) Kind() string {
@@ -0,0 +1,131 @@
+package bookmark
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Merges the bookmarks read from several devices (or snapshots of them) into one Bookmarks per
+// book. The same annotation is recognized by its BookmarkID, which is what the Kobo sync keeps
+// across devices, or by having the same text in the same position, for books sideloaded in each
+// device. When a highlight is found twice, the text, note and color of the most recently modified
+// version are kept under the first id seen, and the device where it was first created stays as its
+// origin
+func Merge(sets ...[]*Bookmarks) []*Bookmarks {
+	merged := []*Bookmarks{}
+	byBook := map[string]*bookMerge{}
+
+	for _, set := range sets {
+		for _, bms := range set {
+			bm, ok := byBook[bms.Book]
+			if !ok {
+				bm = &bookMerge{
+					Bookmarks: &Bookmarks{
+						Book:       bms.Book,
+						Markups:    []*Markup{},
+						Highlights: []*Highlight{},
+					},
+					highs: map[string]*Highlight{},
+					marks: map[string]*Markup{},
+				}
+				byBook[bms.Book] = bm
+				merged = append(merged, bm.Bookmarks)
+			}
+			bm.add(bms)
+		}
+	}
+
+	return merged
+}
+
+type bookMerge struct {
+	*Bookmarks
+	// by BookmarkID and by position key
+	highs map[string]*Highlight
+	marks map[string]*Markup
+}
+
+func (self *bookMerge) add(bms *Bookmarks) {
+	if self.VolumeId == "" {
+		self.VolumeId = bms.VolumeId
+	}
+	if self.ContentId == "" {
+		self.ContentId = bms.ContentId
+	}
+	if self.Author == "" {
+		self.Author = bms.Author
+	}
+	if self.ISBN == "" {
+		self.ISBN = bms.ISBN
+	}
+
+	for _, h := range bms.Highlights {
+		key := h.mergeKey()
+		existing, ok := self.highs[h.Id]
+		if !ok {
+			existing, ok = self.highs[key]
+		}
+		if !ok {
+			self.Highlights = append(self.Highlights, h)
+			self.highs[h.Id] = h
+			self.highs[key] = h
+			continue
+		}
+
+		if firstCreated(h.Created, existing.Created) {
+			existing.Device, existing.Created = h.Device, h.Created
+		}
+		// only what can be edited on the device, the id and position stay those of the first one
+		if h.Modified.After(existing.Modified) {
+			existing.text, existing.Note, existing.color, existing.Modified = h.text, h.Note, h.color, h.Modified
+		}
+		self.highs[h.Id] = existing
+	}
+
+	for _, m := range bms.Markups {
+		key := m.mergeKey()
+		existing, ok := self.marks[m.Id]
+		if !ok && key != "" {
+			existing, ok = self.marks[key]
+		}
+		if !ok {
+			self.Markups = append(self.Markups, m)
+			self.marks[m.Id] = m
+			if key != "" {
+				self.marks[key] = m
+			}
+			continue
+		}
+
+		origin := existing.Device
+		if firstCreated(m.Created, existing.Created) {
+			origin = m.Device
+		}
+		if m.Modified.After(existing.Modified) {
+			*existing = *m
+		}
+		existing.Device = origin
+		self.marks[m.Id] = existing
+	}
+}
+
+// Whether created comes before than. An unknown date (zero) never comes first
+func firstCreated(created time.Time, than time.Time) bool {
+	return !created.IsZero() && (than.IsZero() || created.Before(than))
+}
+
+// Same chapter, same start and same text, regardless of the BookmarkID
+func (self *Highlight) mergeKey() string {
+	text := strings.Join(strings.Fields(self.text), " ")
+	return fmt.Sprintf("%s|%s|%d|%s", self.ChapterHref(), self.StartPath, self.StartOffset, text)
+}
+
+// Markups have no text, the same page and creation time is as close as we can get. Without a
+// date that's too little to tell two markups apart, so there's no key and only the BookmarkID counts
+func (self *Markup) mergeKey() string {
+	if self.Created.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%s|%s|%s|%d", self.ContentId, self.Section, self.Location, self.Created.Unix())
+}
@@ -0,0 +1,80 @@
+package bookmark
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 10, 0, 0, 0, time.UTC) }
+	libra := []*Bookmarks{{
+		Book: "Test Book",
+		Highlights: []*Highlight{
+			// synced, same ID in both devices, edited later in the elipsa
+			{Id: "h1", Device: "libra", Created: day(1), Modified: day(1), text: "Synced", Note: "old"},
+			// sideloaded in both, different ID but same place and text
+			{Id: "h2", Device: "libra", VolumeId: "v1", ContentId: "v1!!ch1.xhtml", StartPath: "span#kobo.2.1",
+				Created: day(2), Modified: day(2), text: "Same  text"},
+			{Id: "h3", Device: "libra", Created: day(3), Modified: day(3), text: "Only in libra"},
+		},
+		Markups: []*Markup{
+			{Id: "m1", Device: "libra", Created: day(4), Modified: day(4)},
+			// no dates, same page as m4 but a different markup
+			{Id: "m3", Device: "libra", ContentId: "v1!!ch1.xhtml", Section: "chapter01", Location: "1.1"},
+		},
+	}}
+	elipsa := []*Bookmarks{
+		{
+			Book:   "Test Book",
+			Author: "Jane Doe",
+			Highlights: []*Highlight{
+				{Id: "h1", Device: "elipsa", Created: day(1), Modified: day(5), text: "Synced", Note: "new", color: 2},
+				// h3 edited in the elipsa, which lost its creation date
+				{Id: "h3", Device: "elipsa", Modified: day(8), text: "Only in libra", Note: "edited"},
+				{Id: "x2", Device: "elipsa", VolumeId: "v2", ContentId: "v2!!ch1.xhtml", StartPath: "span#kobo.2.1",
+					Created: day(1), Modified: day(1), text: "Same text"},
+			},
+			Markups: []*Markup{
+				{Id: "m2", Device: "elipsa", Created: day(6), Modified: day(6)},
+				// m1 synced, with its date stamped again
+				{Id: "m1", Device: "elipsa", Created: day(7), Modified: day(7)},
+				{Id: "m4", Device: "elipsa", ContentId: "v1!!ch1.xhtml", Section: "chapter01", Location: "1.1"},
+			},
+		},
+		{Book: "Other Book"},
+	}
+
+	merged := Merge(libra, elipsa)
+	if len(merged) != 2 {
+		t.Fatalf("Want 2 books, got %d", len(merged))
+	}
+	book := merged[0]
+	if book.Author != "Jane Doe" {
+		t.Errorf("Book metadata not merged, want author Jane Doe, got %q", book.Author)
+	}
+	if len(book.Highlights) != 3 || len(book.Markups) != 4 {
+		t.Fatalf("Want 3 highlights and 4 markups, got %d and %d", len(book.Highlights), len(book.Markups))
+	}
+	if m1 := book.Markups[0]; m1.Id != "m1" || !m1.Modified.Equal(day(7)) || m1.Device != "libra" {
+		t.Errorf("Want m1 once, in its newest version, got %+v", m1)
+	}
+
+	h1 := book.Highlights[0]
+	if h1.Note != "new" || h1.Device != "libra" {
+		t.Errorf("Want the newest version of h1 with its origin device, got note %q from %q", h1.Note, h1.Device)
+	}
+	if h1.color != 2 || !h1.Modified.Equal(day(5)) {
+		t.Errorf("Want the color and date of the newest h1, got %d at %v", h1.color, h1.Modified)
+	}
+	h2 := book.Highlights[1]
+	if h2.Device != "elipsa" || !h2.Created.Equal(day(1)) {
+		t.Errorf("Want the origin of h2 to be the device where it was created first, got %q", h2.Device)
+	}
+	if h2.Id != "h2" || h2.VolumeId != "v1" {
+		t.Errorf("Want h2 to keep the id and position it was first seen with, got %s in %s", h2.Id, h2.VolumeId)
+	}
+	h3 := book.Highlights[2]
+	if h3.Note != "edited" || h3.Device != "libra" || !h3.Created.Equal(day(3)) {
+		t.Errorf("Want h3 edited, created in the libra, got note %q from %q at %v", h3.Note, h3.Device, h3.Created)
+	}
+}
@@ -0,0 +1,402 @@
+package bookmark
+
+import (
+	"database/sql"
+	"fmt"
+	"kme/internal/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What happened to each bookmark of a restore, Reason only for skipped and conflicted ones
+type RestoreItem struct {
+	Id     string
+	Book   string
+	Reason string
+}
+
+type RestoreReport struct {
+	Restored   []RestoreItem
+	Skipped    []RestoreItem
+	Conflicted []RestoreItem
+}
+
+// A bookmark to restore, as the column values of its Kobo Bookmark row
+type restoreRow struct {
+	values  map[string]any
+	title   string
+	author  string
+	svgFile string
+	jpgFile string
+}
+
+type targetColumn struct {
+	name    string
+	kind    string
+	notNull bool
+	hasDflt bool
+}
+
+// Makes a consistent copy of a Kobo DB, including what is still in its WAL, to restore into
+func CopyKoboDB(dbPath string, dest string) error {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return fmt.Errorf("Could not open %s: %w", dbPath, err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`VACUUM INTO ?1`, dest); err != nil {
+		return fmt.Errorf("Could not copy %s: %w", dbPath, err)
+	}
+	return nil
+}
+
+// Restores the bookmarks of another Kobo DB (e.g. from a backup) into targetDb. Whole rows are
+// copied, so nothing the Kobo keeps is lost as long as both DBs have the same columns
+func RestoreFromKoboDB(srcDb string, srcMarkPath string, targetDb string, targetMarkPath string) (*RestoreReport, error) {
+	db, err := sql.Open("sqlite", srcDb)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %s: %w", srcDb, err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+	SELECT Bookmark.*, content.Title AS kme_title, content.Attribution AS kme_author
+	FROM Bookmark
+	LEFT JOIN content ON content.ContentID = Bookmark.VolumeID
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read bookmarks from %s: %w", srcDb, err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read bookmarks from %s: %w", srcDb, err)
+	}
+	restoreRows := []restoreRow{}
+	for rows.Next() {
+		vals := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, fmt.Errorf("Could not read bookmarks from %s: %w", srcDb, err)
+		}
+
+		r := restoreRow{values: map[string]any{}}
+		for i, c := range cols {
+			switch c {
+			case "kme_title":
+				r.title = asString(vals[i])
+			case "kme_author":
+				r.author = asString(vals[i])
+			default:
+				r.values[c] = vals[i]
+			}
+		}
+		r.setMarkupFiles(srcMarkPath)
+		restoreRows = append(restoreRows, r)
+	}
+
+	return restore(restoreRows, targetDb, targetMarkPath)
+}
+
+// Restores the archived bookmarks into targetDb. The archive only has the columns kme reads, the
+// Kobo fills the rest with its defaults
+func RestoreFromArchive(archivePath string, cacheDir string, targetDb string, targetMarkPath string) (*RestoreReport, error) {
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("Archive %s does not exist", archivePath)
+	}
+	adb, err := OpenArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer adb.Close()
+	adb.cacheDir = cacheDir
+
+	rows, err := adb.db.Query(`
+	SELECT bookmarks.id, bookmarks.volume_id, bookmarks.content_id, start_path, start_offset,
+		end_path, end_offset, text, annotation, date_created, date_modified, chapter_progress, type,
+		color, books.title, books.author
+	FROM bookmarks
+	INNER JOIN books ON books.volume_id = bookmarks.volume_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read bookmarks from archive: %w", err)
+	}
+	defer rows.Close()
+
+	// Kobo column names, in the order of the query
+	cols := []string{"BookmarkID", "VolumeID", "ContentID", "StartContainerPath", "StartOffset",
+		"EndContainerPath", "EndOffset", "Text", "Annotation", "DateCreated", "DateModified",
+		"ChapterProgress", "Type", "Color"}
+	restoreRows := []restoreRow{}
+	for rows.Next() {
+		vals := make([]any, len(cols))
+		var title, author sql.NullString
+		ptrs := []any{}
+		for i := range vals {
+			ptrs = append(ptrs, &vals[i])
+		}
+		if err := rows.Scan(append(ptrs, &title, &author)...); err != nil {
+			return nil, fmt.Errorf("Could not read bookmarks from archive: %w", err)
+		}
+
+		r := restoreRow{values: map[string]any{}, title: title.String, author: author.String}
+		for i, c := range cols {
+			r.values[c] = vals[i]
+		}
+		if asString(r.values["Type"]) == MARKUP {
+			if err := adb.extractMarkupImages(asString(r.values["BookmarkID"])); err != nil {
+				return nil, err
+			}
+		}
+		r.setMarkupFiles(cacheDir)
+		restoreRows = append(restoreRows, r)
+	}
+	rows.Close()
+
+	return restore(restoreRows, targetDb, targetMarkPath)
+}
+
+func (self *restoreRow) setMarkupFiles(markPath string) {
+	if asString(self.values["Type"]) != MARKUP {
+		return
+	}
+	m := &Markup{Id: asString(self.values["BookmarkID"])}
+	if m.HasImagePair(markPath) {
+		self.svgFile = m.SvgFile(markPath)
+		self.jpgFile = m.JpgFile(markPath)
+	}
+}
+
+// Inserts the bookmarks whose book is in targetDb, matched by VolumeID or else by title and author.
+// Bookmarks already there are skipped, and a different bookmark with the same id is a conflict
+// that is left alone. Markup files are copied into targetMarkPath
+func restore(rows []restoreRow, targetDb string, targetMarkPath string) (*RestoreReport, error) {
+	db, err := sql.Open("sqlite", targetDb)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %s: %w", targetDb, err)
+	}
+	defer db.Close()
+
+	columns, err := bookmarkColumns(db)
+	if err != nil {
+		return nil, err
+	}
+	byId, byTitle, err := targetBooks(db)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("Could not write to %s: %w", targetDb, err)
+	}
+	defer tx.Rollback()
+
+	report := &RestoreReport{}
+	for _, r := range rows {
+		item := RestoreItem{Id: asString(r.values["BookmarkID"]), Book: r.title}
+
+		srcVolume := asString(r.values["VolumeID"])
+		volume, ok := byId[srcVolume]
+		if !ok {
+			volume, ok = byTitle[bookKey(r.title, r.author)]
+		}
+		if !ok {
+			item.Reason = "book not on the device"
+			report.Skipped = append(report.Skipped, item)
+			continue
+		}
+		// the same book sideloaded again may live somewhere else
+		r.values["VolumeID"] = volume
+		r.values["ContentID"] = volume + strings.TrimPrefix(asString(r.values["ContentID"]), srcVolume)
+
+		conflict, present, err := existingBookmark(tx, r)
+		if err != nil {
+			return nil, err
+		}
+		if conflict {
+			item.Reason = "a different bookmark with the same id is on the device"
+			report.Conflicted = append(report.Conflicted, item)
+			continue
+		}
+		if present {
+			item.Reason = "already on the device"
+			report.Skipped = append(report.Skipped, item)
+			continue
+		}
+		if asString(r.values["Type"]) == MARKUP && r.svgFile == "" {
+			item.Reason = "markup images missing from the backup"
+			report.Skipped = append(report.Skipped, item)
+			continue
+		}
+
+		if err := insertBookmark(tx, columns, r); err != nil {
+			return nil, fmt.Errorf("Could not restore bookmark %s: %w", item.Id, err)
+		}
+		if r.svgFile != "" {
+			if err := copyMarkupFiles(r, targetMarkPath); err != nil {
+				return nil, err
+			}
+		}
+		report.Restored = append(report.Restored, item)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Could not write to %s: %w", targetDb, err)
+	}
+	return report, nil
+}
+
+func bookmarkColumns(db *sql.DB) ([]targetColumn, error) {
+	rows, err := db.Query(`PRAGMA table_info(Bookmark)`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the Bookmark table: %w", err)
+	}
+	defer rows.Close()
+
+	columns := []targetColumn{}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, kind string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &dflt, &pk); err != nil {
+			return nil, fmt.Errorf("Could not read the Bookmark table: %w", err)
+		}
+		columns = append(columns, targetColumn{name: name, kind: strings.ToUpper(kind), notNull: notNull == 1, hasDflt: dflt.Valid})
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("The target database has no Bookmark table")
+	}
+	return columns, nil
+}
+
+// Books in the target DB by VolumeID, and VolumeIDs by title and author
+func targetBooks(db *sql.DB) (map[string]string, map[string]string, error) {
+	rows, err := db.Query(`SELECT ContentID, Title, Attribution FROM content WHERE ContentType = 6`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read books from the target database: %w", err)
+	}
+	defer rows.Close()
+
+	byId := map[string]string{}
+	byTitle := map[string]string{}
+	for rows.Next() {
+		var id string
+		var title, author sql.NullString
+		if err := rows.Scan(&id, &title, &author); err != nil {
+			continue
+		}
+		byId[id] = id
+		if title.String != "" {
+			byTitle[bookKey(title.String, author.String)] = id
+		}
+	}
+	return byId, byTitle, nil
+}
+
+func bookKey(title string, author string) string {
+	normalize := func(s string) string {
+		return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	}
+	return normalize(title) + "|" + normalize(author)
+}
+
+// Whether the bookmark is already in the target (same id and text, or another id in the exact same
+// position), or the id is taken by a different bookmark
+func existingBookmark(tx *sql.Tx, r restoreRow) (conflict bool, present bool, err error) {
+	var path, text sql.NullString
+	var offset sql.NullInt64
+	err = tx.QueryRow(
+		`SELECT StartContainerPath, StartOffset, Text FROM Bookmark WHERE BookmarkID = ?1`,
+		r.values["BookmarkID"],
+	).Scan(&path, &offset, &text)
+	if err == nil {
+		// NULL offsets only match NULL ones, a NULL isn't 0
+		sameOffset := offset.Valid == (r.values["StartOffset"] != nil) &&
+			(!offset.Valid || fmt.Sprint(offset.Int64) == asString(r.values["StartOffset"]))
+		same := path.String == asString(r.values["StartContainerPath"]) && sameOffset &&
+			text.String == asString(r.values["Text"])
+		return !same, same, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, false, fmt.Errorf("Could not read the target database: %w", err)
+	}
+
+	var count int
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM Bookmark
+	WHERE ContentID = ?1 AND StartContainerPath IS ?2 AND StartOffset IS ?3 AND Type = ?4
+		AND IFNULL(Text, '') = ?5
+	`, r.values["ContentID"], r.values["StartContainerPath"], r.values["StartOffset"], r.values["Type"],
+		asString(r.values["Text"]),
+	).Scan(&count)
+	if err != nil {
+		return false, false, fmt.Errorf("Could not read the target database: %w", err)
+	}
+	return false, count > 0, nil
+}
+
+// Only the columns both sides have. Required columns we have no value for get a zero value, so
+// rows from the archive can still be inserted
+func insertBookmark(tx *sql.Tx, columns []targetColumn, r restoreRow) error {
+	names := []string{}
+	args := []any{}
+	for _, c := range columns {
+		v, ok := r.values[c.name]
+		if !ok || v == nil {
+			if !c.notNull || c.hasDflt {
+				continue
+			}
+			v = zeroValue(c.kind)
+		}
+		names = append(names, c.name)
+		args = append(args, v)
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO Bookmark (%s) VALUES (%s)",
+		strings.Join(names, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "),
+	)
+	_, err := tx.Exec(query, args...)
+	return err
+}
+
+func zeroValue(kind string) any {
+	switch {
+	case strings.Contains(kind, "INT"), strings.Contains(kind, "BOOL"), strings.Contains(kind, "BIT"):
+		return 0
+	case strings.Contains(kind, "REAL"), strings.Contains(kind, "FLOA"), strings.Contains(kind, "DOUB"):
+		return 0.0
+	default:
+		return ""
+	}
+}
+
+func copyMarkupFiles(r restoreRow, markPath string) error {
+	if err := os.MkdirAll(markPath, 0755); err != nil {
+		return fmt.Errorf("Could not create markups directory: %w", err)
+	}
+	for _, src := range []string{r.svgFile, r.jpgFile} {
+		if err := utils.CopyFile(src, filepath.Join(markPath, filepath.Base(src))); err != nil {
+			return fmt.Errorf("Could not restore markup %s: %w", asString(r.values["BookmarkID"]), err)
+		}
+	}
+	return nil
+}
+
+func asString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
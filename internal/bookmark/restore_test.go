@@ -0,0 +1,77 @@
+package bookmark
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreFromKoboDB(t *testing.T) {
+	srcDb, srcMarks := testKoboDevice(t)
+	targetDb, _ := testKoboDevice(t)
+	targetMarks := filepath.Join(t.TempDir(), "markups")
+
+	// the target lost h2 and m1, and has its own h1
+	db, err := sql.Open("sqlite", targetDb)
+	if err != nil {
+		t.Fatalf("Could not open target: %v", err)
+	}
+	for _, q := range []string{
+		`DELETE FROM Bookmark WHERE BookmarkID IN ('h2', 'm1')`,
+		`UPDATE Bookmark SET Text = 'Changed' WHERE BookmarkID = 'h1'`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("Could not prepare target: %v", err)
+		}
+	}
+	db.Close()
+
+	report, err := RestoreFromKoboDB(srcDb, srcMarks, targetDb, targetMarks)
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if len(report.Restored) != 2 || len(report.Conflicted) != 1 || report.Conflicted[0].Id != "h1" {
+		t.Fatalf("Want h2 and m1 restored and h1 conflicted, got %+v", report)
+	}
+	if !(&Markup{Id: "m1"}).HasImagePair(targetMarks) {
+		t.Errorf("Markup images were not restored")
+	}
+
+	// nothing left to do the second time
+	report, err = RestoreFromKoboDB(srcDb, srcMarks, targetDb, targetMarks)
+	if err != nil || len(report.Restored) != 0 || len(report.Skipped) != 2 {
+		t.Errorf("Want everything skipped on a second restore, got %+v (%v)", report, err)
+	}
+}
+
+func TestRestoreNullOffset(t *testing.T) {
+	srcDb, srcMarks := testKoboDevice(t)
+	targetDb, _ := testKoboDevice(t)
+
+	// older Kobos leave StartOffset NULL, the same h1 is on both sides
+	for _, path := range []string{srcDb, targetDb} {
+		db, err := sql.Open("sqlite", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range []string{
+			`CREATE TABLE nullable AS SELECT * FROM Bookmark`,
+			`DROP TABLE Bookmark`,
+			`ALTER TABLE nullable RENAME TO Bookmark`,
+			`UPDATE Bookmark SET StartOffset = NULL WHERE BookmarkID = 'h1'`,
+		} {
+			if _, err := db.Exec(q); err != nil {
+				t.Fatalf("Could not prepare %s: %v", path, err)
+			}
+		}
+		db.Close()
+	}
+
+	report, err := RestoreFromKoboDB(srcDb, srcMarks, targetDb, filepath.Join(t.TempDir(), "markups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Conflicted) != 0 || len(report.Restored) != 0 {
+		t.Errorf("Want h1 taken as the same bookmark, got %+v", report)
+	}
+}
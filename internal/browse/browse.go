@@ -0,0 +1,512 @@
+package browse
+
+import (
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/export"
+	"kme/internal/utils"
+	"slices"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+const (
+	helpBooks      = "↑↓ move · enter open · / search · 1-4 colors · 0 all colors · e export · q quit"
+	helpHighlights = "↑↓ move · space select · / search · 1-4 colors · 0 all colors · e export · c copy · esc back · q quit"
+)
+
+type Options struct {
+	Palette export.Palette
+	// Writes the bookmarks somewhere, returns what to tell in the status bar
+	Export func([]*bookmark.Bookmarks) (string, error)
+	// Puts the text in the clipboard
+	Copy func(string) error
+}
+
+type view int
+
+const (
+	booksView view = iota
+	highlightsView
+)
+
+// A line on screen, item is the index of the book or highlight it belongs to, -1 for none
+type row struct {
+	text  string
+	style tcell.Style
+	item  int
+}
+
+// Full screen browser of a library: the books, and the highlights of a book by chapter
+type Browser struct {
+	screen  tcell.Screen
+	library []*bookmark.Bookmarks
+	opts    Options
+
+	view   view
+	books  []*bookmark.Bookmarks
+	book   *bookmark.Bookmarks
+	items  []*bookmark.Highlight
+	cursor int
+	offset int
+	// cursor in the book list, to get back to it
+	bookCursor int
+
+	selected map[string]bool
+	// colors shown, all of them when empty
+	colors map[int]bool
+	query  string
+	// what is being typed in the search line, nil when not searching
+	input  *string
+	status string
+}
+
+func New(screen tcell.Screen, library []*bookmark.Bookmarks, opts Options) *Browser {
+	return &Browser{
+		screen:   screen,
+		library:  library,
+		opts:     opts,
+		selected: map[string]bool{},
+		colors:   map[int]bool{},
+	}
+}
+
+// Runs until the user quits. The screen must be initialized, and is left to the caller to finish
+func (self *Browser) Run() error {
+	self.filterBooks()
+	for {
+		self.draw()
+		ev := self.screen.PollEvent()
+		switch ev := ev.(type) {
+		case nil:
+			return nil
+		case *tcell.EventResize:
+			self.screen.Sync()
+		case *tcell.EventKey:
+			if quit := self.handleKey(ev); quit {
+				return nil
+			}
+		}
+	}
+}
+
+func (self *Browser) handleKey(ev *tcell.EventKey) (quit bool) {
+	if self.input != nil {
+		self.handleInput(ev)
+		return false
+	}
+	self.status = ""
+
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		return true
+	case tcell.KeyUp:
+		self.move(-1)
+	case tcell.KeyDown:
+		self.move(1)
+	case tcell.KeyPgUp:
+		self.move(-self.pageSize())
+	case tcell.KeyPgDn:
+		self.move(self.pageSize())
+	case tcell.KeyHome:
+		self.move(-len(self.library) - len(self.items))
+	case tcell.KeyEnd:
+		self.move(len(self.library) + len(self.items))
+	case tcell.KeyEnter, tcell.KeyRight:
+		self.open()
+	case tcell.KeyEscape, tcell.KeyLeft, tcell.KeyBackspace, tcell.KeyBackspace2:
+		self.back()
+	case tcell.KeyRune:
+		return self.handleRune(ev.Rune())
+	}
+	return false
+}
+
+func (self *Browser) handleRune(r rune) (quit bool) {
+	switch r {
+	case 'q':
+		return true
+	case 'k':
+		self.move(-1)
+	case 'j':
+		self.move(1)
+	case 'l':
+		self.open()
+	case 'h':
+		self.back()
+	case '/':
+		input := self.query
+		self.input = &input
+	case '0':
+		self.colors = map[int]bool{}
+		self.refresh()
+	case '1', '2', '3', '4':
+		// same order as the Kobo color codes: yellow, red, blue, green
+		code := int(r - '1')
+		if self.colors[code] {
+			delete(self.colors, code)
+		} else {
+			self.colors[code] = true
+		}
+		self.refresh()
+	case ' ':
+		if h := self.current(); h != nil {
+			self.selected[h.Id] = !self.selected[h.Id]
+			self.move(1)
+		}
+	case 'e':
+		self.export()
+	case 'c':
+		self.copy()
+	}
+	return false
+}
+
+func (self *Browser) handleInput(ev *tcell.EventKey) {
+	switch ev.Key() {
+	case tcell.KeyEscape:
+		self.input = nil
+	case tcell.KeyEnter:
+		self.query = strings.TrimSpace(*self.input)
+		self.input = nil
+		self.refresh()
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if s := *self.input; s != "" {
+			r := []rune(s)
+			*self.input = string(r[:len(r)-1])
+		}
+	case tcell.KeyRune:
+		*self.input += string(ev.Rune())
+	}
+}
+
+func (self *Browser) open() {
+	if self.view != booksView || len(self.books) == 0 {
+		return
+	}
+	self.bookCursor = self.cursor
+	self.book = self.books[self.cursor]
+	self.view = highlightsView
+	self.cursor, self.offset = 0, 0
+	self.filterHighlights()
+}
+
+func (self *Browser) back() {
+	if self.view == booksView {
+		if self.query != "" {
+			self.query = ""
+			self.refresh()
+		}
+		return
+	}
+	self.view = booksView
+	self.book = nil
+	self.filterBooks()
+	self.cursor, self.offset = min(self.bookCursor, max(len(self.books)-1, 0)), 0
+}
+
+func (self *Browser) refresh() {
+	if self.view == booksView {
+		self.filterBooks()
+	} else {
+		self.filterHighlights()
+	}
+	self.move(0)
+}
+
+func (self *Browser) move(delta int) {
+	n := len(self.books)
+	if self.view == highlightsView {
+		n = len(self.items)
+	}
+	self.cursor = max(0, min(self.cursor+delta, n-1))
+}
+
+func (self *Browser) pageSize() int {
+	_, h := self.screen.Size()
+	return max(h-3, 1)
+}
+
+func (self *Browser) current() *bookmark.Highlight {
+	if self.view != highlightsView || self.cursor >= len(self.items) {
+		return nil
+	}
+	return self.items[self.cursor]
+}
+
+// Books with at least one highlight passing the filters, or with a title matching the search
+func (self *Browser) filterBooks() {
+	self.books = []*bookmark.Bookmarks{}
+	for _, bm := range self.library {
+		if len(self.visible(bm)) > 0 || (self.query != "" && len(self.colors) == 0 && self.bookMatches(bm)) {
+			self.books = append(self.books, bm)
+		}
+	}
+}
+
+func (self *Browser) filterHighlights() {
+	self.items = self.visible(self.book)
+}
+
+// Highlights of the book passing the color filter and the search, in reading order
+func (self *Browser) visible(bm *bookmark.Bookmarks) []*bookmark.Highlight {
+	visible := []*bookmark.Highlight{}
+	titleMatch := self.bookMatches(bm)
+	for _, c := range export.Chapters(bm) {
+		for _, h := range c.Highlights {
+			if len(self.colors) > 0 && !self.colors[h.Color()] {
+				continue
+			}
+			if !titleMatch && !matches(self.query, h.Text(), h.Note, h.Section) {
+				continue
+			}
+			visible = append(visible, h)
+		}
+	}
+	return visible
+}
+
+func (self *Browser) bookMatches(bm *bookmark.Bookmarks) bool {
+	return self.query != "" && matches(self.query, bm.Book, bm.Author)
+}
+
+// Every word of the query is in one of the texts, ignoring case
+func matches(query string, texts ...string) bool {
+	all := strings.ToLower(strings.Join(texts, " "))
+	for _, w := range strings.Fields(strings.ToLower(query)) {
+		if !strings.Contains(all, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// The selected highlights, or all the visible ones if none is selected
+func (self *Browser) exportSelection() []*bookmark.Bookmarks {
+	books := self.books
+	if self.view == highlightsView {
+		books = []*bookmark.Bookmarks{self.book}
+	}
+
+	selection := []*bookmark.Bookmarks{}
+	anySelected := slices.ContainsFunc(books, func(bm *bookmark.Bookmarks) bool {
+		return slices.ContainsFunc(bm.Highlights, func(h *bookmark.Highlight) bool { return self.selected[h.Id] })
+	})
+	for _, bm := range books {
+		highs := self.visible(bm)
+		if anySelected {
+			highs = slices.DeleteFunc(highs, func(h *bookmark.Highlight) bool { return !self.selected[h.Id] })
+		}
+		if len(highs) == 0 {
+			continue
+		}
+		part := *bm
+		part.Highlights = highs
+		part.Markups = []*bookmark.Markup{}
+		selection = append(selection, &part)
+	}
+	return selection
+}
+
+func (self *Browser) export() {
+	if self.opts.Export == nil {
+		return
+	}
+	selection := self.exportSelection()
+	if len(selection) == 0 {
+		self.status = "Nothing to export"
+		return
+	}
+	msg, err := self.opts.Export(selection)
+	// exporters print what they write, which messes the screen
+	self.screen.Sync()
+	if err != nil {
+		// one line per book that failed, the status bar only has the one
+		self.status = strings.ReplaceAll(err.Error(), "\n", "; ")
+		return
+	}
+	self.status = msg
+}
+
+func (self *Browser) copy() {
+	h := self.current()
+	if h == nil || self.opts.Copy == nil {
+		return
+	}
+	if err := self.opts.Copy(h.Text()); err != nil {
+		self.status = err.Error()
+		return
+	}
+	self.status = "Highlight copied"
+}
+
+func (self *Browser) draw() {
+	self.screen.Clear()
+	w, h := self.screen.Size()
+	if w <= 0 || h <= 0 {
+		return
+	}
+
+	var title string
+	var rows []row
+	if self.view == booksView {
+		title = fmt.Sprintf(" kme · %d books", len(self.books))
+		rows = self.bookRows(w)
+	} else {
+		title = fmt.Sprintf(" %s · %s · %d highlights", self.book.Book, self.book.Author, len(self.items))
+		rows = self.highlightRows(w)
+	}
+	if filters := self.filterText(); filters != "" {
+		title += " · " + filters
+	}
+	drawText(self.screen, 0, 0, w, title, tcell.StyleDefault.Reverse(true))
+
+	// keep the rows of the current item in view
+	listHeight := h - 2
+	first, last := -1, -1
+	for i, r := range rows {
+		if r.item == self.cursor {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first >= 0 {
+		if first < self.offset {
+			self.offset = first
+		}
+		if last >= self.offset+listHeight {
+			self.offset = last - listHeight + 1
+		}
+	}
+	// chapter title above the first highlight of the book
+	if self.cursor == 0 {
+		self.offset = 0
+	}
+	self.offset = max(0, min(self.offset, len(rows)-1))
+
+	for y := 0; y < listHeight && self.offset+y < len(rows); y++ {
+		r := rows[self.offset+y]
+		style := r.style
+		prefix := "  "
+		if r.item == self.cursor && r.item >= 0 {
+			prefix = "▶ "
+		}
+		drawText(self.screen, 0, y+1, 2, prefix, tcell.StyleDefault.Bold(true))
+		drawText(self.screen, 2, y+1, w-2, r.text, style)
+	}
+
+	self.drawStatus(w, h)
+	self.screen.Show()
+}
+
+func (self *Browser) drawStatus(w int, h int) {
+	style := tcell.StyleDefault.Reverse(true)
+	switch {
+	case self.input != nil:
+		drawText(self.screen, 0, h-1, w, "/"+*self.input+"▏", style)
+	case self.status != "":
+		drawText(self.screen, 0, h-1, w, " "+self.status, style)
+	case self.view == booksView:
+		drawText(self.screen, 0, h-1, w, " "+helpBooks, style)
+	default:
+		drawText(self.screen, 0, h-1, w, " "+helpHighlights, style)
+	}
+}
+
+func (self *Browser) filterText() string {
+	parts := []string{}
+	if self.query != "" {
+		parts = append(parts, fmt.Sprintf("search %q", self.query))
+	}
+	if len(self.colors) > 0 {
+		h := &bookmark.Highlight{}
+		colors := ""
+		for code := range 4 {
+			if self.colors[code] {
+				colors += string(h.Colors(code))
+			}
+		}
+		parts = append(parts, colors)
+	}
+	return strings.Join(parts, " · ")
+}
+
+func (self *Browser) bookRows(w int) []row {
+	rows := []row{}
+	for i, bm := range self.books {
+		count := fmt.Sprintf("%d highlights", len(bm.Highlights))
+		if visible := len(self.visible(bm)); visible != len(bm.Highlights) {
+			count = fmt.Sprintf("%d of %d highlights", visible, len(bm.Highlights))
+		}
+		if len(bm.Markups) > 0 {
+			count += fmt.Sprintf(", %d markups", len(bm.Markups))
+		}
+		text := bm.Book
+		if bm.Author != "" {
+			text += " — " + bm.Author
+		}
+		// counts aligned to the right
+		pad := max(w-4-runewidth.StringWidth(text)-runewidth.StringWidth(count), 2)
+		rows = append(rows, row{text: text + strings.Repeat(" ", pad) + count, item: i})
+	}
+	return rows
+}
+
+func (self *Browser) highlightRows(w int) []row {
+	rows := []row{}
+	width := max(w-6, 10)
+	section := ""
+	for i, h := range self.items {
+		if h.Section != section || i == 0 {
+			section = h.Section
+			rows = append(rows, row{text: section, style: tcell.StyleDefault.Bold(true).Underline(true), item: -1})
+		}
+
+		style := self.colorStyle(h.Color())
+		mark := "  "
+		if self.selected[h.Id] {
+			mark = "✓ "
+		}
+		for j, line := range utils.Wrap(h.Text(), width) {
+			if j > 0 {
+				mark = "  "
+			}
+			rows = append(rows, row{text: mark + line, style: style, item: i})
+		}
+		if h.Note != "" {
+			for _, line := range utils.Wrap("✎ "+h.Note, width) {
+				rows = append(rows, row{text: "  " + line, style: tcell.StyleDefault.Italic(true), item: i})
+			}
+		}
+		rows = append(rows, row{item: -1})
+	}
+	return rows
+}
+
+func (self *Browser) colorStyle(code int) tcell.Style {
+	sw, ok := self.opts.Palette[code]
+	if !ok {
+		return tcell.StyleDefault
+	}
+	return tcell.StyleDefault.Background(tcell.GetColor(sw.Background)).Foreground(tcell.GetColor(sw.Font))
+}
+
+func drawText(s tcell.Screen, x int, y int, width int, text string, style tcell.Style) {
+	col := x
+	for _, r := range text {
+		rw := runewidth.RuneWidth(r)
+		if col+rw > x+width {
+			break
+		}
+		s.SetContent(col, y, r, nil, style)
+		col += rw
+	}
+	// the style, e.g. reversed bars, fills the whole width
+	for ; col < x+width; col++ {
+		s.SetContent(col, y, ' ', nil, style)
+	}
+}
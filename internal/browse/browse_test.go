@@ -0,0 +1,126 @@
+package browse
+
+import (
+	"errors"
+	"kme/internal/bookmark"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func TestMatches(t *testing.T) {
+	if !matches("", "anything") {
+		t.Error("An empty query should match everything")
+	}
+	if !matches("whale SEA", "The whale", "in the sea") {
+		t.Error("Words in different texts should match, ignoring case")
+	}
+	if matches("whale ship", "The whale", "in the sea") {
+		t.Error("Every word should match")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	high := func(id string, color int, order float64) *bookmark.Highlight {
+		h := bookmark.NewHighlight("Text of "+id, color)
+		h.Id, h.Section, h.OrderId = id, "ch1", order
+		return h
+	}
+	library := []*bookmark.Bookmarks{
+		{Book: "Dune", Highlights: []*bookmark.Highlight{high("d1", 0, 1), high("d2", 1, 2), high("d3", 2, 3)},
+			Markups: []*bookmark.Markup{{Id: "m1"}}},
+		{Book: "Emma", Highlights: []*bookmark.Highlight{high("e1", 0, 1)}},
+	}
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer screen.Fini()
+	screen.SetSize(80, 24)
+
+	var exported []*bookmark.Bookmarks
+	var exportErr error
+	b := New(screen, library, Options{Export: func(selection []*bookmark.Bookmarks) (string, error) {
+		exported = selection
+		return "Exported", exportErr
+	}})
+
+	// the keys, then q so Run returns
+	run := func(keys ...any) {
+		t.Helper()
+		for _, k := range append(keys, 'q') {
+			switch k := k.(type) {
+			case rune:
+				screen.InjectKey(tcell.KeyRune, k, tcell.ModNone)
+			case tcell.Key:
+				screen.InjectKey(k, 0, tcell.ModNone)
+			}
+		}
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the status bar as last drawn, q doesn't draw again
+	status := func() string {
+		cells, w, h := screen.GetContents()
+		line := []rune{}
+		for _, c := range cells[(h-1)*w:] {
+			line = append(line, c.Runes...)
+		}
+		return strings.TrimSpace(string(line))
+	}
+	ids := func(selection []*bookmark.Bookmarks) []string {
+		found := []string{}
+		for _, bm := range selection {
+			if len(bm.Markups) > 0 {
+				t.Errorf("Markups of %s in the export", bm.Book)
+			}
+			for _, h := range bm.Highlights {
+				found = append(found, bm.Book+"/"+h.Id)
+			}
+		}
+		return found
+	}
+
+	// only red: Emma has none, Dune its red one
+	run('2', 'e')
+	if got := ids(exported); !slices.Equal(got, []string{"Dune/d2"}) || len(b.books) != 1 || status() != "Exported" {
+		t.Errorf("Red export = %v (books %d, status %q)", got, len(b.books), status())
+	}
+
+	// all colors again, then blue only, in Dune
+	run('0', tcell.KeyEnter, '3')
+	if b.view != highlightsView || b.book.Book != "Dune" || len(b.items) != 1 || b.items[0].Id != "d3" {
+		t.Errorf("Want Dune open with only d3 in blue, got view %d with %d items", b.view, len(b.items))
+	}
+
+	// select the second one of all of them
+	run('0', tcell.KeyDown, ' ', 'e')
+	if got := ids(exported); !slices.Equal(got, []string{"Dune/d2"}) || b.cursor != 2 {
+		t.Errorf("Selection export = %v, cursor %d", got, b.cursor)
+	}
+
+	// back in the books, the selection still wins over the visible highlights
+	run(tcell.KeyEscape, 'e')
+	if b.view != booksView || b.cursor != 0 || len(b.books) != 2 {
+		t.Errorf("Want back in the books list, got view %d, cursor %d", b.view, b.cursor)
+	}
+	if got := ids(exported); !slices.Equal(got, []string{"Dune/d2"}) {
+		t.Errorf("Books export with a selection = %v", got)
+	}
+
+	// unselected, everything goes
+	run(tcell.KeyEnter, tcell.KeyDown, ' ', tcell.KeyEscape, 'e')
+	if got := ids(exported); !slices.Equal(got, []string{"Dune/d1", "Dune/d2", "Dune/d3", "Emma/e1"}) {
+		t.Errorf("Books export = %v", got)
+	}
+
+	exportErr = errors.Join(errors.New("Dune failed"), errors.New("Emma failed"))
+	run('e')
+	if status() != "Dune failed; Emma failed" {
+		t.Errorf("Status = %q, want the errors in one line", status())
+	}
+}
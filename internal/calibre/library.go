@@ -0,0 +1,127 @@
+package calibre
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+const METADATA_DB = "metadata.db"
+
+const (
+	MATCH_ISBN   = "isbn"
+	MATCH_AUTHOR = "title+author"
+	MATCH_TITLE  = "title"
+)
+
+var nonAlnumRgx = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+type Book struct {
+	Id      int
+	Title   string
+	Authors []string
+	ISBN    string
+}
+
+// A Calibre library, read from its metadata.db. It's opened read only since Calibre owns it
+type Library struct {
+	Books []*Book
+}
+
+func OpenLibrary(libDir string) (*Library, error) {
+	dbPath := filepath.Join(libDir, METADATA_DB)
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro", dbPath))
+	if err != nil {
+		return nil, fmt.Errorf("Could not open Calibre library %s: %w", dbPath, err)
+	}
+	defer db.Close()
+
+	query := `
+	SELECT books.id, books.title,
+		COALESCE((SELECT GROUP_CONCAT(authors.name, '|')
+			FROM books_authors_link
+			INNER JOIN authors ON authors.id = books_authors_link.author
+			WHERE books_authors_link.book = books.id), ''),
+		COALESCE((SELECT val FROM identifiers
+			WHERE identifiers.book = books.id AND identifiers.type = 'isbn' LIMIT 1), '')
+	FROM books
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read books from Calibre library %s: %w", dbPath, err)
+	}
+	defer rows.Close()
+
+	lib := &Library{}
+	for rows.Next() {
+		b := &Book{}
+		var authors string
+		if err := rows.Scan(&b.Id, &b.Title, &authors, &b.ISBN); err != nil {
+			return nil, fmt.Errorf("Could not read book from Calibre library: %w", err)
+		}
+		if authors != "" {
+			b.Authors = strings.Split(authors, "|")
+		}
+		lib.Books = append(lib.Books, b)
+	}
+
+	return lib, rows.Err()
+}
+
+// Finds the Calibre book for a Kobo book. ISBN wins, then title and author, and title alone only
+// if there is a single book with that title. Returns how the match was made, or nil if none
+func (self *Library) Match(title string, author string, isbn string) (*Book, string) {
+	if isbn := normalizeISBN(isbn); isbn != "" {
+		for _, b := range self.Books {
+			if normalizeISBN(b.ISBN) == isbn {
+				return b, MATCH_ISBN
+			}
+		}
+	}
+
+	title = normalize(title)
+	candidates := []*Book{}
+	for _, b := range self.Books {
+		if normalize(b.Title) != title {
+			continue
+		}
+		candidates = append(candidates, b)
+		for _, a := range b.Authors {
+			if sameAuthor(a, author) {
+				return b, MATCH_AUTHOR
+			}
+		}
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0], MATCH_TITLE
+	}
+	return nil, ""
+}
+
+func normalize(s string) string {
+	s = strings.ToLower(s)
+	return strings.TrimSpace(nonAlnumRgx.ReplaceAllString(s, " "))
+}
+
+// Kobo and Calibre don't always agree on "First Last" vs "Last, First", so the words are compared
+// regardless of their order
+func sameAuthor(a string, b string) bool {
+	wa := strings.Fields(normalize(a))
+	wb := strings.Fields(normalize(b))
+	if len(wa) == 0 || len(wb) == 0 {
+		return false
+	}
+	slices.Sort(wa)
+	slices.Sort(wb)
+	return slices.Equal(wa, wb)
+}
+
+func normalizeISBN(s string) string {
+	return strings.ToUpper(nonAlnumRgx.ReplaceAllString(s, ""))
+}
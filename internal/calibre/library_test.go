@@ -0,0 +1,101 @@
+package calibre
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// Just the tables and columns kme reads from metadata.db
+const testCalibreSchema = `
+CREATE TABLE books (id INTEGER PRIMARY KEY, title TEXT NOT NULL DEFAULT 'Unknown');
+CREATE TABLE authors (id INTEGER PRIMARY KEY, name TEXT NOT NULL);
+CREATE TABLE books_authors_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, author INTEGER NOT NULL);
+CREATE TABLE identifiers (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, type TEXT NOT NULL DEFAULT 'isbn',
+	val TEXT NOT NULL);
+`
+
+// Creates a Calibre library with two books titled Dune, by different authors, one of them with an
+// ISBN, and a book with no author
+func testLibrary(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(dir, METADATA_DB))
+	if err != nil {
+		t.Fatalf("Could not create test Calibre library: %v", err)
+	}
+	defer db.Close()
+
+	for _, q := range []string{
+		testCalibreSchema,
+		`INSERT INTO books VALUES (1, 'Dune'), (2, 'Dune'), (3, 'The Left Hand of Darkness'), (4, 'Anonymous')`,
+		`INSERT INTO authors VALUES (1, 'Herbert, Frank'), (2, 'Someone Else'), (3, 'Ursula K. Le Guin')`,
+		`INSERT INTO books_authors_link (book, author) VALUES (1, 1), (2, 2), (3, 3)`,
+		`INSERT INTO identifiers (book, type, val) VALUES (2, 'isbn', '978-0-441-17271-9'),
+			(3, 'amazon', 'B000FC1JAI')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("Could not create test Calibre library: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestOpenLibrary(t *testing.T) {
+	lib, err := OpenLibrary(testLibrary(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lib.Books) != 4 {
+		t.Fatalf("Got %d books, want 4", len(lib.Books))
+	}
+	for _, b := range lib.Books {
+		switch b.Id {
+		case 2:
+			if b.ISBN != "978-0-441-17271-9" || len(b.Authors) != 1 {
+				t.Errorf("Book 2 = %+v", b)
+			}
+		case 3:
+			if b.ISBN != "" {
+				t.Errorf("Only isbn identifiers are ISBNs, got %q", b.ISBN)
+			}
+		case 4:
+			if len(b.Authors) != 0 {
+				t.Errorf("Book 4 has no authors, got %q", b.Authors)
+			}
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	lib, err := OpenLibrary(testLibrary(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name                string
+		title, author, isbn string
+		id                  int
+		how                 string
+	}{
+		{"isbn without dashes", "Whatever", "", "9780441172719", 2, MATCH_ISBN},
+		{"isbn wins over title and author", "Dune", "Frank Herbert", "978 0441172719", 2, MATCH_ISBN},
+		{"unknown isbn falls back to title and author", "Dune", "Frank Herbert", "123", 1, MATCH_AUTHOR},
+		{"Last, First author", "DUNE", "Herbert, Frank", "", 1, MATCH_AUTHOR},
+		{"punctuation in title and author", "The Left Hand of Darkness!", "Ursula K Le Guin", "", 3, MATCH_AUTHOR},
+		{"unique title without author", "the left hand of darkness", "Nobody", "", 3, MATCH_TITLE},
+		{"title shared by two books", "Dune", "Nobody", "", 0, ""},
+		{"no such title", "Emma", "Jane Austen", "", 0, ""},
+		{"empty author doesn't match an empty one", "Anonymous", "", "", 4, MATCH_TITLE},
+	} {
+		b, how := lib.Match(tc.title, tc.author, tc.isbn)
+		id := 0
+		if b != nil {
+			id = b.Id
+		}
+		if id != tc.id || how != tc.how {
+			t.Errorf("%s: got book %d by %q, want %d by %q", tc.name, id, how, tc.id, tc.how)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+const CONFIG_FILE = "config.yaml"
+
+// The config file, e.g.
+//
+//	default: work
+//	profiles:
+//	  work:
+//	    device: /media/me/KOBOeReader
+//	    out: ~/notes/kobo
+//	    formats: [markdown, json]
+//	    template: ~/notes/kobo.tmpl
+//	    shelves: [Work]
+//	    colors:
+//	      yellow: important
+//	      blue: {name: definition, tag: def, label: Definitions, css: "#cfe3ff"}
+//
+// Profile values are only defaults, flags and KME_* environment variables win over them
+type Config struct {
+	// Profile used when --profile is not given
+	Default  string              `yaml:"default,omitempty"`
+	Profiles map[string]*Profile `yaml:"profiles"`
+}
+
+type Profile struct {
+	Device   string   `yaml:"device,omitempty"`
+	Out      string   `yaml:"out,omitempty"`
+	Quality  int      `yaml:"quality,omitempty"`
+	Formats  []string `yaml:"formats,omitempty"`
+	Template string   `yaml:"template,omitempty"`
+	Palette  string   `yaml:"palette,omitempty"`
+	Archive  string   `yaml:"archive,omitempty"`
+	Library  string   `yaml:"library,omitempty"`
+	// Only books in these shelves (collections)
+	Shelves []string `yaml:"shelves,omitempty"`
+	// Kobo color name to what it means in the exports
+	Colors map[string]Color `yaml:"colors,omitempty"`
+}
+
+// What a Kobo color means to the reader. Written as just the name, or with any of the fields
+type Color struct {
+	// Used instead of the Kobo name, in the exports and in --color
+	Name string `yaml:"name,omitempty"`
+	// Markdown, Anki and Readwise tag, e.g. key-idea. The name as a tag if empty
+	Tag string `yaml:"tag,omitempty"`
+	// Heading for the highlights of the color, e.g. Key ideas. The name if empty
+	Label string `yaml:"label,omitempty"`
+	// CSS color of the highlights in HTML, over the palette one
+	CSS string `yaml:"css,omitempty"`
+}
+
+func (self *Color) UnmarshalYAML(unmarshal func(any) error) error {
+	if err := unmarshal(&self.Name); err == nil {
+		return nil
+	}
+	type plain Color
+	return unmarshal((*plain)(self))
+}
+
+// Back to just the name when that's all there is, as it was likely written
+func (self Color) MarshalYAML() (any, error) {
+	if self.Tag == "" && self.Label == "" && self.CSS == "" {
+		return self.Name, nil
+	}
+	type plain Color
+	return plain(self), nil
+}
+
+// $XDG_CONFIG_HOME/kme/config.yaml, or ~/.config/kme/config.yaml if not set (on Linux)
+func DefaultPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return CONFIG_FILE
+	}
+	return filepath.Join(configDir, "kme", CONFIG_FILE)
+}
+
+// A missing file is an empty config, kme works the same without one
+func Load(path string) (*Config, error) {
+	config := &Config{Profiles: map[string]*Profile{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read config %s: %w", path, err)
+	}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("Could not parse config %s: %w", path, err)
+	}
+	if config.Profiles == nil {
+		config.Profiles = map[string]*Profile{}
+	}
+	return config, nil
+}
+
+// The profile by name, or the default one if name is empty. nil when there is no default
+func (self *Config) Profile(name string) (*Profile, error) {
+	if name == "" {
+		name = self.Default
+	}
+	if name == "" {
+		return nil, nil
+	}
+	p, ok := self.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown profile %s, the config has %v", name, self.ProfileNames())
+	}
+	if p == nil {
+		p = &Profile{}
+	}
+	return p, nil
+}
+
+func (self *Config) ProfileNames() []string {
+	return slices.Sorted(maps.Keys(self.Profiles))
+}
+
+// Values of the profile by the flag they stand for. Colors have no flag and are not included
+func (self *Profile) Flags() map[string][]string {
+	flags := map[string][]string{}
+	set := func(name string, values ...string) {
+		if len(values) > 0 && values[0] != "" {
+			flags[name] = values
+		}
+	}
+	set("device", expandHome(self.Device))
+	set("out", expandHome(self.Out))
+	if self.Quality != 0 {
+		set("quality", strconv.Itoa(self.Quality))
+	}
+	set("format", self.Formats...)
+	set("template", expandHome(self.Template))
+	set("palette", expandHome(self.Palette))
+	set("archive", expandHome(self.Archive))
+	set("library", expandHome(self.Library))
+	set("shelf", self.Shelves...)
+	return flags
+}
+
+// Paths in a shared config are easier to write with ~
+func expandHome(path string) string {
+	if len(path) < 2 || path[:2] != "~/" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CONFIG_FILE)
+	os.WriteFile(path, []byte(`
+default: work
+profiles:
+  work:
+    out: /notes
+    quality: 80
+    formats: [markdown, json]
+  empty:
+`), 0644)
+
+	conf, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	p, err := conf.Profile("")
+	if err != nil || p == nil {
+		t.Fatalf("Want the default profile, got %v (%v)", p, err)
+	}
+	flags := p.Flags()
+	if flags["out"][0] != "/notes" || flags["quality"][0] != "80" || !slices.Equal(flags["format"], []string{"markdown", "json"}) {
+		t.Errorf("Unexpected flags %v", flags)
+	}
+	if _, ok := flags["device"]; ok {
+		t.Errorf("Unset values must not become flags: %v", flags)
+	}
+
+	if p, err := conf.Profile("empty"); err != nil || len(p.Flags()) != 0 {
+		t.Errorf("Want an empty profile, got %v (%v)", p, err)
+	}
+	if _, err := conf.Profile("missing"); err == nil {
+		t.Errorf("Want an error for an unknown profile")
+	}
+
+	os.WriteFile(path, []byte("profiles:\n  work:\n    outt: /notes\n"), 0644)
+	if _, err := Load(path); err == nil {
+		t.Errorf("Want an error for an unknown key")
+	}
+}
+
+func TestColors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CONFIG_FILE)
+	os.WriteFile(path, []byte(`
+profiles:
+  notes:
+    colors:
+      yellow: important
+      blue: {name: definition, tag: def, label: Definitions, css: "#cfe3ff"}
+`), 0644)
+
+	conf, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	colors := conf.Profiles["notes"].Colors
+	if colors["yellow"] != (Color{Name: "important"}) {
+		t.Errorf("A color given as a name = %+v", colors["yellow"])
+	}
+	if colors["blue"] != (Color{Name: "definition", Tag: "def", Label: "Definitions", CSS: "#cfe3ff"}) {
+		t.Errorf("A color given with its fields = %+v", colors["blue"])
+	}
+}
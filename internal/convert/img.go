@@ -53,23 +53,35 @@ func svgToRGBA(svgPath string) (image.Image, error) {
 }
 
 func OverlayMarkup(m *bookmark.Markup, markPath string, outPath string, quality int) error {
+	container, err := RenderMarkup(m, markPath)
+	if err != nil {
+		return err
+	}
+
+	imgPath := filepath.Join(outPath, m.Outfile())
+
+	return encode(imgPath, container, quality)
+}
+
+// Renders the markup strokes over its page in memory, OverlayMarkup writes this same image to disk
+func RenderMarkup(m *bookmark.Markup, markPath string) (*image.RGBA, error) {
 	if !m.HasImagePair(markPath) {
-		return fmt.Errorf("\tThis bookmark does not have both needed Markup files: %s", m.Id)
+		return nil, fmt.Errorf("\tThis bookmark does not have both needed Markup files: %s", m.Id)
 	}
 	markImg, err := svgToRGBA(m.SvgFile(markPath))
 	if err != nil {
-		return fmt.Errorf("Failed to render SVG: %v", err)
+		return nil, fmt.Errorf("Failed to render SVG: %v", err)
 	}
 
 	base, err := os.Open(m.JpgFile(markPath))
 	if err != nil {
-		return fmt.Errorf("Failed to open background image %s: %w", m.JpgFile(markPath), err)
+		return nil, fmt.Errorf("Failed to open background image %s: %w", m.JpgFile(markPath), err)
 	}
 	defer base.Close()
 
 	baseImg, err := jpeg.Decode(base)
 	if err != nil {
-		return fmt.Errorf("Failed to decode base image %s: %w", m.JpgFile(markPath), err)
+		return nil, fmt.Errorf("Failed to decode base image %s: %w", m.JpgFile(markPath), err)
 	}
 
 	// new RGBA img for the background, with the intended size: The canvas
@@ -101,9 +113,16 @@ func OverlayMarkup(m *bookmark.Markup, markPath string, outPath string, quality
 	// overlay the markup img with the background img
 	draw.Draw(container, markImg.Bounds(), markImg, image.Point{}, draw.Over)
 
-	imgPath := filepath.Join(outPath, m.Outfile())
+	return container, nil
+}
 
-	return encode(imgPath, container, quality)
+// Scales the image down to the given width, keeping its aspect ratio
+func Thumbnail(img image.Image, width int) *image.RGBA {
+	b := img.Bounds()
+	height := b.Dy() * width / b.Dx()
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), img, b, draw.Src, nil)
+	return thumb
 }
 
 func encode(outPath string, img *image.RGBA, quality int) error {
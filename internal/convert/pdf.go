@@ -1,8 +1,11 @@
 package convert
 
 import (
+	"bytes"
 	"cmp"
 	"fmt"
+	"image/jpeg"
+	"io"
 	"kme/internal/bookmark"
 	"os"
 	"path/filepath"
@@ -13,7 +16,9 @@ import (
 	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
 )
 
-func BuildPDF(bms *bookmark.Bookmarks, bookDir string, keep bool) error {
+// Puts the markup images in bookDir together in a PDF and returns its path. The images are
+// deleted afterwards unless keep
+func BuildPDF(bms *bookmark.Bookmarks, bookDir string, keep bool) (string, error) {
 
 	// sorting ASC by loc, part, section
 	slices.SortFunc(bms.Markups, func(a, b *bookmark.Markup) int {
@@ -26,14 +31,7 @@ func BuildPDF(bms *bookmark.Bookmarks, bookDir string, keep bool) error {
 		files = append(files, fname)
 	}
 
-	ctime := time.Now().Local()
-	pdfFile := fmt.Sprintf(
-		"%s - %s (markups).pdf",
-		ctime.Format("20060102_1504"),
-		bms.Book,
-	)
-
-	pdfOut := filepath.Join(bookDir, pdfFile)
+	pdfOut := filepath.Join(bookDir, PDFName(bms))
 	cfg := model.NewDefaultConfiguration()
 	cfg.Optimize = true
 	cfg.OptimizeBeforeWriting = true
@@ -47,7 +45,7 @@ func BuildPDF(bms *bookmark.Bookmarks, bookDir string, keep bool) error {
 		nil,
 		cfg,
 	); err != nil {
-		return err
+		return "", err
 	}
 
 	fmt.Println("PDF saved: ", pdfOut)
@@ -58,5 +56,44 @@ func BuildPDF(bms *bookmark.Bookmarks, bookDir string, keep bool) error {
 			os.Remove(f)
 		}
 	}
+	return pdfOut, nil
+}
+
+// Name of the markups PDF of a book, dated so a new extraction doesn't overwrite the last one
+func PDFName(bms *bookmark.Bookmarks) string {
+	return fmt.Sprintf(
+		"%s - %s (markups).pdf",
+		time.Now().Local().Format("20060102_1504"),
+		bms.Book,
+	)
+}
+
+// Same PDF as BuildPDF, but the markups are rendered in memory and the PDF goes to w. Markups that
+// can't be rendered are left out, it's an error if none can
+func WritePDF(w io.Writer, bms *bookmark.Bookmarks, markPath string, quality int) error {
+	marks := slices.Clone(bms.Markups)
+	slices.SortFunc(marks, func(a, b *bookmark.Markup) int {
+		return cmp.Compare(a.OrderId, b.OrderId)
+	})
+
+	imgs := []io.Reader{}
+	for _, m := range marks {
+		img, err := RenderMarkup(m, markPath)
+		if err != nil {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return fmt.Errorf("jpeg encode failed: %w", err)
+		}
+		imgs = append(imgs, buf)
+	}
+	if len(imgs) == 0 {
+		return fmt.Errorf("No markups to put in the PDF of %s", bms.Book)
+	}
+
+	if err := pdf.ImportImages(nil, w, imgs, nil, model.NewDefaultConfiguration()); err != nil {
+		return fmt.Errorf("Could not build the PDF of %s: %w", bms.Book, err)
+	}
 	return nil
 }
@@ -0,0 +1,400 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"io"
+	"kme/internal/bookmark"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/colornames"
+	"golang.org/x/image/math/fixed"
+)
+
+// A stroke of the markup, as the Kobo wrote it
+type inkPath struct {
+	path rasterx.Path
+	// From the path coordinates to the markup viewBox ones, with the transforms of its groups
+	transform rasterx.Matrix2D
+	style     inkStyle
+}
+
+// The SVG presentation attributes the strokes may use, inherited from their groups
+type inkStyle struct {
+	// nil for none
+	stroke, fill  color.Color
+	width         float64
+	strokeOpacity float64
+	fillOpacity   float64
+	// SVG values: butt, round or square; miter, round or bevel
+	cap, join string
+	evenOdd   bool
+}
+
+var defaultInkStyle = inkStyle{
+	fill:          color.Black,
+	width:         1,
+	strokeOpacity: 1,
+	fillOpacity:   1,
+	cap:           "butt",
+	join:          "miter",
+}
+
+// The markup strokes, and the viewBox they are drawn in
+type ink struct {
+	viewBox struct{ X, Y, W, H float64 }
+	paths   []inkPath
+}
+
+// Reads the strokes of the markup SVG without rasterizing them. Paths, polylines, polygons and
+// lines are kept, inside any groups; the Kobo doesn't write anything else
+func readInk(svgPath string) (*ink, error) {
+	data, err := os.ReadFile(svgPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SVG file %s: %w", svgPath, err)
+	}
+
+	result := &ink{}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	// style and transform of the open elements, the last one applies
+	styles := []inkStyle{defaultInkStyle}
+	transforms := []rasterx.Matrix2D{rasterx.Identity}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SVG %s: %w", svgPath, err)
+		}
+
+		switch el := tok.(type) {
+		case xml.StartElement:
+			attrs := map[string]string{}
+			for _, a := range el.Attr {
+				attrs[a.Name.Local] = a.Value
+			}
+			if el.Name.Local == "svg" && len(styles) == 1 {
+				result.viewBox = rootViewBox(attrs)
+			}
+			style := parseInkStyle(styles[len(styles)-1], attrs)
+			transform := transforms[len(transforms)-1].Mult(parseTransform(attrs["transform"]))
+			styles = append(styles, style)
+			transforms = append(transforms, transform)
+
+			path := elementPath(el.Name.Local, attrs)
+			if len(path) > 0 {
+				result.paths = append(result.paths, inkPath{path: path, transform: transform, style: style})
+			}
+		case xml.EndElement:
+			styles = styles[:len(styles)-1]
+			transforms = transforms[:len(transforms)-1]
+		}
+	}
+	return result, nil
+}
+
+// The viewBox of the root svg, or its size. The Kobo size when it says nothing
+func rootViewBox(attrs map[string]string) struct{ X, Y, W, H float64 } {
+	vb := struct{ X, Y, W, H float64 }{0, 0, WIDTH, HEIGHT}
+	if nums := parseNumbers(attrs["viewBox"]); len(nums) == 4 && nums[2] > 0 && nums[3] > 0 {
+		vb.X, vb.Y, vb.W, vb.H = nums[0], nums[1], nums[2], nums[3]
+		return vb
+	}
+	w, errW := strconv.ParseFloat(strings.TrimSuffix(attrs["width"], "px"), 64)
+	h, errH := strconv.ParseFloat(strings.TrimSuffix(attrs["height"], "px"), 64)
+	if errW == nil && errH == nil && w > 0 && h > 0 {
+		vb.W, vb.H = w, h
+	}
+	return vb
+}
+
+func elementPath(name string, attrs map[string]string) rasterx.Path {
+	switch name {
+	case "path":
+		cursor := &oksvg.PathCursor{}
+		if err := cursor.CompilePath(attrs["d"]); err != nil {
+			return nil
+		}
+		return cursor.Path
+	case "polyline", "polygon":
+		return pointsPath(parseNumbers(attrs["points"]), name == "polygon")
+	case "line":
+		nums := []float64{}
+		for _, a := range []string{"x1", "y1", "x2", "y2"} {
+			n, _ := strconv.ParseFloat(attrs[a], 64)
+			nums = append(nums, n)
+		}
+		return pointsPath(nums, false)
+	}
+	return nil
+}
+
+func pointsPath(nums []float64, closed bool) rasterx.Path {
+	if len(nums) < 4 {
+		return nil
+	}
+	path := rasterx.Path{}
+	path.Start(toFixed(nums[0], nums[1]))
+	for i := 2; i+1 < len(nums); i += 2 {
+		path.Line(toFixed(nums[i], nums[i+1]))
+	}
+	path.Stop(closed)
+	return path
+}
+
+// Presentation attributes, and the same properties in style="" that win over them
+func parseInkStyle(parent inkStyle, attrs map[string]string) inkStyle {
+	props := map[string]string{}
+	for _, name := range []string{"stroke", "fill", "stroke-width", "stroke-opacity", "fill-opacity", "opacity",
+		"stroke-linecap", "stroke-linejoin", "fill-rule"} {
+		if v, ok := attrs[name]; ok {
+			props[name] = v
+		}
+	}
+	for _, decl := range strings.Split(attrs["style"], ";") {
+		if name, value, ok := strings.Cut(decl, ":"); ok {
+			props[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+
+	style := parent
+	for name, value := range props {
+		value = strings.TrimSpace(value)
+		switch name {
+		case "stroke":
+			style.stroke = parseColor(value)
+		case "fill":
+			style.fill = parseColor(value)
+		case "stroke-width":
+			if w, err := strconv.ParseFloat(strings.TrimSuffix(value, "px"), 64); err == nil {
+				style.width = w
+			}
+		case "stroke-linecap":
+			style.cap = value
+		case "stroke-linejoin":
+			style.join = value
+		case "fill-rule":
+			style.evenOdd = value == "evenodd"
+		}
+	}
+	// opacity isn't inherited as is, but it does fade everything inside
+	opacity := parseOpacity(props["opacity"])
+	style.strokeOpacity *= opacity * parseOpacity(props["stroke-opacity"])
+	style.fillOpacity *= opacity * parseOpacity(props["fill-opacity"])
+	return style
+}
+
+func parseOpacity(value string) float64 {
+	o, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 1
+	}
+	return min(max(o, 0), 1)
+}
+
+// #rgb, #rrggbb, rgb(r, g, b) or a CSS name. nil for none and anything unknown
+func parseColor(value string) color.Color {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch {
+	case strings.HasPrefix(value, "#"):
+		hex := value[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		n, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			return nil
+		}
+		return color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 0xff}
+	case strings.HasPrefix(value, "rgb(") && strings.HasSuffix(value, ")"):
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, "rgb("), ")"), ",")
+		if len(parts) != 3 {
+			return nil
+		}
+		rgb := [3]uint8{}
+		for i, p := range parts {
+			p = strings.TrimSpace(p)
+			v, err := strconv.ParseFloat(strings.TrimSuffix(p, "%"), 64)
+			if err != nil {
+				return nil
+			}
+			if strings.HasSuffix(p, "%") {
+				v = v * 255 / 100
+			}
+			rgb[i] = uint8(min(max(v, 0), 255))
+		}
+		return color.RGBA{rgb[0], rgb[1], rgb[2], 0xff}
+	}
+	if c, ok := colornames.Map[value]; ok {
+		return c
+	}
+	return nil
+}
+
+// matrix, translate, scale, rotate, skewX and skewY, in the order given
+func parseTransform(value string) rasterx.Matrix2D {
+	m := rasterx.Identity
+	for _, part := range strings.Split(value, ")") {
+		name, args, ok := strings.Cut(part, "(")
+		if !ok {
+			continue
+		}
+		n := parseNumbers(args)
+		switch strings.Trim(strings.TrimSpace(name), ",") {
+		case "matrix":
+			if len(n) == 6 {
+				m = m.Mult(rasterx.Matrix2D{A: n[0], B: n[1], C: n[2], D: n[3], E: n[4], F: n[5]})
+			}
+		case "translate":
+			if len(n) == 1 {
+				n = append(n, 0)
+			}
+			if len(n) == 2 {
+				m = m.Translate(n[0], n[1])
+			}
+		case "scale":
+			if len(n) == 1 {
+				n = append(n, n[0])
+			}
+			if len(n) == 2 {
+				m = m.Scale(n[0], n[1])
+			}
+		case "rotate":
+			if len(n) == 1 {
+				m = m.Rotate(n[0] * math.Pi / 180)
+			} else if len(n) == 3 {
+				m = m.Translate(n[1], n[2]).Rotate(n[0]*math.Pi/180).Translate(-n[1], -n[2])
+			}
+		case "skewX":
+			if len(n) == 1 {
+				m = m.SkewX(n[0] * math.Pi / 180)
+			}
+		case "skewY":
+			if len(n) == 1 {
+				m = m.SkewY(n[0] * math.Pi / 180)
+			}
+		}
+	}
+	return m
+}
+
+func toFixed(x, y float64) fixed.Point26_6 {
+	return fixed.Point26_6{X: fixed.Int26_6(x * 64), Y: fixed.Int26_6(y * 64)}
+}
+
+func parseNumbers(s string) []float64 {
+	nums := []float64{}
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' }) {
+		if n, err := strconv.ParseFloat(f, 64); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	return nums
+}
+
+// Writes the markup as a standalone SVG: the page JPG embedded as the background and the original
+// strokes on top, so the ink stays sharp at any zoom
+func WriteMarkupSVG(w io.Writer, m *bookmark.Markup, markPath string) error {
+	if !m.HasImagePair(markPath) {
+		return fmt.Errorf("\tThis bookmark does not have both needed Markup files: %s", m.Id)
+	}
+	page, err := os.ReadFile(m.JpgFile(markPath))
+	if err != nil {
+		return fmt.Errorf("Failed to open background image %s: %w", m.JpgFile(markPath), err)
+	}
+	pageConf, _, err := image.DecodeConfig(bytes.NewReader(page))
+	if err != nil {
+		return fmt.Errorf("Failed to decode base image %s: %w", m.JpgFile(markPath), err)
+	}
+	strokes, err := os.ReadFile(m.SvgFile(markPath))
+	if err != nil {
+		return fmt.Errorf("failed to open SVG file %s: %w", m.SvgFile(markPath), err)
+	}
+	inner, attrs, err := innerSVG(strokes)
+	if err != nil {
+		return fmt.Errorf("failed to read SVG %s: %w", m.SvgFile(markPath), err)
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" `+
+		`width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", WIDTH, HEIGHT, WIDTH, HEIGHT)
+	// the same layout as RenderMarkup: the page at its size in the top left corner, then the label
+	fmt.Fprintf(b, `<image x="0" y="0" width="%d" height="%d" xlink:href="data:image/jpeg;base64,%s"/>`+"\n",
+		pageConf.Width, pageConf.Height, base64.StdEncoding.EncodeToString(page))
+	fmt.Fprintf(b, `<text x="10" y="25" font-family="monospace" font-size="13">%s</text>`+"\n",
+		html.EscapeString(fmt.Sprintf("%s/%s", m.Section, m.Location)))
+	fmt.Fprintf(b, `<svg x="0" y="0" width="%d" height="%d" preserveAspectRatio="none"%s>`, WIDTH, HEIGHT, attrs)
+	b.Write(inner)
+	b.WriteString("</svg>\n</svg>\n")
+
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("Could not write the SVG of markup %s: %w", m.Id, err)
+	}
+	return nil
+}
+
+// What is inside the root svg element, and its attributes (viewBox and namespaces mostly) to
+// nest it in another one. The size is left out, the markup is stretched over the page like
+// RenderMarkup does
+func innerSVG(data []byte) ([]byte, string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, "", err
+		}
+		root, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		start := int(dec.InputOffset())
+
+		attrs := strings.Builder{}
+		hasViewBox := false
+		for _, a := range root.Attr {
+			name := a.Name.Local
+			switch {
+			case a.Name.Space == "xmlns":
+				name = "xmlns:" + name
+			case a.Name.Space != "" || name == "xmlns":
+				continue
+			case name == "width" || name == "height" || name == "x" || name == "y" || name == "preserveAspectRatio":
+				continue
+			}
+			hasViewBox = hasViewBox || name == "viewBox"
+			fmt.Fprintf(&attrs, ` %s="%s"`, name, html.EscapeString(a.Value))
+		}
+		if !hasViewBox {
+			vb := rootViewBox(map[string]string{"width": attrValue(root, "width"), "height": attrValue(root, "height")})
+			fmt.Fprintf(&attrs, ` viewBox="%g %g %g %g"`, vb.X, vb.Y, vb.W, vb.H)
+		}
+
+		end := bytes.LastIndex(data, []byte("</"))
+		if end < start {
+			// <svg/>, nothing inside
+			return []byte{}, attrs.String(), nil
+		}
+		return data[start:end], attrs.String(), nil
+	}
+}
+
+func attrValue(el xml.StartElement, name string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package convert
+
+import (
+	"image/color"
+	"kme/internal/bookmark"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadInk(t *testing.T) {
+	svg := filepath.Join(t.TempDir(), "mark.svg")
+	os.WriteFile(svg, []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="632" height="840" viewBox="0 0 632 840">
+  <g stroke="red" stroke-width="2" fill="none" transform="translate(10 20)">
+    <path d="M0 0 Q10 10 20 0"/>
+    <polyline points="0,0 5,5 10,0" style="stroke:#0000ff;stroke-opacity:0.5"/>
+  </g>
+  <rect width="10" height="10"/>
+</svg>`), 0644)
+
+	strokes, err := readInk(svg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strokes.viewBox.W != 632 || strokes.viewBox.H != 840 {
+		t.Errorf("viewBox = %+v", strokes.viewBox)
+	}
+	if len(strokes.paths) != 2 {
+		t.Fatalf("got %d paths, want the path and the polyline", len(strokes.paths))
+	}
+	path, line := strokes.paths[0], strokes.paths[1]
+	if path.style.stroke != (color.RGBA{255, 0, 0, 255}) || path.style.fill != nil || path.style.width != 2 {
+		t.Errorf("path style = %+v, want the one of its group", path.style)
+	}
+	if path.transform.E != 10 || path.transform.F != 20 {
+		t.Errorf("path transform = %+v", path.transform)
+	}
+	if line.style.stroke != (color.RGBA{0, 0, 255, 255}) || line.style.strokeOpacity != 0.5 {
+		t.Errorf("polyline style = %+v", line.style)
+	}
+
+	content, alphas := markupContent(&bookmark.Markup{Section: "chapter01", Location: "(1.2)"}, 1264, 1680, strokes)
+	for _, want := range []string{
+		`(chapter01/\(1.2\)) Tj`,
+		"2 0 0 2 0 0 cm",
+		"0 0 m\n6.6667 6.6667 13.3333 6.6667 20 0 c\nS Q",
+		"/GS0 gs",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("content has no %q:\n%s", want, content)
+		}
+	}
+	if len(alphas) != 1 || alphas[0] != [2]float64{0.5, 1} {
+		t.Errorf("alphas = %v", alphas)
+	}
+}
@@ -0,0 +1,295 @@
+package convert
+
+import (
+	"bytes"
+	"cmp"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"kme/internal/bookmark"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/srwiley/rasterx"
+)
+
+// The PDF was written, but without some of the markups
+var ErrSkippedMarkups = errors.New("Some markups could not be put in the PDF")
+
+// Writes a PDF with a page per markup like BuildPDF, but the page JPG goes in as is and the strokes
+// are drawn as PDF paths over it, so the ink stays sharp at any zoom and nothing is re-encoded.
+// Markups that can't be read are left out and returned as ErrSkippedMarkups, it's an error if none can
+func WriteVectorPDF(w io.Writer, bms *bookmark.Bookmarks, markPath string) error {
+	marks := slices.Clone(bms.Markups)
+	slices.SortFunc(marks, func(a, b *bookmark.Markup) int {
+		return cmp.Compare(a.OrderId, b.OrderId)
+	})
+
+	doc := newPDFWriter()
+	skipped := []error{}
+	for _, m := range marks {
+		if err := doc.addMarkup(m, markPath); err != nil {
+			skipped = append(skipped, err)
+		}
+	}
+	if len(doc.pages) == 0 {
+		return fmt.Errorf("No markups to put in the PDF of %s: %w", bms.Book, errors.Join(skipped...))
+	}
+	if _, err := w.Write(doc.finish()); err != nil {
+		return fmt.Errorf("Could not write the PDF of %s: %w", bms.Book, err)
+	}
+	if len(skipped) > 0 {
+		return fmt.Errorf("%w: %w", ErrSkippedMarkups, errors.Join(skipped...))
+	}
+	return nil
+}
+
+// Just enough PDF for pages with a JPEG, a line of text and paths. Objects 1 to 3 are the catalog,
+// the page tree and the font, pages come after
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets []int
+	pages   []int
+}
+
+func newPDFWriter() *pdfWriter {
+	doc := &pdfWriter{}
+	doc.buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	// catalog and pages are written at the end, once the pages are known
+	doc.offsets = []int{0, 0}
+	doc.object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	return doc
+}
+
+// Writes the next object and returns its number
+func (self *pdfWriter) object(dict string) int {
+	return self.stream(dict, nil)
+}
+
+// Writes the next object with a stream when data isn't nil, the dict gets its /Length
+func (self *pdfWriter) stream(dict string, data []byte) int {
+	self.offsets = append(self.offsets, self.buf.Len())
+	n := len(self.offsets)
+	fmt.Fprintf(&self.buf, "%d 0 obj\n", n)
+	if data == nil {
+		fmt.Fprintf(&self.buf, "%s\nendobj\n", dict)
+		return n
+	}
+	fmt.Fprintf(&self.buf, "%s /Length %d >>\nstream\n", strings.TrimSuffix(dict, " >>"), len(data))
+	self.buf.Write(data)
+	self.buf.WriteString("\nendstream\nendobj\n")
+	return n
+}
+
+// Writes an object in one of the slots reserved at the start
+func (self *pdfWriter) reserved(n int, dict string) {
+	self.offsets[n-1] = self.buf.Len()
+	fmt.Fprintf(&self.buf, "%d 0 obj\n%s\nendobj\n", n, dict)
+}
+
+func (self *pdfWriter) addMarkup(m *bookmark.Markup, markPath string) error {
+	if !m.HasImagePair(markPath) {
+		return fmt.Errorf("\tThis bookmark does not have both needed Markup files: %s", m.Id)
+	}
+	page, err := os.ReadFile(m.JpgFile(markPath))
+	if err != nil {
+		return fmt.Errorf("Failed to open background image %s: %w", m.JpgFile(markPath), err)
+	}
+	conf, _, err := image.DecodeConfig(bytes.NewReader(page))
+	if err != nil {
+		return fmt.Errorf("Failed to decode base image %s: %w", m.JpgFile(markPath), err)
+	}
+	strokes, err := readInk(m.SvgFile(markPath))
+	if err != nil {
+		return err
+	}
+
+	colorSpace := "/DeviceRGB"
+	switch conf.ColorModel {
+	case color.GrayModel:
+		colorSpace = "/DeviceGray"
+	case color.CMYKModel:
+		colorSpace = "/DeviceCMYK /Decode [1 0 1 0 1 0 1 0]"
+	}
+	img := self.stream(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s "+
+		"/BitsPerComponent 8 /Filter /DCTDecode >>", conf.Width, conf.Height, colorSpace), page)
+
+	content, alphas := markupContent(m, conf.Width, conf.Height, strokes)
+	gstates := strings.Builder{}
+	for i, a := range alphas {
+		fmt.Fprintf(&gstates, " /GS%d << /CA %s /ca %s >>", i, pdfNum(a[0]), pdfNum(a[1]))
+	}
+	contents := self.stream("<< /Filter /FlateDecode >>", deflate(content))
+
+	self.pages = append(self.pages, self.object(fmt.Sprintf(
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Contents %d 0 R "+
+			"/Resources << /XObject << /Im0 %d 0 R >> /Font << /F1 3 0 R >> /ExtGState <<%s >> >> >>",
+		WIDTH, HEIGHT, contents, img, gstates.String())))
+	return nil
+}
+
+// The content stream of a page, with the same layout as RenderMarkup. Also the stroke and fill
+// opacities it uses, each one is a /GS<i> graphics state
+func markupContent(m *bookmark.Markup, pageW, pageH int, strokes *ink) ([]byte, [][2]float64) {
+	b := &bytes.Buffer{}
+	// the page at its size in the top left corner
+	fmt.Fprintf(b, "q %d 0 0 %d 0 %d cm /Im0 Do Q\n", pageW, pageH, HEIGHT-pageH)
+	fmt.Fprintf(b, "BT /F1 13 Tf 0 g 10 %d Td (%s) Tj ET\n", HEIGHT-25, pdfText(fmt.Sprintf("%s/%s", m.Section, m.Location)))
+
+	// from here on, SVG coordinates: y down, and the viewBox stretched over the page
+	vb := strokes.viewBox
+	fmt.Fprintf(b, "q 1 0 0 -1 0 %d cm\n", HEIGHT)
+	sx, sy := float64(WIDTH)/vb.W, float64(HEIGHT)/vb.H
+	fmt.Fprintf(b, "%s 0 0 %s %s %s cm\n", pdfNum(sx), pdfNum(sy), pdfNum(-vb.X*sx), pdfNum(-vb.Y*sy))
+
+	alphas := [][2]float64{}
+	for _, p := range strokes.paths {
+		st := p.style
+		stroke, fill := st.stroke != nil && st.width > 0, st.fill != nil
+		if !stroke && !fill {
+			continue
+		}
+		t := p.transform
+		fmt.Fprintf(b, "q %s %s %s %s %s %s cm\n", pdfNum(t.A), pdfNum(t.B), pdfNum(t.C), pdfNum(t.D), pdfNum(t.E), pdfNum(t.F))
+
+		if alpha := [2]float64{st.strokeOpacity, st.fillOpacity}; alpha != [2]float64{1, 1} {
+			i := slices.Index(alphas, alpha)
+			if i < 0 {
+				i = len(alphas)
+				alphas = append(alphas, alpha)
+			}
+			fmt.Fprintf(b, "/GS%d gs\n", i)
+		}
+		if stroke {
+			fmt.Fprintf(b, "%s RG %s w %d J %d j\n", pdfColor(st.stroke), pdfNum(st.width), pdfCap(st.cap), pdfJoin(st.join))
+		}
+		if fill {
+			fmt.Fprintf(b, "%s rg\n", pdfColor(st.fill))
+		}
+		writePath(b, p.path)
+
+		op := "S"
+		if fill {
+			op = "f"
+			if stroke {
+				op = "B"
+			}
+			if st.evenOdd {
+				op += "*"
+			}
+		}
+		fmt.Fprintf(b, "%s Q\n", op)
+	}
+	b.WriteString("Q\n")
+	return b.Bytes(), alphas
+}
+
+// The path as PDF operators. Quadratic curves, which PDF doesn't have, become cubic ones
+func writePath(b *bytes.Buffer, path rasterx.Path) {
+	pt := func(i int) (float64, float64) { return float64(path[i]) / 64, float64(path[i+1]) / 64 }
+	var cx, cy float64
+	for i := 0; i < len(path); {
+		switch rasterx.PathCommand(path[i]) {
+		case rasterx.PathMoveTo:
+			cx, cy = pt(i + 1)
+			fmt.Fprintf(b, "%s %s m\n", pdfNum(cx), pdfNum(cy))
+			i += 3
+		case rasterx.PathLineTo:
+			cx, cy = pt(i + 1)
+			fmt.Fprintf(b, "%s %s l\n", pdfNum(cx), pdfNum(cy))
+			i += 3
+		case rasterx.PathQuadTo:
+			qx, qy := pt(i + 1)
+			x, y := pt(i + 3)
+			fmt.Fprintf(b, "%s %s %s %s %s %s c\n",
+				pdfNum(cx+2*(qx-cx)/3), pdfNum(cy+2*(qy-cy)/3), pdfNum(x+2*(qx-x)/3), pdfNum(y+2*(qy-y)/3), pdfNum(x), pdfNum(y))
+			cx, cy = x, y
+			i += 5
+		case rasterx.PathCubicTo:
+			x1, y1 := pt(i + 1)
+			x2, y2 := pt(i + 3)
+			cx, cy = pt(i + 5)
+			fmt.Fprintf(b, "%s %s %s %s %s %s c\n", pdfNum(x1), pdfNum(y1), pdfNum(x2), pdfNum(y2), pdfNum(cx), pdfNum(cy))
+			i += 7
+		case rasterx.PathClose:
+			b.WriteString("h\n")
+			i++
+		default:
+			return
+		}
+	}
+}
+
+// Catalog, page tree and cross-reference table, the PDF is done after this
+func (self *pdfWriter) finish() []byte {
+	kids := []string{}
+	for _, p := range self.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", p))
+	}
+	self.reserved(1, "<< /Type /Catalog /Pages 2 0 R >>")
+	self.reserved(2, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+
+	xref := self.buf.Len()
+	fmt.Fprintf(&self.buf, "xref\n0 %d\n0000000000 65535 f \n", len(self.offsets)+1)
+	for _, off := range self.offsets {
+		fmt.Fprintf(&self.buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&self.buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(self.offsets)+1, xref)
+	return self.buf.Bytes()
+}
+
+func deflate(data []byte) []byte {
+	b := &bytes.Buffer{}
+	zw := zlib.NewWriter(b)
+	zw.Write(data)
+	zw.Close()
+	return b.Bytes()
+}
+
+// Up to 4 decimals, which is way below what anyone can see
+func pdfNum(f float64) string {
+	f = math.Round(f*1e4) / 1e4
+	if f == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func pdfColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("%s %s %s", pdfNum(float64(r>>8)/255), pdfNum(float64(g>>8)/255), pdfNum(float64(b>>8)/255))
+}
+
+func pdfCap(cap string) int {
+	return max(slices.Index([]string{"butt", "round", "square"}, cap), 0)
+}
+
+func pdfJoin(join string) int {
+	return max(slices.Index([]string{"miter", "round", "bevel"}, join), 0)
+}
+
+// A PDF string in WinAnsi, what Helvetica takes without embedding anything. Characters it doesn't
+// have become ?
+func pdfText(s string) string {
+	b := strings.Builder{}
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,52 @@
+package convert
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"kme/internal/bookmark"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pdf "github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+func TestWriteVectorPDF(t *testing.T) {
+	markPath := t.TempDir()
+	page := &bytes.Buffer{}
+	if err := jpeg.Encode(page, image.NewGray(image.Rect(0, 0, 632, 840)), nil); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(markPath, "m1.jpg"), page.Bytes(), 0644)
+	os.WriteFile(filepath.Join(markPath, "m1.svg"), []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 632 840">
+  <path d="M10 10 Q50 50 90 10" stroke="red" stroke-width="2" stroke-opacity="0.5" fill="none"/>
+</svg>`), 0644)
+
+	// m2 has no files, it's left out
+	bms := &bookmark.Bookmarks{
+		Book:    "Dune",
+		Markups: []*bookmark.Markup{{Id: "m1", Section: "ch1", Location: "(1)"}, {Id: "m2", OrderId: 1}},
+	}
+	var buf bytes.Buffer
+	if err := WriteVectorPDF(&buf, bms, markPath); !errors.Is(err, ErrSkippedMarkups) {
+		t.Errorf("Want ErrSkippedMarkups for m2, got %v", err)
+	}
+
+	if err := pdf.Validate(bytes.NewReader(buf.Bytes()), nil); err != nil {
+		t.Fatalf("Invalid PDF: %v", err)
+	}
+	pages, err := pdf.PageCount(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages != 1 {
+		t.Errorf("Got %d pages, want the one of m1", pages)
+	}
+
+	bms.Markups = bms.Markups[1:]
+	if err := WriteVectorPDF(&bytes.Buffer{}, bms, markPath); err == nil || errors.Is(err, ErrSkippedMarkups) {
+		t.Errorf("Want an error without any markup to put in, got %v", err)
+	}
+}
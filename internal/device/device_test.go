@@ -0,0 +1,123 @@
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Makes a device (or a copy of its .kobo folder, if version is empty) in dir
+func testDevice(t *testing.T, dir string, version string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, ".kobo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, DB_FILE), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if version != "" {
+		if err := os.WriteFile(filepath.Join(dir, VERSION_FILE), []byte(version), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnescapeMount(t *testing.T) {
+	for in, want := range map[string]string{
+		"/media/me/KOBOeReader":      "/media/me/KOBOeReader",
+		`/media/me/My\040Kobo`:       "/media/me/My Kobo",
+		`/mnt/tab\011and\134slash`:   "/mnt/tab\tand\\slash",
+		`/mnt/not\08octal`:           `/mnt/not\08octal`,
+		`/mnt/cut\04`:                `/mnt/cut\04`,
+		`/mnt/end\040`:               "/mnt/end ",
+		`/mnt/\040\040two`:           "/mnt/  two",
+		`/mnt/backslash\`:            `/mnt/backslash\`,
+		`/mnt/sixties\0400`:          "/mnt/sixties 0",
+		`/mnt/no\escape/only\nchars`: `/mnt/no\escape/only\nchars`,
+	} {
+		if got := unescapeMount(in); got != want {
+			t.Errorf("unescapeMount(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestReadVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		content  string
+		serial   string
+		firmware string
+		modelId  string
+	}{
+		{"full", "N418000000001,4.1.15,4.38.21908,4.1.15,4.1.15,00000000-0000-0000-0000-000000000390\n",
+			"N418000000001", "4.38.21908", "00000000-0000-0000-0000-000000000390"},
+		{"no model id", "N418000000001,4.1.15,4.38.21908", "N418000000001", "4.38.21908", ""},
+		{"too short", "N418000000001,4.1.15", "", "", ""},
+		{"no serial", ",4.1.15,4.38.21908", "", "", ""},
+		{"empty", "", "", "", ""},
+		{"blank lines", "\n\n", "", "", ""},
+	} {
+		dir := t.TempDir()
+		os.MkdirAll(filepath.Join(dir, ".kobo"), 0755)
+		os.WriteFile(filepath.Join(dir, VERSION_FILE), []byte(tc.content), 0644)
+
+		info, err := ReadVersion(dir)
+		if tc.serial == "" {
+			if err == nil {
+				t.Errorf("%s: want an error, got %+v", tc.name, info)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if info.Serial != tc.serial || info.Firmware != tc.firmware || info.ModelId != tc.modelId || info.Path != dir {
+			t.Errorf("%s: got %+v", tc.name, info)
+		}
+	}
+
+	if _, err := ReadVersion(t.TempDir()); err == nil {
+		t.Errorf("Want an error without a version file")
+	}
+}
+
+func TestModel(t *testing.T) {
+	for id, want := range map[string]string{
+		"00000000-0000-0000-0000-000000000390": "Kobo Libra Colour",
+		"00000000-0000-0000-0000-000000000376": "Kobo Clara HD",
+		"00000000-0000-0000-0000-000000000999": "Unknown Kobo (999)",
+		"not a model id":                       "Unknown Kobo (not a model id)",
+		"":                                     "Unknown Kobo",
+	} {
+		if got := (&Info{ModelId: id}).Model(); got != want {
+			t.Errorf("Model of %q = %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	root := t.TempDir()
+	defer func(roots []string) { mountRoots = roots }(mountRoots)
+	mountRoots = []string{root}
+
+	kobo := filepath.Join(root, "KOBOeReader")
+	testDevice(t, kobo, "N418000000001,4.1.15,4.38.21908,4.1.15,4.1.15,00000000-0000-0000-0000-000000000390")
+	// a copy of the .kobo folder isn't a device, and a link to the Kobo is the same one
+	testDevice(t, filepath.Join(root, "backup"), "")
+	os.Mkdir(filepath.Join(root, "usb"), 0755)
+	if err := os.Symlink(kobo, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	found := Discover()
+	if len(found) != 1 {
+		t.Fatalf("Found %d devices, want the Kobo once: %+v", len(found), found)
+	}
+	if found[0].Serial != "N418000000001" || found[0].Model() != "Kobo Libra Colour" {
+		t.Errorf("Found %+v", found[0])
+	}
+	if Id(kobo) != "N418000000001" || Id(filepath.Join(root, "backup")) != "path:"+filepath.Join(root, "backup") {
+		t.Errorf("Ids = %s, %s", Id(kobo), Id(filepath.Join(root, "backup")))
+	}
+}
@@ -0,0 +1,50 @@
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Where desktops mount removable drives, $USER is filled in. The Kobo names its volume KOBOeReader
+var mountRoots = []string{
+	"/media/$USER",
+	"/run/media/$USER",
+	"/media",
+	"/Volumes",
+}
+
+// Kobo devices currently mounted, from the mounted filesystems and the usual mount roots. Only
+// the ones with a .kobo/version are returned, copies of the .kobo folder are not devices
+func Discover() []*Info {
+	candidates := []string{}
+	if mounts, err := Mounted(); err == nil {
+		candidates = append(candidates, mounts...)
+	}
+	for _, root := range mountRoots {
+		entries, err := os.ReadDir(os.ExpandEnv(root))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			candidates = append(candidates, filepath.Join(os.ExpandEnv(root), e.Name()))
+		}
+	}
+
+	found := []*Info{}
+	seen := []string{}
+	for _, c := range candidates {
+		path, err := filepath.EvalSymlinks(c)
+		if err != nil || slices.Contains(seen, path) || !IsKobo(path) {
+			continue
+		}
+		seen = append(seen, path)
+
+		info, err := ReadVersion(c)
+		if err != nil {
+			continue
+		}
+		found = append(found, info)
+	}
+	return found
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package device
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Bytes available to us in the filesystem of path
+func FreeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, fmt.Errorf("Could not read free space of %s: %w", path, err)
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
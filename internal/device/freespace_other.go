@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package device
+
+import "fmt"
+
+func FreeSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("Free space is not supported on this platform")
+}
@@ -0,0 +1,52 @@
+package device
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kobo models by the number at the end of the model id in .kobo/version
+var models = map[int]string{
+	310: "Kobo Touch",
+	320: "Kobo Touch",
+	330: "Kobo Glo",
+	340: "Kobo Mini",
+	350: "Kobo Aura HD",
+	360: "Kobo Aura",
+	370: "Kobo Aura H2O",
+	371: "Kobo Glo HD",
+	372: "Kobo Touch 2.0",
+	373: "Kobo Aura ONE",
+	374: "Kobo Aura H2O Edition 2",
+	375: "Kobo Aura Edition 2",
+	376: "Kobo Clara HD",
+	377: "Kobo Forma",
+	380: "Kobo Forma",
+	382: "Kobo Nia",
+	383: "Kobo Sage",
+	384: "Kobo Libra H2O",
+	386: "Kobo Clara 2E",
+	387: "Kobo Elipsa",
+	388: "Kobo Libra 2",
+	389: "Kobo Elipsa 2E",
+	390: "Kobo Libra Colour",
+	391: "Kobo Clara BW",
+	393: "Kobo Clara Colour",
+}
+
+// Name of the model, or its number when we don't know it
+func (self *Info) Model() string {
+	if self.ModelId == "" {
+		return "Unknown Kobo"
+	}
+	_, num, _ := strings.Cut(self.ModelId, "-0000-0000-0000-")
+	code, err := strconv.Atoi(strings.TrimLeft(num, "0"))
+	if err != nil {
+		return "Unknown Kobo (" + self.ModelId + ")"
+	}
+	if name, ok := models[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown Kobo (%d)", code)
+}
@@ -0,0 +1,79 @@
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	MOUNTS_FILE = "/proc/self/mounts"
+	DB_FILE     = ".kobo/KoboReader.sqlite"
+)
+
+// Whether path looks like the root of a Kobo, or a copy of one
+func IsKobo(path string) bool {
+	fi, err := os.Stat(filepath.Join(path, DB_FILE))
+	return err == nil && !fi.IsDir()
+}
+
+// Mount points listed in /proc/self/mounts, so Linux only
+func Mounts() ([]string, error) {
+	f, err := os.Open(MOUNTS_FILE)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read mounted filesystems: %w", err)
+	}
+	defer f.Close()
+
+	mounts := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// device mountpoint fstype options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		mounts = append(mounts, unescapeMount(fields[1]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read mounted filesystems: %w", err)
+	}
+	return mounts, nil
+}
+
+// Mounted filesystems that are a Kobo
+func Mounted() ([]string, error) {
+	mounts, err := Mounts()
+	if err != nil {
+		return nil, err
+	}
+	kobos := []string{}
+	for _, m := range mounts {
+		if IsKobo(m) {
+			kobos = append(kobos, m)
+		}
+	}
+	return kobos, nil
+}
+
+// Spaces and such are written as octal escapes in the mounts file, e.g. \040
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,54 @@
+package device
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const VERSION_FILE = ".kobo/version"
+
+// What the Kobo says about itself in .kobo/version, a single comma separated line like
+// N418xxxxxxxxx,4.1.15,4.38.21908,4.1.15,4.1.15,00000000-0000-0000-0000-000000000390
+// serial, kernel, firmware, ..., model id
+type Info struct {
+	Path     string
+	Serial   string
+	Firmware string
+	ModelId  string
+}
+
+func ReadVersion(devicePath string) (*Info, error) {
+	data, err := os.ReadFile(filepath.Join(devicePath, VERSION_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read Kobo version file: %w", err)
+	}
+	fields := strings.Split(strings.TrimSpace(string(data)), ",")
+	if len(fields) < 3 || fields[0] == "" {
+		return nil, fmt.Errorf("Unexpected Kobo version file: %s", string(data))
+	}
+
+	info := &Info{
+		Path:     devicePath,
+		Serial:   fields[0],
+		Firmware: fields[2],
+	}
+	if len(fields) >= 6 {
+		info.ModelId = fields[5]
+	}
+	return info, nil
+}
+
+// Identifier for the device, the serial number. Devices without a version file (e.g. a copy of
+// the .kobo folder) are named after the folder they live in
+func Id(devicePath string) string {
+	if info, err := ReadVersion(devicePath); err == nil {
+		return info.Serial
+	}
+	abs, err := filepath.Abs(devicePath)
+	if err != nil {
+		abs = devicePath
+	}
+	return "path:" + abs
+}
@@ -0,0 +1,108 @@
+package epub
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// An EPUB (or KEPUB) file opened from the device, enough to know the reading order of its
+// chapters and to look inside them.
+type Book struct {
+	zip *zip.ReadCloser
+	// Full paths inside the zip, in reading order
+	Spine []string
+}
+
+type container struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type opf struct {
+	Items []struct {
+		Id   string `xml:"id,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"manifest>item"`
+	Itemrefs []struct {
+		Idref string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+func Open(bookPath string) (*Book, error) {
+	zr, err := zip.OpenReader(bookPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open book %s: %w", bookPath, err)
+	}
+	book := &Book{zip: zr}
+
+	cont := container{}
+	if err := book.decode("META-INF/container.xml", &cont); err != nil {
+		zr.Close()
+		return nil, err
+	}
+	if len(cont.Rootfiles) == 0 {
+		zr.Close()
+		return nil, fmt.Errorf("Book %s has no rootfile in its container", bookPath)
+	}
+
+	opfPath := cont.Rootfiles[0].FullPath
+	pkg := opf{}
+	if err := book.decode(opfPath, &pkg); err != nil {
+		zr.Close()
+		return nil, err
+	}
+
+	hrefs := map[string]string{}
+	for _, it := range pkg.Items {
+		hrefs[it.Id] = path.Join(path.Dir(opfPath), it.Href)
+	}
+	for _, ref := range pkg.Itemrefs {
+		if href, ok := hrefs[ref.Idref]; ok {
+			book.Spine = append(book.Spine, href)
+		}
+	}
+
+	return book, nil
+}
+
+func (self *Book) Close() error {
+	return self.zip.Close()
+}
+
+// Index in the spine of the chapter file. The Kobo DB does not always keep the same root as the
+// OPF so we match on the end of the path. -1 if the chapter is not in the spine
+func (self *Book) SpineIndex(href string) int {
+	href = strings.TrimPrefix(path.Clean("/"+href), "/")
+	for i, s := range self.Spine {
+		if s == href || strings.HasSuffix(s, "/"+href) || strings.HasSuffix(href, "/"+s) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (self *Book) open(name string) (io.ReadCloser, error) {
+	f, err := self.zip.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find %s inside the book: %w", name, err)
+	}
+	return f, nil
+}
+
+func (self *Book) decode(name string, v any) error {
+	f, err := self.open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("Could not parse %s: %w", name, err)
+	}
+	return nil
+}
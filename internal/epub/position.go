@@ -0,0 +1,139 @@
+package epub
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// One element on the way from the document root to a Kobo span
+type Step struct {
+	Name string
+	// 0 based index among all the element children of the parent
+	Index int
+	// 1 based index among the siblings with the same name, the way XPath counts them
+	NameIndex int
+}
+
+// Where a Kobo span lives inside the book, independent of any reader. CFI() and XPointer() give it
+// in the format Calibre and KOReader understand respectively.
+type Position struct {
+	Spine  int
+	Steps  []Step
+	Offset int
+}
+
+// The Kobo DB keeps the span selector escaped for CSS, e.g. span#kobo\.40\.9 => kobo.40.9
+func SpanId(containerPath string) string {
+	id := containerPath
+	if i := strings.Index(id, "#"); i >= 0 {
+		id = id[i+1:]
+	}
+	return strings.ReplaceAll(id, `\`, "")
+}
+
+// Find the span the Kobo container path points to, inside the chapter file href
+func (self *Book) Locate(href string, containerPath string, offset int) (*Position, error) {
+	spine := self.SpineIndex(href)
+	if spine < 0 {
+		return nil, fmt.Errorf("Chapter %s is not part of the book spine", href)
+	}
+	id := SpanId(containerPath)
+	if id == "" {
+		return nil, fmt.Errorf("Empty Kobo location in chapter %s", href)
+	}
+
+	f, err := self.open(self.Spine[spine])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	steps, err := findId(f, id)
+	if err != nil {
+		return nil, fmt.Errorf("Could not locate %s in %s: %w", id, href, err)
+	}
+
+	return &Position{Spine: spine, Steps: steps, Offset: offset}, nil
+}
+
+// Walks the document keeping the path to the current element, until an element with the given id
+func findId(r io.Reader, id string) ([]Step, error) {
+	type frame struct {
+		children int
+		names    map[string]int
+	}
+
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+
+	stack := []*frame{{names: map[string]int{}}}
+	steps := []Step{}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("id not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			parent := stack[len(stack)-1]
+			parent.names[t.Name.Local]++
+			steps = append(steps, Step{
+				Name:      t.Name.Local,
+				Index:     parent.children,
+				NameIndex: parent.names[t.Name.Local],
+			})
+			parent.children++
+			stack = append(stack, &frame{names: map[string]int{}})
+
+			for _, a := range t.Attr {
+				if a.Name.Local == "id" && a.Value == id {
+					return steps, nil
+				}
+			}
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+				steps = steps[:len(steps)-1]
+			}
+		}
+	}
+}
+
+// EPUB CFI relative to the chapter document, the way Calibre stores them next to the spine index.
+// Elements take even indices and the text inside the span is its first (odd) child
+func (self *Position) CFI() string {
+	b := strings.Builder{}
+	for _, s := range self.Steps {
+		fmt.Fprintf(&b, "/%d", (s.Index+1)*2)
+	}
+	fmt.Fprintf(&b, "/1:%d", self.Offset)
+	return b.String()
+}
+
+// CREngine XPointer as KOReader keeps them in its sidecar files, e.g.
+// /body/DocFragment[3]/body/div/p[2]/span[4]/text().12
+func (self *Position) XPointer() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "/body/DocFragment[%d]", self.Spine+1)
+	for _, s := range self.Steps {
+		switch s.Name {
+		case "html":
+			continue
+		case "body":
+			b.WriteString("/body")
+		default:
+			fmt.Fprintf(&b, "/%s[%d]", s.Name, s.NameIndex)
+		}
+	}
+	fmt.Fprintf(&b, "/text().%d", self.Offset)
+	return b.String()
+}
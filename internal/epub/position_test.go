@@ -0,0 +1,52 @@
+package epub
+
+import (
+	"strings"
+	"testing"
+)
+
+const chapter = `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>Chapter 1</title></head>
+<body>
+<div class="chapter">
+	<h1><span class="koboSpan" id="kobo.1.1">Chapter 1</span></h1>
+	<p><span class="koboSpan" id="kobo.2.1">First paragraph.</span></p>
+	<p><span class="koboSpan" id="kobo.3.1">Second&nbsp;paragraph.</span><br/><span class="koboSpan" id="kobo.3.2">Same paragraph.</span></p>
+</div>
+</body>
+</html>`
+
+func TestSpanId(t *testing.T) {
+	tests := map[string]string{
+		`span#kobo\.40\.9`: "kobo.40.9",
+		`span#kobo.114.3`:  "kobo.114.3",
+		`kobo.1.1`:         "kobo.1.1",
+	}
+	for in, want := range tests {
+		if got := SpanId(in); got != want {
+			t.Errorf("Incorrect span id for %s: want: %s, got: %s", in, want, got)
+		}
+	}
+}
+
+func TestPositionFormats(t *testing.T) {
+	steps, err := findId(strings.NewReader(chapter), "kobo.3.2")
+	if err != nil {
+		t.Fatalf("Could not find span: %v", err)
+	}
+	pos := &Position{Spine: 2, Steps: steps, Offset: 5}
+
+	if got, want := pos.CFI(), "/2/4/2/6/6/1:5"; got != want {
+		t.Errorf("Incorrect CFI: want: %s, got: %s", want, got)
+	}
+	if got, want := pos.XPointer(), "/body/DocFragment[3]/body/div[1]/p[2]/span[2]/text().5"; got != want {
+		t.Errorf("Incorrect XPointer: want: %s, got: %s", want, got)
+	}
+}
+
+func TestMissingSpan(t *testing.T) {
+	if _, err := findId(strings.NewReader(chapter), "kobo.9.9"); err == nil {
+		t.Errorf("Expected an error for a span that is not in the chapter")
+	}
+}
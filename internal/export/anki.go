@@ -0,0 +1,350 @@
+package export
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"kme/internal/bookmark"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const ANKI_DEFAULT_DECK = "Kobo"
+
+// Note types and their ids have to stay the same between exports, otherwise Anki sees a new note
+// type on every import and duplicates the notes instead of updating them
+const (
+	ankiBasicModelId = 1718000000001
+	ankiClozeModelId = 1718000000002
+)
+
+// Anki keeps the fields of a note in a single column separated by this
+const ankiFieldSep = "\x1f"
+
+var htmlTagRgx = regexp.MustCompile(`<[^>]*>`)
+
+type AnkiOptions struct {
+	// Make cloze cards from the highlights that have a note
+	Cloze bool
+	// Deck for each color code, highlights with colors not in here go to DefaultDeck
+	Decks       map[int]string
+	DefaultDeck string
+}
+
+// Schema of an Anki 2.1 collection (collection.anki2), which is what .apkg files carry
+const ankiSchema = `
+CREATE TABLE col (id integer primary key, crt integer not null, mod integer not null,
+	scm integer not null, ver integer not null, dty integer not null, usn integer not null,
+	ls integer not null, conf text not null, models text not null, decks text not null,
+	dconf text not null, tags text not null);
+CREATE TABLE notes (id integer primary key, guid text not null, mid integer not null,
+	mod integer not null, usn integer not null, tags text not null, flds text not null,
+	sfld integer not null, csum integer not null, flags integer not null, data text not null);
+CREATE TABLE cards (id integer primary key, nid integer not null, did integer not null,
+	ord integer not null, mod integer not null, usn integer not null, type integer not null,
+	queue integer not null, due integer not null, ivl integer not null, factor integer not null,
+	reps integer not null, lapses integer not null, left integer not null, odue integer not null,
+	odid integer not null, flags integer not null, data text not null);
+CREATE TABLE revlog (id integer primary key, cid integer not null, usn integer not null,
+	ease integer not null, ivl integer not null, lastIvl integer not null, factor integer not null,
+	time integer not null, type integer not null);
+CREATE TABLE graves (usn integer not null, oid integer not null, type integer not null);
+CREATE INDEX ix_notes_usn on notes (usn);
+CREATE INDEX ix_cards_usn on cards (usn);
+CREATE INDEX ix_revlog_usn on revlog (usn);
+CREATE INDEX ix_cards_nid on cards (nid);
+CREATE INDEX ix_cards_sched on cards (did, queue, due);
+CREATE INDEX ix_revlog_cid on revlog (cid);
+CREATE INDEX ix_notes_csum on notes (csum);
+`
+
+// Writes all the highlights as an Anki package. Each highlight is a note tagged with its book and
+// chapter, and with the Kobo bookmark ID as note guid, so importing a newer export updates the
+// cards instead of duplicating them
+func WriteAnki(w io.Writer, all []*bookmark.Bookmarks, opts AnkiOptions) error {
+	if opts.DefaultDeck == "" {
+		opts.DefaultDeck = ANKI_DEFAULT_DECK
+	}
+
+	tmpDir, err := os.MkdirTemp("", "kme-anki")
+	if err != nil {
+		return fmt.Errorf("Could not create temporary directory for the Anki collection: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	colPath := filepath.Join(tmpDir, "collection.anki2")
+
+	if err := writeAnkiCollection(colPath, all, opts); err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	if err := addFileToZip(zw, "collection.anki2", colPath); err != nil {
+		return err
+	}
+	// No media, but Anki expects the (empty) media map
+	mw, err := zw.Create("media")
+	if err != nil {
+		return fmt.Errorf("Error writing Anki package: %w", err)
+	}
+	if _, err := mw.Write([]byte("{}")); err != nil {
+		return fmt.Errorf("Error writing Anki package: %w", err)
+	}
+	return zw.Close()
+}
+
+func writeAnkiCollection(colPath string, all []*bookmark.Bookmarks, opts AnkiOptions) error {
+	db, err := sql.Open("sqlite", colPath)
+	if err != nil {
+		return fmt.Errorf("Could not create Anki collection: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(ankiSchema); err != nil {
+		return fmt.Errorf("Could not create Anki collection: %w", err)
+	}
+
+	now := time.Now()
+	decks := map[string]int64{}
+	deckId := func(name string) int64 {
+		if id, ok := decks[name]; ok {
+			return id
+		}
+		decks[name] = ankiId("deck:" + name)
+		return decks[name]
+	}
+	deckId(opts.DefaultDeck)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not write Anki collection: %w", err)
+	}
+	defer tx.Rollback()
+
+	due := 0
+	for _, bms := range all {
+		for _, c := range Chapters(bms) {
+			for _, h := range c.Highlights {
+				if h.Text() == "" {
+					continue
+				}
+				due++
+				deck := opts.DefaultDeck
+				if d, ok := opts.Decks[h.Color()]; ok {
+					deck = d
+				}
+				if err := insertAnkiNote(tx, bms, h, deckId(deck), due, opts.Cloze, now); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	models, err := ankiModels(deckId(opts.DefaultDeck), now)
+	if err != nil {
+		return err
+	}
+	decksJson, err := ankiDecks(decks, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO col VALUES (1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')`,
+		now.Unix(), now.UnixMilli(), now.UnixMilli(),
+		ankiConf, models, decksJson, ankiDeckConf,
+	)
+	if err != nil {
+		return fmt.Errorf("Could not write Anki collection: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func insertAnkiNote(
+	tx *sql.Tx,
+	bms *bookmark.Bookmarks,
+	h *bookmark.Highlight,
+	did int64,
+	due int,
+	cloze bool,
+	now time.Time,
+) error {
+	source := bms.Book
+	if bms.Author != "" {
+		source = fmt.Sprintf("%s, %s", bms.Book, bms.Author)
+	}
+	source = fmt.Sprintf("%s (%s)", source, h.Section)
+
+	// fields are HTML for Anki
+	text, note := html.EscapeString(h.Text()), html.EscapeString(h.Note)
+	source = html.EscapeString(source)
+
+	mid := int64(ankiBasicModelId)
+	fields := []string{text, source, note, h.Id}
+	if cloze && note != "" {
+		mid = ankiClozeModelId
+		fields = []string{ankiCloze(text, note), source, note, h.Id}
+	}
+	sortField := htmlTagRgx.ReplaceAllString(fields[0], "")
+
+	tags := []string{ankiTag(bms.Book), ankiTag(h.Section), ankiTag(h.ColorTag(h.Color()))}
+	nid := ankiId("note:" + h.Id)
+
+	_, err := tx.Exec(
+		`INSERT INTO notes VALUES (?, ?, ?, ?, -1, ?, ?, ?, ?, 0, '')`,
+		nid, h.Id, mid, now.Unix(),
+		" "+strings.Join(tags, " ")+" ",
+		strings.Join(fields, ankiFieldSep),
+		sortField, ankiChecksum(sortField),
+	)
+	if err != nil {
+		return fmt.Errorf("Could not write Anki note for highlight %s: %w", h.Id, err)
+	}
+	_, err = tx.Exec(
+		`INSERT INTO cards VALUES (?, ?, ?, 0, ?, -1, 0, 0, ?, 0, 0, 0, 0, 0, 0, 0, 0, '')`,
+		ankiId("card:"+h.Id), nid, did, now.Unix(), due,
+	)
+	if err != nil {
+		return fmt.Errorf("Could not write Anki card for highlight %s: %w", h.Id, err)
+	}
+	return nil
+}
+
+// If the note is part of the highlight that's what gets hidden, otherwise the whole highlight is
+// hidden with the note as hint
+func ankiCloze(text string, note string) string {
+	e := ankiClozeEscaper.Replace
+	if i := strings.Index(text, note); i >= 0 {
+		return fmt.Sprintf("%s{{c1::%s}}%s", e(text[:i]), e(text[i:i+len(note)]), e(text[i+len(note):]))
+	}
+	return fmt.Sprintf("{{c1::%s::%s}}", e(text), e(note))
+}
+
+// Braces and colons in the text would end the cloze early (or start another one), as HTML
+// entities Anki shows them as they are
+var ankiClozeEscaper = strings.NewReplacer("{", "&#123;", "}", "&#125;", ":", "&#58;")
+
+// Anki tags can't have spaces
+func ankiTag(s string) string {
+	return strings.Trim(slugRgx.ReplaceAllString(strings.ToLower(s), "_"), "_")
+}
+
+// Stable ids from the Kobo IDs, positive and within what JavaScript can represent (Anki is happier)
+func ankiId(key string) int64 {
+	sum := sha1.Sum([]byte(key))
+	return int64(binary.BigEndian.Uint64(sum[:8]) >> 12)
+}
+
+func ankiChecksum(s string) int64 {
+	sum := sha1.Sum([]byte(s))
+	return int64(binary.BigEndian.Uint32(sum[:4]))
+}
+
+func ankiModels(did int64, now time.Time) (string, error) {
+	field := func(name string, ord int) map[string]any {
+		return map[string]any{
+			"name": name, "ord": ord, "sticky": false, "rtl": false,
+			"font": "Arial", "size": 20, "media": []any{},
+		}
+	}
+	tmpl := func(name string, qfmt string, afmt string) map[string]any {
+		return map[string]any{
+			"name": name, "ord": 0, "qfmt": qfmt, "afmt": afmt,
+			"did": nil, "bqfmt": "", "bafmt": "",
+		}
+	}
+	css := ".card { font-family: Georgia, serif; font-size: 20px; text-align: left; }\n" +
+		".source { font-size: 14px; color: #888; }\n.cloze { font-weight: bold; color: #2a6fb0; }"
+
+	basic := map[string]any{
+		"id": ankiBasicModelId, "name": "Kobo highlight", "type": 0,
+		"mod": now.Unix(), "usn": -1, "sortf": 0, "did": did,
+		"flds": []any{field("Text", 0), field("Source", 1), field("Note", 2), field("KoboID", 3)},
+		"tmpls": []any{tmpl(
+			"Highlight",
+			`{{Text}}<div class="source">{{Source}}</div>`,
+			`{{FrontSide}}<hr id="answer">{{Note}}`,
+		)},
+		"css": css, "latexPre": "", "latexPost": "", "tags": []any{}, "vers": []any{},
+		"req": []any{[]any{0, "any", []any{0}}},
+	}
+	cloze := map[string]any{
+		"id": ankiClozeModelId, "name": "Kobo highlight (cloze)", "type": 1,
+		"mod": now.Unix(), "usn": -1, "sortf": 0, "did": did,
+		"flds": []any{field("Text", 0), field("Source", 1), field("Note", 2), field("KoboID", 3)},
+		"tmpls": []any{tmpl(
+			"Cloze",
+			`{{cloze:Text}}<div class="source">{{Source}}</div>`,
+			`{{cloze:Text}}<div class="source">{{Source}}</div><hr id="answer">{{Note}}`,
+		)},
+		"css": css, "latexPre": "", "latexPost": "", "tags": []any{}, "vers": []any{},
+	}
+
+	models, err := json.Marshal(map[string]any{
+		fmt.Sprint(ankiBasicModelId): basic,
+		fmt.Sprint(ankiClozeModelId): cloze,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Could not write Anki note types: %w", err)
+	}
+	return string(models), nil
+}
+
+func ankiDecks(decks map[string]int64, now time.Time) (string, error) {
+	all := map[string]any{}
+	deck := func(id int64, name string) map[string]any {
+		return map[string]any{
+			"id": id, "name": name, "mod": now.Unix(), "usn": -1, "desc": "",
+			"dyn": 0, "conf": 1, "collapsed": false, "extendNew": 10, "extendRev": 50,
+			"newToday": []int{0, 0}, "revToday": []int{0, 0},
+			"lrnToday": []int{0, 0}, "timeToday": []int{0, 0},
+		}
+	}
+	all["1"] = deck(1, "Default")
+	for name, id := range decks {
+		all[fmt.Sprint(id)] = deck(id, name)
+	}
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return "", fmt.Errorf("Could not write Anki decks: %w", err)
+	}
+	return string(data), nil
+}
+
+const ankiConf = `{"activeDecks": [1], "curDeck": 1, "newSpread": 0, "collapseTime": 1200,
+"timeLim": 0, "estTimes": true, "dueCounts": true, "curModel": null, "nextPos": 1,
+"sortType": "noteFld", "sortBackwards": false, "addToCur": true}`
+
+const ankiDeckConf = `{"1": {"id": 1, "name": "Default", "mod": 0, "usn": 0, "maxTaken": 60,
+"autoplay": true, "timer": 0, "replayq": true, "dyn": false,
+"new": {"bury": true, "delays": [1, 10], "initialFactor": 2500, "ints": [1, 4, 7], "order": 1, "perDay": 20, "separate": true},
+"lapse": {"delays": [10], "leechAction": 0, "leechFails": 8, "minInt": 1, "mult": 0},
+"rev": {"bury": true, "ease4": 1.3, "fuzz": 0.05, "ivlFct": 1, "maxIvl": 36500, "minSpace": 1, "perDay": 100}}}`
+
+func addFileToZip(zw *zip.Writer, name string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Could not read %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return fmt.Errorf("Could not add %s to zip: %w", name, err)
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("Could not add %s to zip: %w", name, err)
+	}
+	return nil
+}
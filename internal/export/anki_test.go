@@ -0,0 +1,99 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"io"
+	"kme/internal/bookmark"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteAnki(t *testing.T) {
+	bms, _ := testBook(t)
+	out := bytes.Buffer{}
+	opts := AnkiOptions{Cloze: true, Decks: map[int]string{1: "Kobo::Litanies"}}
+	if err := WriteAnki(&out, []*bookmark.Bookmarks{bms}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the collection is a SQLite DB inside the package
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	colPath := filepath.Join(t.TempDir(), "collection.anki2")
+	for _, f := range zr.File {
+		if f.Name != "collection.anki2" {
+			continue
+		}
+		r, _ := f.Open()
+		data, _ := io.ReadAll(r)
+		r.Close()
+		os.WriteFile(colPath, data, 0644)
+	}
+	db, err := sql.Open("sqlite", colPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	type note struct {
+		mid        int64
+		flds, tags string
+		did        int64
+	}
+	notes := map[string]note{}
+	rows, err := db.Query(`SELECT guid, mid, flds, tags, did FROM notes JOIN cards ON cards.nid = notes.id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var guid string
+		n := note{}
+		if err := rows.Scan(&guid, &n.mid, &n.flds, &n.tags, &n.did); err != nil {
+			t.Fatal(err)
+		}
+		notes[guid] = n
+	}
+	rows.Close()
+
+	if len(notes) != 3 {
+		t.Fatalf("Got %d notes, want one per highlight", len(notes))
+	}
+	if n := notes["h1"]; n.mid != ankiBasicModelId || !strings.HasPrefix(n.flds, "A beginning is the time."+ankiFieldSep) ||
+		n.tags != " dune ch1 yellow " || n.did != ankiId("deck:Kobo") {
+		t.Errorf("Basic note = %+v", n)
+	}
+	if n := notes["h2"]; n.mid != ankiClozeModelId || !strings.HasPrefix(n.flds, "{{c1::Fear is the mind-killer.::Litany, &#34;against&#34; fear}}") ||
+		n.did != ankiId("deck:Kobo::Litanies") {
+		t.Errorf("Cloze note = %+v", n)
+	}
+
+	var decks string
+	if err := db.QueryRow(`SELECT decks FROM col`).Scan(&decks); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(decks, `"Kobo::Litanies"`) || !strings.Contains(decks, `"Kobo"`) {
+		t.Errorf("Decks = %s", decks)
+	}
+}
+
+func TestAnkiCloze(t *testing.T) {
+	tests := []struct {
+		text, note, want string
+	}{
+		{"The spice must flow", "spice", "The {{c1::spice}} must flow"},
+		{"The spice must flow", "melange", "{{c1::The spice must flow::melange}}"},
+		{"Use {{x}} and a::b", "a::b", "Use &#123;&#123;x&#125;&#125; and {{c1::a&#58;&#58;b}}"},
+		{"Ends with }}", "what::is it", "{{c1::Ends with &#125;&#125;::what&#58;&#58;is it}}"},
+	}
+	for _, tt := range tests {
+		if got := ankiCloze(tt.text, tt.note); got != tt.want {
+			t.Errorf("ankiCloze(%q, %q) = %q, want %q", tt.text, tt.note, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"kme/internal/bookmark"
+	"kme/internal/epub"
+	"time"
+)
+
+// Extension the Calibre viewer uses when exporting/importing highlights
+const CALIBRE_EXT = ".calibre_highlights"
+
+type calibreCollection struct {
+	Version    int                `json:"version"`
+	Type       string             `json:"type"`
+	Highlights []calibreHighlight `json:"highlights"`
+}
+
+type calibreStyle struct {
+	Kind  string `json:"kind"`
+	Type  string `json:"type"`
+	Which string `json:"which"`
+}
+
+type calibreHighlight struct {
+	Type            string       `json:"type"`
+	Uuid            string       `json:"uuid"`
+	Timestamp       string       `json:"timestamp"`
+	StartCfi        string       `json:"start_cfi"`
+	EndCfi          string       `json:"end_cfi"`
+	HighlightedText string       `json:"highlighted_text"`
+	Notes           string       `json:"notes,omitempty"`
+	SpineIndex      int          `json:"spine_index"`
+	SpineName       string       `json:"spine_name"`
+	Style           calibreStyle `json:"style"`
+	TocFamilyTitles []string     `json:"toc_family_titles"`
+}
+
+// Writes the highlights of a book in the format the Calibre viewer imports. Calibre anchors
+// highlights with CFIs, so the positions are resolved against the book file; highlights that can't
+// be located in it are left out and counted as skipped.
+func WriteCalibre(w io.Writer, bms *bookmark.Bookmarks, book *epub.Book) (int, error) {
+	coll := calibreCollection{
+		Version:    1,
+		Type:       "calibre_highlights",
+		Highlights: []calibreHighlight{},
+	}
+	skipped := 0
+
+	for _, h := range bms.Highs() {
+		start, err := book.Locate(h.ChapterHref(), h.StartPath, h.StartOffset)
+		if err != nil {
+			skipped++
+			continue
+		}
+		end, err := book.Locate(h.ChapterHref(), h.EndPath, h.EndOffset)
+		if err != nil {
+			// a highlight ending in a span we can't find is better than no highlight
+			end = start
+		}
+
+		coll.Highlights = append(coll.Highlights, calibreHighlight{
+			Type:            "highlight",
+			Uuid:            h.Id,
+			Timestamp:       calibreTime(h.Created),
+			StartCfi:        start.CFI(),
+			EndCfi:          end.CFI(),
+			HighlightedText: h.Text(),
+			Notes:           h.Note,
+			SpineIndex:      start.Spine,
+			SpineName:       book.Spine[start.Spine],
+			Style: calibreStyle{
+				Kind:  "color",
+				Type:  "builtin",
+				Which: h.KoboColorName(h.Color()),
+			},
+			TocFamilyTitles: []string{h.Section},
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(coll); err != nil {
+		return skipped, fmt.Errorf("Error writing Calibre highlights for book %s: %w", bms.Book, err)
+	}
+	return skipped, nil
+}
+
+func calibreTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
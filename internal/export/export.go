@@ -0,0 +1,44 @@
+package export
+
+import (
+	"cmp"
+	"kme/internal/bookmark"
+	"slices"
+)
+
+// Highlights of a chapter, in reading order
+type Chapter struct {
+	Section    string
+	Highlights []*bookmark.Highlight
+}
+
+// Groups the highlights of a book by section, sorted by OrderId so chapters and highlights come
+// in the order they appear in the book
+func Chapters(bms *bookmark.Bookmarks) []*Chapter {
+	highs := slices.Clone(bms.Highlights)
+	slices.SortFunc(highs, func(a, b *bookmark.Highlight) int {
+		return cmp.Compare(a.OrderId, b.OrderId)
+	})
+
+	chapters := []*Chapter{}
+	for _, h := range highs {
+		if len(chapters) == 0 || chapters[len(chapters)-1].Section != h.Section {
+			chapters = append(chapters, &Chapter{Section: h.Section})
+		}
+		last := chapters[len(chapters)-1]
+		last.Highlights = append(last.Highlights, h)
+	}
+	return chapters
+}
+
+// The file each markup can be found in after the extraction, by markup id, relative to the exported
+// file. Markups without one have no file to link to, e.g. when only highlights were extracted
+type MarkupFiles map[string]string
+
+func sortedMarkups(bms *bookmark.Bookmarks) []*bookmark.Markup {
+	marks := slices.Clone(bms.Markups)
+	slices.SortFunc(marks, func(a, b *bookmark.Markup) int {
+		return cmp.Compare(a.OrderId, b.OrderId)
+	})
+	return marks
+}
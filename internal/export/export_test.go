@@ -0,0 +1,161 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"flag"
+	"io"
+	"kme/internal/bookmark"
+	"kme/internal/epub"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A book with two chapters and the bookmarks made on it: three highlights, one of them with a
+// note, and a markup
+func testBook(t *testing.T) (*bookmark.Bookmarks, *epub.Book) {
+	t.Helper()
+	bookPath := filepath.Join(t.TempDir(), "dune.epub")
+	f, err := os.Create(bookPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, content := range map[string]string{
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="OEBPS/content.opf"/></rootfiles></container>`,
+		"OEBPS/content.opf": `<package><manifest><item id="c1" href="ch1.xhtml"/><item id="c2" href="ch2.xhtml"/></manifest>` +
+			`<spine><itemref idref="c1"/><itemref idref="c2"/></spine></package>`,
+		"OEBPS/ch1.xhtml": `<html><body><p><span class="koboSpan" id="kobo.1.1">A beginning is the time.</span></p>` +
+			`<p><span class="koboSpan" id="kobo.2.1">Fear is the mind-killer.</span></p></body></html>`,
+		"OEBPS/ch2.xhtml": `<html><body><p><span class="koboSpan" id="kobo.1.1">The spice must flow.</span></p></body></html>`,
+	} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	f.Close()
+
+	book, err := epub.Open(bookPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { book.Close() })
+
+	day := time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC)
+	highlight := func(id, chapter, span, text string, color int, order float64) *bookmark.Highlight {
+		h := bookmark.NewHighlight(text, color)
+		h.Id, h.Section, h.Location, h.OrderId = id, chapter, span, order
+		h.VolumeId = "file:///mnt/onboard/Books/dune.epub"
+		h.ContentId = h.VolumeId + "!OEBPS!" + chapter + ".xhtml"
+		h.StartPath, h.EndPath, h.EndOffset = `span#kobo\.`+span, `span#kobo\.`+span, 4
+		h.Created, h.Modified = day, day
+		return h
+	}
+	fear := highlight("h2", "ch1", "2.1", "Fear is the mind-killer.", 1, 2)
+	fear.Note = "Litany, \"against\" fear"
+	return &bookmark.Bookmarks{
+		Book:      "Dune",
+		Author:    "Frank Herbert",
+		VolumeId:  "file:///mnt/onboard/Books/dune.epub",
+		ContentId: "file:///mnt/onboard/Books/dune.epub",
+		Highlights: []*bookmark.Highlight{
+			highlight("h1", "ch1", "1.1", "A beginning is the time.", 0, 1),
+			fear,
+			highlight("h3", "ch2", "1.1", "The spice must flow.", 2, 3),
+		},
+		Markups: []*bookmark.Markup{{Id: "22222222-bbbb-4000-8000-000000000001", Section: "ch2", Location: "1.1", OrderId: 4}},
+	}, book
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Compares with testdata/<name>, go test -update writes it
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		os.MkdirAll("testdata", 0755)
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("No golden file, run go test -update: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s changed, run go test -update if it is on purpose. Got:\n%s", name, got)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	// dates are written in local time, and the export date is today
+	local := time.Local
+	time.Local = time.UTC
+	defer func() { time.Local = local }()
+	today := []byte(time.Now().Format("2006-01-02"))
+
+	bms, book := testBook(t)
+	palette, err := LoadPalette(DEFAULT_PALETTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := MarkdownTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writers := map[string]func(w io.Writer) error{
+		"dune.md": func(w io.Writer) error {
+			return WriteMarkdown(w, bms, tmpl, MarkupFiles{bms.Markups[0].Id: "20240302_1000 - Dune (markups).pdf"})
+		},
+		"dune.html": func(w io.Writer) error { return WriteHTML(w, bms, palette, "") },
+		"dune.org": func(w io.Writer) error {
+			return WriteOrg(w, bms, MarkupFiles{bms.Markups[0].Id: "20240302_1000 - Dune (markups).pdf"})
+		},
+		"dune" + CALIBRE_EXT: func(w io.Writer) error {
+			_, err := WriteCalibre(w, bms, book)
+			return err
+		},
+		"metadata.epub.lua": func(w io.Writer) error {
+			_, err := WriteKOReader(w, bms, book, "/mnt/onboard/Books/dune.epub", nil)
+			return err
+		},
+	}
+	for name, write := range writers {
+		out := bytes.Buffer{}
+		if err := write(&out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		golden(t, name, bytes.ReplaceAll(out.Bytes(), today, []byte("<today>")))
+	}
+}
+
+func TestWriteOrgWithoutMarkupFiles(t *testing.T) {
+	bms, _ := testBook(t)
+	out := bytes.Buffer{}
+	if err := WriteOrg(&out, bms, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "** ch2/1.1") || strings.Contains(out.String(), "[[file:") {
+		t.Errorf("Want the markup listed without a link when it has no file:\n%s", out.String())
+	}
+}
+
+func TestWriteMarkdownWithoutMarkupFiles(t *testing.T) {
+	bms, _ := testBook(t)
+	tmpl, err := MarkdownTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.Buffer{}
+	if err := WriteMarkdown(&out, bms, tmpl, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "\n- ch2/1.1\n") || strings.Contains(out.String(), "](") {
+		t.Errorf("Want the markup listed without a link when it has no file:\n%s", out.String())
+	}
+}
@@ -0,0 +1,72 @@
+package export
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image/jpeg"
+	"io"
+	"kme/internal/bookmark"
+	"kme/internal/convert"
+	"maps"
+	"slices"
+)
+
+const THUMB_WIDTH = 240
+
+type htmlView struct {
+	*BookView
+	Palette []htmlSwatch
+	Thumbs  []htmlThumb
+}
+
+type htmlSwatch struct {
+	Code int
+	Swatch
+}
+
+type htmlThumb struct {
+	Section  string
+	Location string
+	Src      template.URL
+}
+
+// Writes a standalone HTML page for the book: highlights styled with the palette colors, grouped
+// by chapter, and thumbnails of the markups embedded in the page so it can be moved around alone.
+// Markups that can't be rendered (e.g. missing files) are left out
+func WriteHTML(w io.Writer, bms *bookmark.Bookmarks, palette Palette, markPath string) error {
+	tmpl, err := template.New("html.tmpl").Funcs(template.FuncMap(TemplateFuncs())).ParseFS(templatesFS, "templates/html.tmpl")
+	if err != nil {
+		return fmt.Errorf("Could not load HTML template: %w", err)
+	}
+
+	view := htmlView{BookView: NewBookView(bms)}
+	for _, code := range slices.Sorted(maps.Keys(palette)) {
+		view.Palette = append(view.Palette, htmlSwatch{Code: code, Swatch: palette[code]})
+	}
+	for _, m := range sortedMarkups(bms) {
+		src, err := thumbnailURL(m, markPath)
+		if err != nil {
+			continue
+		}
+		view.Thumbs = append(view.Thumbs, htmlThumb{Section: m.Section, Location: m.Location, Src: src})
+	}
+
+	if err := tmpl.Execute(w, view); err != nil {
+		return fmt.Errorf("Error writing HTML for book %s: %w", bms.Book, err)
+	}
+	return nil
+}
+
+func thumbnailURL(m *bookmark.Markup, markPath string) (template.URL, error) {
+	img, err := convert.RenderMarkup(m, markPath)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, convert.Thumbnail(img, THUMB_WIDTH), &jpeg.Options{Quality: 70}); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
@@ -0,0 +1,209 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"kme/internal/bookmark"
+	"time"
+)
+
+// Version of the JSON/NDJSON schema below. Bump it on any change that breaks existing readers
+// (renamed or removed fields, changed types); new fields alone don't need it.
+//
+// JSON (--format json) is a single object:
+//
+//	{"schema": "kme.library", "version": 1, "exported": <RFC3339>, "books": [<book>, ...]}
+//
+// NDJSON (--format ndjson) is one object per line, each with a "type" of "book", "highlight" or
+// "markup". Book lines come before the annotations of the book, and annotations carry the
+// "book_id" (Kobo VolumeID) and "book" title so every line can be read on its own:
+//
+//	{"type": "book", "version": 1, <book fields without highlights/markups>}
+//	{"type": "highlight", "version": 1, "book_id": ..., "book": ..., <highlight fields>}
+//
+// list-books uses the same book objects without the annotations, only their counts.
+const SCHEMA_VERSION = 1
+
+type JSONLibrary struct {
+	Schema   string      `json:"schema"`
+	Version  int         `json:"version"`
+	Exported time.Time   `json:"exported"`
+	Books    []*JSONBook `json:"books"`
+}
+
+type JSONBook struct {
+	Type            string           `json:"type,omitempty"`
+	Version         int              `json:"version,omitempty"`
+	Title           string           `json:"title"`
+	Author          string           `json:"author"`
+	ISBN            string           `json:"isbn"`
+	VolumeId        string           `json:"volume_id"`
+	ContentId       string           `json:"content_id"`
+	HighlightsCount int              `json:"highlights_count"`
+	MarkupsCount    int              `json:"markups_count"`
+	Highlights      []*JSONHighlight `json:"highlights,omitempty"`
+	Markups         []*JSONMarkup    `json:"markups,omitempty"`
+}
+
+type JSONHighlight struct {
+	Type            string    `json:"type,omitempty"`
+	Version         int       `json:"version,omitempty"`
+	BookId          string    `json:"book_id,omitempty"`
+	Book            string    `json:"book,omitempty"`
+	Id              string    `json:"id"`
+	ContentId       string    `json:"content_id"`
+	Section         string    `json:"section"`
+	Location        string    `json:"location"`
+	OrderId         float64   `json:"order_id"`
+	StartPath       string    `json:"start_path"`
+	StartOffset     int       `json:"start_offset"`
+	EndPath         string    `json:"end_path"`
+	EndOffset       int       `json:"end_offset"`
+	ChapterProgress float64   `json:"chapter_progress"`
+	Color           int       `json:"color"`
+	ColorName       string    `json:"color_name"`
+	ColorTag        string    `json:"color_tag"`
+	ColorLabel      string    `json:"color_label"`
+	Text            string    `json:"text"`
+	Note            string    `json:"note"`
+	Created         time.Time `json:"created,omitzero"`
+	Modified        time.Time `json:"modified,omitzero"`
+	// Serial of the device the annotation was made on, when known
+	Device string `json:"device,omitempty"`
+}
+
+type JSONMarkup struct {
+	Type            string    `json:"type,omitempty"`
+	Version         int       `json:"version,omitempty"`
+	BookId          string    `json:"book_id,omitempty"`
+	Book            string    `json:"book,omitempty"`
+	Id              string    `json:"id"`
+	ContentId       string    `json:"content_id"`
+	Section         string    `json:"section"`
+	Location        string    `json:"location"`
+	OrderId         float64   `json:"order_id"`
+	ChapterProgress float64   `json:"chapter_progress"`
+	Created         time.Time `json:"created,omitzero"`
+	Modified        time.Time `json:"modified,omitzero"`
+	Device          string    `json:"device,omitempty"`
+	// Stylus strokes and page background in the device, and the name of the rendered image
+	SvgPath string `json:"svg_path"`
+	JpgPath string `json:"jpg_path"`
+	Image   string `json:"image"`
+}
+
+// full includes the highlights and markups of the book, otherwise only their counts
+func NewJSONBook(bms *bookmark.Bookmarks, markPath string, full bool) *JSONBook {
+	book := &JSONBook{
+		Title:           bms.Book,
+		Author:          bms.Author,
+		ISBN:            bms.ISBN,
+		VolumeId:        bms.VolumeId,
+		ContentId:       bms.ContentId,
+		HighlightsCount: len(bms.Highlights),
+		MarkupsCount:    len(bms.Markups),
+	}
+	if !full {
+		return book
+	}
+
+	book.Highlights = []*JSONHighlight{}
+	for _, c := range Chapters(bms) {
+		for _, h := range c.Highlights {
+			book.Highlights = append(book.Highlights, newJSONHighlight(h))
+		}
+	}
+	book.Markups = []*JSONMarkup{}
+	for _, m := range bms.Marks() {
+		book.Markups = append(book.Markups, newJSONMarkup(m, markPath))
+	}
+	return book
+}
+
+func newJSONHighlight(h *bookmark.Highlight) *JSONHighlight {
+	return &JSONHighlight{
+		Id:              h.Id,
+		ContentId:       h.ContentId,
+		Section:         h.Section,
+		Location:        h.Location,
+		OrderId:         h.OrderId,
+		StartPath:       h.StartPath,
+		StartOffset:     h.StartOffset,
+		EndPath:         h.EndPath,
+		EndOffset:       h.EndOffset,
+		ChapterProgress: h.ChapterProgress,
+		Color:           h.Color(),
+		ColorName:       h.ColorName(h.Color()),
+		ColorTag:        h.ColorTag(h.Color()),
+		ColorLabel:      h.ColorLabel(h.Color()),
+		Text:            h.Text(),
+		Note:            h.Note,
+		Created:         h.Created,
+		Modified:        h.Modified,
+		Device:          h.Device,
+	}
+}
+
+func newJSONMarkup(m *bookmark.Markup, markPath string) *JSONMarkup {
+	return &JSONMarkup{
+		Id:              m.Id,
+		ContentId:       m.ContentId,
+		Section:         m.Section,
+		Location:        m.Location,
+		OrderId:         m.OrderId,
+		ChapterProgress: m.ChapterProgress,
+		Created:         m.Created,
+		Modified:        m.Modified,
+		Device:          m.Device,
+		SvgPath:         m.SvgFile(markPath),
+		JpgPath:         m.JpgFile(markPath),
+		Image:           m.Outfile(),
+	}
+}
+
+func WriteJSON(w io.Writer, all []*bookmark.Bookmarks, markPath string, full bool) error {
+	lib := JSONLibrary{
+		Schema:   "kme.library",
+		Version:  SCHEMA_VERSION,
+		Exported: time.Now(),
+		Books:    []*JSONBook{},
+	}
+	for _, bms := range all {
+		lib.Books = append(lib.Books, NewJSONBook(bms, markPath, full))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(lib); err != nil {
+		return fmt.Errorf("Error writing JSON: %w", err)
+	}
+	return nil
+}
+
+func WriteNDJSON(w io.Writer, all []*bookmark.Bookmarks, markPath string, full bool) error {
+	enc := json.NewEncoder(w)
+	for _, bms := range all {
+		book := NewJSONBook(bms, markPath, full)
+		highs, marks := book.Highlights, book.Markups
+		book.Highlights, book.Markups = nil, nil
+		book.Type, book.Version = "book", SCHEMA_VERSION
+
+		if err := enc.Encode(book); err != nil {
+			return fmt.Errorf("Error writing NDJSON for book %s: %w", bms.Book, err)
+		}
+		for _, h := range highs {
+			h.Type, h.Version, h.BookId, h.Book = bookmark.HIGHLIGHT, SCHEMA_VERSION, book.VolumeId, book.Title
+			if err := enc.Encode(h); err != nil {
+				return fmt.Errorf("Error writing NDJSON for book %s: %w", bms.Book, err)
+			}
+		}
+		for _, m := range marks {
+			m.Type, m.Version, m.BookId, m.Book = bookmark.MARKUP, SCHEMA_VERSION, book.VolumeId, book.Title
+			if err := enc.Encode(m); err != nil {
+				return fmt.Errorf("Error writing NDJSON for book %s: %w", bms.Book, err)
+			}
+		}
+	}
+	return nil
+}
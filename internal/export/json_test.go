@@ -0,0 +1,68 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"kme/internal/bookmark"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	bms, _ := testBook(t)
+	out := bytes.Buffer{}
+	if err := WriteJSON(&out, []*bookmark.Bookmarks{bms}, "/markups", true); err != nil {
+		t.Fatal(err)
+	}
+	lib := struct {
+		Schema  string `json:"schema"`
+		Version int    `json:"version"`
+		Books   []map[string]any
+	}{}
+	if err := json.Unmarshal(out.Bytes(), &lib); err != nil {
+		t.Fatal(err)
+	}
+	if lib.Schema != "kme.library" || lib.Version != SCHEMA_VERSION || len(lib.Books) != 1 {
+		t.Fatalf("Library = %+v", lib)
+	}
+	book := lib.Books[0]
+	if book["title"] != "Dune" || book["highlights_count"] != 3.0 || book["markups_count"] != 1.0 {
+		t.Errorf("Book = %v", book)
+	}
+	fear := book["highlights"].([]any)[1].(map[string]any)
+	for field, want := range map[string]any{
+		"id": "h2", "color": 1.0, "color_name": "red", "color_tag": "red", "text": "Fear is the mind-killer.",
+		"note": "Litany, \"against\" fear", "start_path": `span#kobo\.2.1`, "created": "2024-03-02T10:00:00Z",
+	} {
+		if fear[field] != want {
+			t.Errorf("Highlight %s = %v, want %v", field, fear[field], want)
+		}
+	}
+	markup := book["markups"].([]any)[0].(map[string]any)
+	if markup["image"] != "mk_22222222_ch2_1.1_4.000000.jpeg" || markup["svg_path"] == "" {
+		t.Errorf("Markup = %v", markup)
+	}
+}
+
+func TestWriteNDJSON(t *testing.T) {
+	bms, _ := testBook(t)
+	out := bytes.Buffer{}
+	if err := WriteNDJSON(&out, []*bookmark.Bookmarks{bms}, "/markups", true); err != nil {
+		t.Fatal(err)
+	}
+	types := []string{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		line := map[string]any{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Line is not JSON: %s", scanner.Text())
+		}
+		if line["version"] != float64(SCHEMA_VERSION) || (line["type"] != "book" && line["book"] != "Dune") {
+			t.Errorf("Line without its version or book: %v", line)
+		}
+		types = append(types, line["type"].(string))
+	}
+	if len(types) != 5 || types[0] != "book" || types[4] != bookmark.MARKUP {
+		t.Errorf("Line types = %v", types)
+	}
+}
@@ -0,0 +1,184 @@
+package export
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"kme/internal/bookmark"
+	"kme/internal/epub"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const koreaderTime = "2006-01-02 15:04:05"
+
+// KOReader keeps its settings for a book in a folder next to it, named as the book without its
+// last extension, e.g. Books/test.kepub.epub => Books/test.kepub.sdr/metadata.epub.lua
+func KOReaderSidecar(bookPath string) string {
+	ext := filepath.Ext(bookPath)
+	dir := strings.TrimSuffix(bookPath, ext) + ".sdr"
+	return filepath.Join(dir, fmt.Sprintf("metadata%s.lua", ext))
+}
+
+// Writes the highlights of a book as a KOReader sidecar file. KOReader anchors annotations with
+// CREngine XPointers, so as with Calibre highlights that can't be located in the book file are
+// skipped. docPath is the path of the book as KOReader sees it in the device (under /mnt/onboard).
+//
+// existing is the sidecar already next to the book, nil if there is none. Everything in it is kept
+// (reading position, settings...) and the highlights are merged into its annotations: the ones
+// KOReader already has, at the same position or with the same text, are left as they are
+func WriteKOReader(w io.Writer, bms *bookmark.Bookmarks, book *epub.Book, docPath string, existing []byte) (int, error) {
+	highs := slices.Clone(bms.Highlights)
+	slices.SortFunc(highs, func(a, b *bookmark.Highlight) int {
+		return cmp.Compare(a.OrderId, b.OrderId)
+	})
+
+	sidecar := &luaTable{}
+	if existing != nil {
+		var err error
+		if sidecar, err = parseLua(string(existing)); err != nil {
+			return 0, err
+		}
+		// KOReader only reads highlight and bookmarks when there are no annotations, adding them
+		// would hide those
+		if sidecar.get("annotations") == nil && (sidecar.get("highlight") != nil || sidecar.get("bookmarks") != nil) {
+			return 0, fmt.Errorf("KOReader sidecar in an old format, open the book once in KOReader to update it")
+		}
+	}
+	annotations, ok := sidecar.get("annotations").(*luaTable)
+	if !ok {
+		annotations = &luaTable{}
+		sidecar.set("annotations", annotations)
+	}
+	merged := annotations.list()
+
+	skipped := 0
+	for _, h := range highs {
+		start, err := book.Locate(h.ChapterHref(), h.StartPath, h.StartOffset)
+		if err != nil {
+			skipped++
+			continue
+		}
+		end, err := book.Locate(h.ChapterHref(), h.EndPath, h.EndOffset)
+		if err != nil {
+			end = start
+		}
+		if hasAnnotation(merged, start.XPointer(), h.Text()) {
+			continue
+		}
+
+		a := &luaTable{}
+		a.set("chapter", h.Section)
+		a.set("color", h.KoboColorName(h.Color()))
+		a.set("datetime", koreaderDate(h.Created))
+		a.set("datetime_updated", koreaderDate(h.Modified))
+		a.set("drawer", "lighten")
+		if h.Note != "" {
+			a.set("note", h.Note)
+		}
+		a.set("page", start.XPointer())
+		a.set("pos0", start.XPointer())
+		a.set("pos1", end.XPointer())
+		a.set("text", h.Text())
+
+		// KOReader keeps them in reading order
+		at := slices.IndexFunc(merged, func(v any) bool {
+			other, ok := v.(*luaTable)
+			return ok && compareXPointers(other.str("page"), start.XPointer()) > 0
+		})
+		if at < 0 {
+			at = len(merged)
+		}
+		merged = slices.Insert(merged, at, any(a))
+	}
+	annotations.setList(merged)
+
+	if sidecar.get("doc_path") == nil {
+		sidecar.set("doc_path", docPath)
+	}
+	if sidecar.get("doc_props") == nil {
+		props := &luaTable{}
+		props.set("authors", bms.Author)
+		props.set("title", bms.Book)
+		sidecar.set("doc_props", props)
+	}
+
+	if _, err := io.WriteString(w, sidecar.String()); err != nil {
+		return skipped, fmt.Errorf("Error writing KOReader sidecar for book %s: %w", bms.Book, err)
+	}
+	return skipped, nil
+}
+
+// Whether KOReader already has an annotation at that position, or with that text in the same
+// chapter, where it may start a few characters away. The same text elsewhere is another highlight
+func hasAnnotation(annotations []any, pos0 string, text string) bool {
+	text = strings.TrimSpace(text)
+	return slices.ContainsFunc(annotations, func(v any) bool {
+		a, ok := v.(*luaTable)
+		if !ok {
+			return false
+		}
+		if a.str("pos0") == pos0 {
+			return true
+		}
+		return text != "" && strings.TrimSpace(a.str("text")) == text &&
+			xpointerFragment(a.str("pos0")) != "" && xpointerFragment(a.str("pos0")) == xpointerFragment(pos0)
+	})
+}
+
+var xpointerFragmentRgx = regexp.MustCompile(`^/body/DocFragment\[\d+\]`)
+
+// The chapter part of an XPointer, e.g. /body/DocFragment[3]
+func xpointerFragment(x string) string {
+	return xpointerFragmentRgx.FindString(x)
+}
+
+var xpointerStepRgx = regexp.MustCompile(`^(.*?)(?:\[(\d+)\])?$`)
+
+// Orders two XPointers by where they point in the book, step by step and then by the offset in
+// the text. Anything that isn't an XPointer (e.g. page numbers of PDFs) compares as equal
+func compareXPointers(a, b string) int {
+	if !strings.HasPrefix(a, "/") || !strings.HasPrefix(b, "/") {
+		return 0
+	}
+	split := func(x string) ([]string, int) {
+		offset := 0
+		if i := strings.LastIndex(x, "."); i > strings.LastIndex(x, "/") {
+			offset, _ = strconv.Atoi(x[i+1:])
+			x = x[:i]
+		}
+		return strings.Split(strings.Trim(x, "/"), "/"), offset
+	}
+	stepsA, offsetA := split(a)
+	stepsB, offsetB := split(b)
+	for i := 0; i < min(len(stepsA), len(stepsB)); i++ {
+		ma, mb := xpointerStepRgx.FindStringSubmatch(stepsA[i]), xpointerStepRgx.FindStringSubmatch(stepsB[i])
+		indexA, indexB := 1, 1
+		if ma[2] != "" {
+			indexA, _ = strconv.Atoi(ma[2])
+		}
+		if mb[2] != "" {
+			indexB, _ = strconv.Atoi(mb[2])
+		}
+		if c := cmp.Or(cmp.Compare(indexA, indexB), strings.Compare(ma[1], mb[1])); c != 0 {
+			return c
+		}
+	}
+	return cmp.Or(cmp.Compare(len(stepsA), len(stepsB)), cmp.Compare(offsetA, offsetB))
+}
+
+func luaString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\x00", `\0`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func koreaderDate(t time.Time) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.Local().Format(koreaderTime)
+}
@@ -0,0 +1,101 @@
+package export
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestKOReaderMerge(t *testing.T) {
+	bms, book := testBook(t)
+	existing := `-- we can read Lua syntax here!
+return {
+    ["annotations"] = {
+        [1] = {
+            ["datetime"] = "2024-01-01 10:00:00",
+            ["pos0"] = "/body/DocFragment[1]/body/p[2]/span[1]/text().0",
+            ["page"] = "/body/DocFragment[1]/body/p[2]/span[1]/text().0",
+            ["text"] = "Fear is the mind-killer.",
+            ["note"] = "written in KOReader",
+        },
+        [2] = {
+            ["page"] = "/body/DocFragment[2]/body/p[1]/span[1]/text().10",
+            ["text"] = "must flow",
+        },
+        [3] = {
+            ["page"] = "/body/DocFragment[2]/body/p[2]/text().0",
+            ["pos0"] = "/body/DocFragment[2]/body/p[2]/text().0",
+            ["text"] = "A beginning is the time.",
+        },
+    },
+    ["last_xpointer"] = "/body/DocFragment[2]/body/p[1]/text().0",
+    ["percent_finished"] = 0.42,
+    ["summary"] = {
+        ["status"] = "reading",
+    },
+}
+`
+	out := bytes.Buffer{}
+	if _, err := WriteKOReader(&out, bms, book, "/mnt/onboard/Books/dune.epub", []byte(existing)); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := parseLua(out.String())
+	if err != nil {
+		t.Fatalf("Could not read the merged sidecar back: %v\n%s", err, out.String())
+	}
+
+	if merged.get("percent_finished") != luaNumber("0.42") || merged.str("last_xpointer") == "" {
+		t.Errorf("Reading state was not kept:\n%s", out.String())
+	}
+	texts := []string{}
+	for _, a := range merged.get("annotations").(*luaTable).list() {
+		texts = append(texts, a.(*luaTable).str("text"))
+	}
+	// the litany was already there, the others go around the KOReader ones in reading order. The
+	// same words in another chapter are another highlight
+	want := []string{"A beginning is the time.", "Fear is the mind-killer.", "The spice must flow.", "must flow", "A beginning is the time."}
+	if strings.Join(texts, "|") != strings.Join(want, "|") {
+		t.Errorf("Annotations = %q, want %q", texts, want)
+	}
+	if !strings.Contains(out.String(), `"written in KOReader"`) || merged.get("doc_props") == nil {
+		t.Errorf("Existing annotation changed or doc_props missing:\n%s", out.String())
+	}
+
+	old := `return { ["highlight"] = { [1] = {} } }`
+	if _, err := WriteKOReader(&out, bms, book, "", []byte(old)); err == nil {
+		t.Errorf("Expected an error merging into an old format sidecar")
+	}
+}
+
+func TestParseLua(t *testing.T) {
+	table, err := parseLua("--[[ header ]] return { a = 1, [\"b\\\\\"] = 'it\\'s\\\nok', {true, -2.5e3}; nested = { x = nil } }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.get("a") != luaNumber("1") || table.str(`b\`) != "it's\nok" {
+		t.Errorf("Table = %+v", table.entries)
+	}
+	inner := table.get(1).(*luaTable)
+	if inner.get(1) != true || inner.get(2) != luaNumber("-2.5e3") {
+		t.Errorf("Array = %+v", inner.entries)
+	}
+}
+
+func TestParseLuaTruncated(t *testing.T) {
+	for _, s := range []string{
+		"return {",
+		"return { a = 1,",
+		"return { a = 1",
+		"return { [\"a\"] =",
+		"return { [\"a\"",
+		"return { { 1, 2 }",
+		"return { \"unfinished",
+		"return { [[long",
+		"return",
+		"",
+	} {
+		if _, err := parseLua(s); err == nil {
+			t.Errorf("parseLua(%q) should fail", s)
+		}
+	}
+}
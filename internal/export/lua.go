@@ -0,0 +1,317 @@
+package export
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A Lua table as KOReader writes them in its sidecar files. Entries keep the order they were read
+// in, so writing the table back only changes what we touched
+type luaTable struct {
+	entries []luaEntry
+}
+
+type luaEntry struct {
+	// string, int or luaNumber
+	key any
+	// string, luaNumber, bool or *luaTable
+	value any
+}
+
+// Numbers are kept as written, so they come back out exactly the same
+type luaNumber string
+
+var luaNumberRgx = regexp.MustCompile(`^-?(0[xX][0-9a-fA-F]+|(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?)`)
+
+func (self *luaTable) get(key any) any {
+	for _, e := range self.entries {
+		if e.key == key {
+			return e.value
+		}
+	}
+	return nil
+}
+
+// Replaces the value of key, or adds it at the end
+func (self *luaTable) set(key any, value any) {
+	for i, e := range self.entries {
+		if e.key == key {
+			self.entries[i].value = value
+			return
+		}
+	}
+	self.entries = append(self.entries, luaEntry{key, value})
+}
+
+func (self *luaTable) str(key string) string {
+	s, _ := self.get(key).(string)
+	return s
+}
+
+// The values with integer keys, the array part of the table
+func (self *luaTable) list() []any {
+	values := []any{}
+	for _, e := range self.entries {
+		if _, ok := e.key.(int); ok {
+			values = append(values, e.value)
+		}
+	}
+	return values
+}
+
+// Replaces the array part of the table with values, numbered from 1
+func (self *luaTable) setList(values []any) {
+	entries := []luaEntry{}
+	for _, e := range self.entries {
+		if _, ok := e.key.(int); !ok {
+			entries = append(entries, e)
+		}
+	}
+	for i, v := range values {
+		entries = append(entries, luaEntry{i + 1, v})
+	}
+	self.entries = entries
+}
+
+// Writes the table the way KOReader does, as a Lua chunk returning it
+func (self *luaTable) String() string {
+	b := strings.Builder{}
+	b.WriteString("-- we can read Lua syntax here!\nreturn ")
+	self.write(&b, 0)
+	b.WriteString("\n")
+	return b.String()
+}
+
+func (self *luaTable) write(b *strings.Builder, depth int) {
+	b.WriteString("{\n")
+	indent := strings.Repeat("    ", depth+1)
+	for _, e := range self.entries {
+		switch k := e.key.(type) {
+		case string:
+			fmt.Fprintf(b, "%s[%s] = ", indent, luaString(k))
+		default:
+			fmt.Fprintf(b, "%s[%v] = ", indent, k)
+		}
+		switch v := e.value.(type) {
+		case *luaTable:
+			v.write(b, depth+1)
+		case string:
+			b.WriteString(luaString(v))
+		default:
+			fmt.Fprintf(b, "%v", v)
+		}
+		b.WriteString(",\n")
+	}
+	b.WriteString(strings.Repeat("    ", depth) + "}")
+}
+
+// Reads a Lua chunk returning a table literal, which is all a KOReader sidecar is
+func parseLua(s string) (*luaTable, error) {
+	p := &luaParser{s: s}
+	p.space()
+	if !p.consume("return") {
+		return nil, fmt.Errorf("Not a KOReader sidecar, it doesn't return a table")
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	table, ok := v.(*luaTable)
+	if !ok {
+		return nil, fmt.Errorf("Not a KOReader sidecar, it doesn't return a table")
+	}
+	return table, nil
+}
+
+type luaParser struct {
+	s string
+	i int
+}
+
+func (self *luaParser) errorf(format string, args ...any) error {
+	line := strings.Count(self.s[:self.i], "\n") + 1
+	return fmt.Errorf("Could not read Lua at line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// Skips blanks and comments
+func (self *luaParser) space() {
+	for self.i < len(self.s) {
+		switch {
+		case strings.ContainsRune(" \t\r\n", rune(self.s[self.i])):
+			self.i++
+		case strings.HasPrefix(self.s[self.i:], "--[["):
+			end := strings.Index(self.s[self.i:], "]]")
+			if end < 0 {
+				self.i = len(self.s)
+			} else {
+				self.i += end + 2
+			}
+		case strings.HasPrefix(self.s[self.i:], "--"):
+			end := strings.IndexByte(self.s[self.i:], '\n')
+			if end < 0 {
+				self.i = len(self.s)
+			} else {
+				self.i += end + 1
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (self *luaParser) consume(token string) bool {
+	if strings.HasPrefix(self.s[self.i:], token) {
+		self.i += len(token)
+		self.space()
+		return true
+	}
+	return false
+}
+
+func (self *luaParser) value() (any, error) {
+	self.space()
+	if self.i >= len(self.s) {
+		return nil, self.errorf("unexpected end")
+	}
+	rest := self.s[self.i:]
+	switch {
+	case rest[0] == '{':
+		return self.table()
+	case rest[0] == '"' || rest[0] == '\'':
+		return self.str()
+	case strings.HasPrefix(rest, "[["):
+		end := strings.Index(rest[2:], "]]")
+		if end < 0 {
+			return nil, self.errorf("unfinished long string")
+		}
+		self.i += end + 4
+		self.space()
+		return strings.TrimPrefix(rest[2:end+2], "\n"), nil
+	case self.consume("true"):
+		return true, nil
+	case self.consume("false"):
+		return false, nil
+	case self.consume("nil"):
+		return nil, nil
+	}
+	if n := luaNumberRgx.FindString(rest); n != "" {
+		self.i += len(n)
+		self.space()
+		return luaNumber(n), nil
+	}
+	return nil, self.errorf("unexpected %q", rest[:min(len(rest), 10)])
+}
+
+func (self *luaParser) table() (*luaTable, error) {
+	self.i++
+	self.space()
+	table := &luaTable{}
+	n := 0
+	for !self.consume("}") {
+		if self.i >= len(self.s) {
+			return nil, self.errorf("unexpected end of table")
+		}
+		var key any
+		switch {
+		case self.s[self.i] == '[' && !strings.HasPrefix(self.s[self.i:], "[["):
+			self.i++
+			k, err := self.value()
+			if err != nil {
+				return nil, err
+			}
+			if !self.consume("]") || !self.consume("=") {
+				return nil, self.errorf("expected ] =")
+			}
+			key = k
+			if num, ok := k.(luaNumber); ok {
+				if i, err := strconv.Atoi(string(num)); err == nil {
+					key = i
+				}
+			}
+		default:
+			if name := luaNameRgx.FindString(self.s[self.i:]); name != "" && !luaKeywords[name] {
+				save := self.i
+				self.i += len(name)
+				self.space()
+				if self.consume("=") && !strings.HasPrefix(self.s[self.i:], "=") {
+					key = name
+				} else {
+					self.i = save
+				}
+			}
+		}
+		value, err := self.value()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			n++
+			key = n
+		}
+		if value != nil {
+			table.entries = append(table.entries, luaEntry{key, value})
+		}
+		if !self.consume(",") && !self.consume(";") {
+			if !self.consume("}") {
+				return nil, self.errorf("expected , or }")
+			}
+			break
+		}
+	}
+	return table, nil
+}
+
+var (
+	luaNameRgx  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*`)
+	luaKeywords = map[string]bool{"true": true, "false": true, "nil": true}
+	luaEscapes  = map[byte]byte{'n': '\n', 't': '\t', 'r': '\r', 'a': '\a', 'b': '\b', 'f': '\f', 'v': '\v', '\n': '\n'}
+)
+
+func (self *luaParser) str() (string, error) {
+	quote := self.s[self.i]
+	self.i++
+	b := strings.Builder{}
+	for self.i < len(self.s) {
+		c := self.s[self.i]
+		self.i++
+		switch {
+		case c == quote:
+			self.space()
+			return b.String(), nil
+		case c == '\\' && self.i < len(self.s):
+			e := self.s[self.i]
+			self.i++
+			switch {
+			case luaEscapes[e] != 0:
+				b.WriteByte(luaEscapes[e])
+			case e >= '0' && e <= '9':
+				// \ddd, up to three decimal digits
+				end := self.i - 1
+				for end < len(self.s) && end < self.i+2 && self.s[end] >= '0' && self.s[end] <= '9' {
+					end++
+				}
+				code, _ := strconv.Atoi(self.s[self.i-1 : end])
+				b.WriteByte(byte(code))
+				self.i = end
+			case e == 'x' && self.i+2 <= len(self.s):
+				code, err := strconv.ParseUint(self.s[self.i:self.i+2], 16, 8)
+				if err != nil {
+					return "", self.errorf("bad escape \\x%s", self.s[self.i:self.i+2])
+				}
+				b.WriteByte(byte(code))
+				self.i += 2
+			case e == 'z':
+				for self.i < len(self.s) && strings.ContainsRune(" \t\r\n", rune(self.s[self.i])) {
+					self.i++
+				}
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", self.errorf("unfinished string")
+}
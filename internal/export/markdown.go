@@ -0,0 +1,117 @@
+package export
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"kme/internal/bookmark"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//go:embed templates/*.tmpl
+var templatesFS embed.FS
+
+var slugRgx = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// What the Markdown templates get as ".". Besides the book metadata, Chapters has the highlights
+// grouped by section, Highlights all of them in reading order and Markups the handwritten ones, also
+// in reading order. MarkupFiles has where to find each markup, by id, if anywhere
+type BookView struct {
+	Book        string
+	Author      string
+	ISBN        string
+	Exported    time.Time
+	Chapters    []*Chapter
+	Highlights  []*bookmark.Highlight
+	Markups     []*bookmark.Markup
+	MarkupFiles MarkupFiles
+}
+
+func NewBookView(bms *bookmark.Bookmarks) *BookView {
+	chapters := Chapters(bms)
+	highs := []*bookmark.Highlight{}
+	for _, c := range chapters {
+		highs = append(highs, c.Highlights...)
+	}
+	return &BookView{
+		Book:       bms.Book,
+		Author:     bms.Author,
+		ISBN:       bms.ISBN,
+		Exported:   time.Now().Local(),
+		Chapters:   chapters,
+		Highlights: highs,
+		Markups:    sortedMarkups(bms),
+	}
+}
+
+// Helpers available in the templates:
+//   - date: formats a time with a Go layout, empty for unknown dates. {{ date .Created "2006-01-02" }}
+//   - slug: lowercase, dash separated version of a text. {{ slug .Book }}
+//   - colorName / colorEmoji: name or emoji square for a Kobo color code. {{ colorName .Color }}
+//   - koboColorName: name of the color in the Kobo, even if renamed in the config
+//   - colorTag / colorLabel: tag (without #) and heading of the color, from its meaning in the config
+//   - colorMeant: whether the config gives the color a tag or label, not just a name
+//   - quote: prefixes every line with "> " so multi-line highlights stay in the blockquote
+//   - trim: strings.TrimSpace
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"date": func(t time.Time, layout string) string {
+			if t.IsZero() {
+				return ""
+			}
+			return t.Local().Format(layout)
+		},
+		"slug": func(s string) string {
+			return strings.Trim(slugRgx.ReplaceAllString(strings.ToLower(s), "-"), "-")
+		},
+		"colorName": func(code int) string {
+			return (&bookmark.Highlight{}).ColorName(code)
+		},
+		"koboColorName": func(code int) string {
+			return (&bookmark.Highlight{}).KoboColorName(code)
+		},
+		"colorTag": func(code int) string {
+			return (&bookmark.Highlight{}).ColorTag(code)
+		},
+		"colorLabel": func(code int) string {
+			return (&bookmark.Highlight{}).ColorLabel(code)
+		},
+		"colorMeant": func(code int) bool {
+			m, _ := (&bookmark.Highlight{}).ColorMeaning(code)
+			return m.Tag != "" || m.Label != ""
+		},
+		"colorEmoji": func(code int) string {
+			return string((&bookmark.Highlight{}).Colors(code))
+		},
+		"quote": func(s string) string {
+			return "> " + strings.ReplaceAll(strings.TrimSpace(s), "\n", "\n> ")
+		},
+		"trim": strings.TrimSpace,
+	}
+}
+
+// Loads the user template from tmplPath, or the default one if empty
+func MarkdownTemplate(tmplPath string) (*template.Template, error) {
+	if tmplPath == "" {
+		return template.New("markdown.tmpl").Funcs(TemplateFuncs()).ParseFS(templatesFS, "templates/markdown.tmpl")
+	}
+	tmpl, err := template.New(filepath.Base(tmplPath)).Funcs(TemplateFuncs()).ParseFiles(tmplPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load template %s: %w", tmplPath, err)
+	}
+	return tmpl, nil
+}
+
+// Markups link to their file in files, if they have one
+func WriteMarkdown(w io.Writer, bms *bookmark.Bookmarks, tmpl *template.Template, files MarkupFiles) error {
+	view := NewBookView(bms)
+	view.MarkupFiles = files
+	if err := tmpl.Execute(w, view); err != nil {
+		return fmt.Errorf("Error writing Markdown for book %s: %w", bms.Book, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"kme/internal/bookmark"
+	"regexp"
+	"strings"
+)
+
+const orgHeadlineLen = 60
+
+var (
+	orgTagRgx = regexp.MustCompile(`[^\p{L}\p{N}_@#%]`)
+	// brackets would end the link
+	orgLinkEscaper = strings.NewReplacer("[", `\[`, "]", `\]`)
+)
+
+// Writes a book as an Org file: chapters as headlines, a headline per highlight tagged with its
+// color and with its Kobo IDs and color as properties (so re-exports can be merged by ID), the text in a quote block and
+// the note as body. Markups link to their file in files, if they have one
+func WriteOrg(w io.Writer, bms *bookmark.Bookmarks, files MarkupFiles) error {
+	b := strings.Builder{}
+	// Org only reads the file properties when the drawer is the first thing in the file
+	b.WriteString(":PROPERTIES:\n")
+	orgProperty(&b, "KOBO_VOLUME_ID", bms.VolumeId)
+	orgProperty(&b, "ISBN", bms.ISBN)
+	b.WriteString(":END:\n")
+	fmt.Fprintf(&b, "#+TITLE: %s\n", bms.Book)
+	if bms.Author != "" {
+		fmt.Fprintf(&b, "#+AUTHOR: %s\n", bms.Author)
+	}
+
+	for _, c := range Chapters(bms) {
+		fmt.Fprintf(&b, "\n* %s\n", c.Section)
+		for _, h := range c.Highlights {
+			fmt.Fprintf(&b, "** %s :%s:\n", orgHeadline(h.Text()), orgTag(h.ColorTag(h.Color())))
+			b.WriteString(":PROPERTIES:\n")
+			orgProperty(&b, "ID", h.Id)
+			orgProperty(&b, "KOBO_BOOKMARK_ID", h.Id)
+			orgProperty(&b, "KOBO_COLOR", h.ColorName(h.Color()))
+			orgProperty(&b, "KOBO_LOCATION", fmt.Sprintf("%s.%s", h.Section, h.Location))
+			if !h.Created.IsZero() {
+				orgProperty(&b, "CREATED", h.Created.Local().Format("[2006-01-02 Mon 15:04]"))
+			}
+			b.WriteString(":END:\n")
+			b.WriteString("#+BEGIN_QUOTE\n")
+			b.WriteString(orgEscape(h.Text()))
+			b.WriteString("\n#+END_QUOTE\n")
+			if h.Note != "" {
+				b.WriteString(orgEscape(h.Note))
+				b.WriteString("\n")
+			}
+		}
+	}
+
+	if marks := sortedMarkups(bms); len(marks) > 0 {
+		b.WriteString("\n* Markups\n")
+		for _, m := range marks {
+			fmt.Fprintf(&b, "** %s/%s\n", m.Section, m.Location)
+			b.WriteString(":PROPERTIES:\n")
+			orgProperty(&b, "ID", m.Id)
+			orgProperty(&b, "KOBO_BOOKMARK_ID", m.Id)
+			b.WriteString(":END:\n")
+			if f := files[m.Id]; f != "" {
+				fmt.Fprintf(&b, "[[file:%s]]\n", orgLinkEscaper.Replace(f))
+			}
+		}
+	}
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("Error writing Org file for book %s: %w", bms.Book, err)
+	}
+	return nil
+}
+
+func orgProperty(b *strings.Builder, key string, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Fprintf(b, ":%s: %s\n", key, value)
+}
+
+// First words of the highlight, in a single line
+func orgHeadline(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= orgHeadlineLen {
+		return text
+	}
+	return strings.TrimSpace(string(runes[:orgHeadlineLen])) + "…"
+}
+
+// Org tags only take letters, numbers and _@#%
+func orgTag(tag string) string {
+	return orgTagRgx.ReplaceAllString(tag, "_")
+}
+
+// Lines starting with "*" or "#+" would be read as headlines or keywords, Org escapes them with ","
+// (and the ones already starting with the escaped version, so they survive unescaping)
+func orgEscape(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	for i, l := range lines {
+		unescaped := strings.TrimPrefix(l, ",")
+		if strings.HasPrefix(unescaped, "*") || strings.HasPrefix(unescaped, "#+") {
+			lines[i] = "," + l
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,91 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"kme/internal/bookmark"
+	"maps"
+	"os"
+	"slices"
+)
+
+const DEFAULT_PALETTE = "kobo"
+
+// CSS background and font color for a highlight
+type Swatch struct {
+	Background string `json:"background"`
+	Font       string `json:"font"`
+}
+
+// Swatch for each Kobo color code
+type Palette map[int]Swatch
+
+var palettes = map[string]Palette{
+	// Close to what the Libra Colour shows
+	"kobo": {
+		0: {Background: "#fbe38e", Font: "#1f1f1f"},
+		1: {Background: "#f4a3a3", Font: "#1f1f1f"},
+		2: {Background: "#a9cbf0", Font: "#1f1f1f"},
+		3: {Background: "#b5e0a6", Font: "#1f1f1f"},
+	},
+	"pastel": {
+		0: {Background: "#fff6d5", Font: "#5c4b00"},
+		1: {Background: "#fde2e2", Font: "#6b1d1d"},
+		2: {Background: "#e1efff", Font: "#123d6b"},
+		3: {Background: "#e4f6e0", Font: "#1f4d16"},
+	},
+	// For dark backgrounds, the color goes to the font instead
+	"dark": {
+		0: {Background: "#2b2b2b", Font: "#f5d76e"},
+		1: {Background: "#2b2b2b", Font: "#f28b82"},
+		2: {Background: "#2b2b2b", Font: "#8ab4f8"},
+		3: {Background: "#2b2b2b", Font: "#81c995"},
+	},
+}
+
+func PaletteNames() []string {
+	return slices.Sorted(maps.Keys(palettes))
+}
+
+// A built-in palette by name, or a JSON file with the swatches by color name, e.g.
+// {"yellow": {"background": "#ffeeaa", "font": "#000"}, ...}. Missing colors are taken from the
+// default palette
+func LoadPalette(nameOrPath string) (Palette, error) {
+	if p, ok := palettes[nameOrPath]; ok {
+		return withColorCSS(maps.Clone(p)), nil
+	}
+
+	data, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown palette %s, must be one of %v or a JSON file", nameOrPath, PaletteNames())
+	}
+	byName := map[string]Swatch{}
+	if err := json.Unmarshal(data, &byName); err != nil {
+		return nil, fmt.Errorf("Could not parse palette %s: %w", nameOrPath, err)
+	}
+
+	palette := maps.Clone(palettes[DEFAULT_PALETTE])
+	h := &bookmark.Highlight{}
+	for code := range palette {
+		if sw, ok := byName[h.KoboColorName(code)]; ok {
+			palette[code] = sw
+		}
+		// colors renamed in the config work too
+		if sw, ok := byName[h.ColorName(code)]; ok {
+			palette[code] = sw
+		}
+	}
+	return withColorCSS(palette), nil
+}
+
+// The CSS colors given in the config win over the palette ones
+func withColorCSS(palette Palette) Palette {
+	h := &bookmark.Highlight{}
+	for code, sw := range palette {
+		if css := h.ColorCSS(code); css != "" {
+			sw.Background = css
+			palette[code] = sw
+		}
+	}
+	return palette
+}
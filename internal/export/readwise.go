@@ -0,0 +1,63 @@
+package export
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"kme/internal/bookmark"
+	"math"
+	"slices"
+)
+
+const readwiseTime = "2006-01-02 15:04:05"
+
+var readwiseHeader = []string{"Highlight", "Title", "Author", "URL", "Note", "Location", "Date"}
+
+// Writes the highlights of all the books in the CSV layout Readwise takes for manual imports.
+// Readwise wants an integer location, so the OrderId (which already sorts by chapter and then
+// location, see bookmark.sectionOrder) is scaled to keep its decimals. The color goes as an inline
+// tag in the note, which is the way Readwise reads tags from imports
+func WriteReadwiseCSV(w io.Writer, all []*bookmark.Bookmarks) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(readwiseHeader); err != nil {
+		return fmt.Errorf("Error writing Readwise CSV: %w", err)
+	}
+
+	for _, bms := range all {
+		highs := slices.Clone(bms.Highlights)
+		slices.SortFunc(highs, func(a, b *bookmark.Highlight) int {
+			return cmp.Compare(a.OrderId, b.OrderId)
+		})
+
+		for _, h := range highs {
+			if h.Text() == "" {
+				continue
+			}
+			note := "." + h.ColorTag(h.Color())
+			if h.Note != "" {
+				note += " " + h.Note
+			}
+			date := ""
+			if !h.Created.IsZero() {
+				date = h.Created.Format(readwiseTime)
+			}
+
+			record := []string{
+				h.Text(),
+				bms.Book,
+				bms.Author,
+				"",
+				note,
+				fmt.Sprintf("%d", int64(math.Round(h.OrderId*10000))),
+				date,
+			}
+			if err := cw.Write(record); err != nil {
+				return fmt.Errorf("Error writing Readwise CSV for book %s: %w", bms.Book, err)
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,35 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"kme/internal/bookmark"
+	"testing"
+)
+
+func TestReadwiseQuoting(t *testing.T) {
+	bms, _ := testBook(t)
+	tricky := bookmark.NewHighlight("He said \"no\", then\nleft", 3)
+	tricky.Id, tricky.OrderId, tricky.Note = "h4", 5, "commas, \"quotes\"\nand lines"
+	bms.Highlights = append(bms.Highlights, tricky)
+
+	out := bytes.Buffer{}
+	if err := WriteReadwiseCSV(&out, []*bookmark.Bookmarks{bms}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("\"He said \"\"no\"\", then\nleft\",Dune,Frank Herbert,")) {
+		t.Errorf("Highlight not quoted as CSV wants it:\n%s", out.String())
+	}
+
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 || records[0][0] != "Highlight" {
+		t.Fatalf("Got %d records, want the header and 4 highlights", len(records))
+	}
+	last := records[4]
+	if last[0] != tricky.Text() || last[4] != ".green commas, \"quotes\"\nand lines" || last[5] != "50000" {
+		t.Errorf("Record = %q", last)
+	}
+}
@@ -0,0 +1,44 @@
+-- we can read Lua syntax here!
+return {
+    ["annotations"] = {
+        [1] = {
+            ["chapter"] = "ch1",
+            ["color"] = "yellow",
+            ["datetime"] = "2024-03-02 10:00:00",
+            ["datetime_updated"] = "2024-03-02 10:00:00",
+            ["drawer"] = "lighten",
+            ["page"] = "/body/DocFragment[1]/body/p[1]/span[1]/text().0",
+            ["pos0"] = "/body/DocFragment[1]/body/p[1]/span[1]/text().0",
+            ["pos1"] = "/body/DocFragment[1]/body/p[1]/span[1]/text().4",
+            ["text"] = "A beginning is the time.",
+        },
+        [2] = {
+            ["chapter"] = "ch1",
+            ["color"] = "red",
+            ["datetime"] = "2024-03-02 10:00:00",
+            ["datetime_updated"] = "2024-03-02 10:00:00",
+            ["drawer"] = "lighten",
+            ["note"] = "Litany, \"against\" fear",
+            ["page"] = "/body/DocFragment[1]/body/p[2]/span[1]/text().0",
+            ["pos0"] = "/body/DocFragment[1]/body/p[2]/span[1]/text().0",
+            ["pos1"] = "/body/DocFragment[1]/body/p[2]/span[1]/text().4",
+            ["text"] = "Fear is the mind-killer.",
+        },
+        [3] = {
+            ["chapter"] = "ch2",
+            ["color"] = "blue",
+            ["datetime"] = "2024-03-02 10:00:00",
+            ["datetime_updated"] = "2024-03-02 10:00:00",
+            ["drawer"] = "lighten",
+            ["page"] = "/body/DocFragment[2]/body/p[1]/span[1]/text().0",
+            ["pos0"] = "/body/DocFragment[2]/body/p[1]/span[1]/text().0",
+            ["pos1"] = "/body/DocFragment[2]/body/p[1]/span[1]/text().4",
+            ["text"] = "The spice must flow.",
+        },
+    },
+    ["doc_path"] = "/mnt/onboard/Books/dune.epub",
+    ["doc_props"] = {
+        ["authors"] = "Frank Herbert",
+        ["title"] = "Dune",
+    },
+}
@@ -0,0 +1,245 @@
+package search
+
+import (
+	"database/sql"
+	"fmt"
+	"kme/internal/bookmark"
+	"strings"
+	"time"
+	"unicode"
+
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+CREATE TABLE entries (
+	id TEXT NOT NULL,
+	book TEXT NOT NULL,
+	author TEXT,
+	section TEXT,
+	location TEXT,
+	order_id REAL,
+	chapter_progress REAL,
+	color INTEGER,
+	created TEXT
+);
+CREATE VIRTUAL TABLE fts USING fts5(text, note, book, tokenize = 'unicode61 remove_diacritics 2');
+`
+
+// Weights of the text, note and book columns when ranking, a match in the highlight matters most
+const rankWeights = "10.0, 5.0, 1.0"
+
+// In memory full-text index of the highlights and notes of a library. It's quick enough to build on
+// every search, so it never goes stale
+type Index struct {
+	db *sql.DB
+}
+
+type Filter struct {
+	// Part of the book title, case insensitive
+	Book   string
+	Colors []int
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+type Result struct {
+	Id              string    `json:"id"`
+	Book            string    `json:"book"`
+	Author          string    `json:"author"`
+	Section         string    `json:"section"`
+	Location        string    `json:"location"`
+	ChapterProgress float64   `json:"chapter_progress"`
+	Color           int       `json:"color"`
+	ColorName       string    `json:"color_name"`
+	Text            string    `json:"text"`
+	Note            string    `json:"note"`
+	Created         time.Time `json:"created,omitzero"`
+	// Highlight text around the matches, which are between [ and ]
+	Snippet string `json:"snippet"`
+	// Lower is better, as FTS5 bm25
+	Rank float64 `json:"rank"`
+}
+
+func NewIndex(all []*bookmark.Bookmarks) (*Index, error) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, fmt.Errorf("Could not create search index: %w", err)
+	}
+	// every connection would get its own empty memory DB
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not create search index: %w", err)
+	}
+
+	idx := &Index{db: db}
+	if err := idx.add(all); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (self *Index) Close() error {
+	return self.db.Close()
+}
+
+func (self *Index) add(all []*bookmark.Bookmarks) error {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not build search index: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, bms := range all {
+		for _, h := range bms.Highlights {
+			res, err := tx.Exec(`
+			INSERT INTO entries (id, book, author, section, location, order_id, chapter_progress, color, created)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)
+			`, h.Id, bms.Book, bms.Author, h.Section, h.Location, h.OrderId, h.ChapterProgress, h.Color(),
+				formatTime(h.Created))
+			if err != nil {
+				return fmt.Errorf("Could not index highlight %s: %w", h.Id, err)
+			}
+			rowId, _ := res.LastInsertId()
+			_, err = tx.Exec(
+				`INSERT INTO fts (rowid, text, note, book) VALUES (?1, ?2, ?3, ?4)`,
+				rowId, h.Text(), h.Note, bms.Book,
+			)
+			if err != nil {
+				return fmt.Errorf("Could not index highlight %s: %w", h.Id, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Could not build search index: %w", err)
+	}
+	return nil
+}
+
+// Searches highlights, notes and book titles, best matches first. See Query for the syntax
+func (self *Index) Search(query string, filter Filter) ([]*Result, error) {
+	match := Query(query)
+	if match == "" {
+		return nil, fmt.Errorf("Nothing to search for")
+	}
+
+	where := []string{"fts MATCH ?"}
+	args := []any{match}
+	if filter.Book != "" {
+		where = append(where, "e.book LIKE ?")
+		args = append(args, "%"+filter.Book+"%")
+	}
+	if len(filter.Colors) > 0 {
+		where = append(where, fmt.Sprintf("e.color IN (%s)", placeholders(len(filter.Colors))))
+		for _, c := range filter.Colors {
+			args = append(args, c)
+		}
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "e.created >= ?")
+		args = append(args, formatTime(filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "e.created < ?")
+		args = append(args, formatTime(filter.Until))
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	args = append(args, limit)
+
+	rows, err := self.db.Query(fmt.Sprintf(`
+	SELECT e.id, e.book, IFNULL(e.author, ''), e.section, e.location, e.chapter_progress, e.color,
+		e.created, fts.text, fts.note, snippet(fts, 0, '[', ']', '…', 32), bm25(fts, %s) AS rank
+	FROM fts
+	INNER JOIN entries e ON e.rowid = fts.rowid
+	WHERE %s
+	ORDER BY rank, e.book, e.order_id
+	LIMIT ?
+	`, rankWeights, strings.Join(where, " AND ")), args...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not search %q: %w", query, err)
+	}
+	defer rows.Close()
+
+	h := &bookmark.Highlight{}
+	results := []*Result{}
+	for rows.Next() {
+		r := &Result{}
+		var created string
+		err := rows.Scan(&r.Id, &r.Book, &r.Author, &r.Section, &r.Location, &r.ChapterProgress, &r.Color,
+			&created, &r.Text, &r.Note, &r.Snippet, &r.Rank)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read search results: %w", err)
+		}
+		r.ColorName = h.ColorName(r.Color)
+		r.Created, _ = time.Parse(time.RFC3339, created)
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read search results: %w", err)
+	}
+	return results, nil
+}
+
+// Turns what the user typed into a FTS5 query: words must all match, "quoted words" match as a
+// phrase and a trailing * matches as a prefix (incent*). Everything is quoted so punctuation and
+// FTS5 keywords are just text
+func Query(input string) string {
+	terms := []string{}
+	for _, t := range splitTerms(input) {
+		prefix := strings.HasSuffix(t, "*")
+		t = strings.Trim(t, `*"`)
+		if strings.TrimFunc(t, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) }) == "" {
+			continue
+		}
+		term := `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Splits on spaces, except inside double quotes
+func splitTerms(input string) []string {
+	terms := []string{}
+	var b strings.Builder
+	quoted := false
+	for _, r := range input {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			b.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if b.Len() > 0 {
+				terms = append(terms, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		terms = append(terms, b.String())
+	}
+	return terms
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// UTC RFC3339 sorts as text, which is what the date filters compare
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
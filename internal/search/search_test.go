@@ -0,0 +1,122 @@
+package search
+
+import (
+	"kme/internal/bookmark"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`incentives`, `"incentives"`},
+		{`incent* matter`, `"incent"* "matter"`},
+		{`"skin in the game" taleb`, `"skin in the game" "taleb"`},
+		{`don't AND -`, `"don't" "AND"`},
+		{`  `, ``},
+	}
+	for _, tt := range tests {
+		if got := Query(tt.input); got != tt.want {
+			t.Errorf("Query(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func testIndex(t *testing.T) *Index {
+	t.Helper()
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 10, 0, 0, 0, time.UTC) }
+	high := func(id string, text string, color int, note string, created time.Time) *bookmark.Highlight {
+		h := bookmark.NewHighlight(text, color)
+		h.Id, h.Note, h.Created = id, note, created
+		return h
+	}
+	idx, err := NewIndex([]*bookmark.Bookmarks{
+		{Book: "Antifragile", Author: "Nassim Taleb", Highlights: []*bookmark.Highlight{
+			high("s1", "Never trust anyone who doesn't have skin in the game.", 0, "", day(1)),
+			high("s2", "The game is played by those with skin in it.", 2, "", day(5)),
+			high("s3", "Incentives matter more than words.", 1, "", day(10)),
+		}},
+		{Book: "Poor Charlie's Almanack", Author: "Charles Munger", Highlights: []*bookmark.Highlight{
+			high("p1", "Show me the incentive and I will show you the outcome.", 0, "", day(2)),
+			high("p2", "Invert, always invert.", 3, "about incentives too", day(20)),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idx.Close() })
+	return idx
+}
+
+func ids(results []*Result) []string {
+	found := []string{}
+	for _, r := range results {
+		found = append(found, r.Id)
+	}
+	return found
+}
+
+func TestSearch(t *testing.T) {
+	idx := testIndex(t)
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 10, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name   string
+		query  string
+		filter Filter
+		want   []string
+	}{
+		{"phrase", `"skin in the game"`, Filter{}, []string{"s1"}},
+		{"words in any order", `game skin`, Filter{}, []string{"s1", "s2"}},
+		// the shorter text first, the note last
+		{"prefix", `incentive*`, Filter{}, []string{"s3", "p1", "p2"}},
+		{"book title", `almanack`, Filter{}, []string{"p1", "p2"}},
+		{"book", `incentive*`, Filter{Book: "charlie"}, []string{"p1", "p2"}},
+		{"colors", `incentive*`, Filter{Colors: []int{1, 3}}, []string{"s3", "p2"}},
+		{"since", `incentive*`, Filter{Since: day(10)}, []string{"s3", "p2"}},
+		{"until", `incentive*`, Filter{Until: day(10)}, []string{"p1"}},
+		{"limit", `incentive*`, Filter{Limit: 1}, []string{"s3"}},
+		{"no match", `nothing`, Filter{}, []string{}},
+	}
+	for _, tt := range tests {
+		results, err := idx.Search(tt.query, tt.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := ids(results)
+		if tt.name == "words in any order" || tt.name == "since" || tt.name == "colors" || tt.name == "book title" {
+			// same weight, the order isn't the point here
+			slices.Sort(got)
+			slices.Sort(tt.want)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: Search(%s) = %v, want %v", tt.name, tt.query, got, tt.want)
+		}
+	}
+
+	if _, err := idx.Search(`" *`, Filter{}); err == nil {
+		t.Errorf("Want an error for a query with nothing to search")
+	}
+}
+
+func TestSearchRank(t *testing.T) {
+	idx := testIndex(t)
+	// in the text ranks above in a note
+	results, err := idx.Search("incentives", Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(results); !slices.Equal(got, []string{"s3", "p2"}) {
+		t.Fatalf("Search(incentives) = %v, want the highlight before the note", got)
+	}
+	if results[0].Rank > results[1].Rank || results[0].Snippet != "[Incentives] matter more than words." {
+		t.Errorf("Results = %+v, %+v", results[0], results[1])
+	}
+	if results[0].Book != "Antifragile" || results[0].Author != "Nassim Taleb" || !results[0].Created.Equal(time.Date(2024, 3, 10, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Result fields = %+v", results[0])
+	}
+}
@@ -0,0 +1,198 @@
+package stats
+
+import (
+	"cmp"
+	"kme/internal/bookmark"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Parts each book is split in for the density heatmap
+const DENSITY_BINS = 20
+
+type Count struct {
+	Highlights int `json:"highlights"`
+	Markups    int `json:"markups"`
+}
+
+func (self Count) Total() int {
+	return self.Highlights + self.Markups
+}
+
+func (self *Count) add(kind string) {
+	if kind == bookmark.MARKUP {
+		self.Markups++
+	} else {
+		self.Highlights++
+	}
+}
+
+type ChapterStats struct {
+	Section string `json:"section"`
+	Count
+}
+
+type BookStats struct {
+	Book   string `json:"book"`
+	Author string `json:"author"`
+	Count
+	// In reading order
+	Chapters []*ChapterStats `json:"chapters"`
+	// Annotations in each of the DENSITY_BINS parts of the book
+	Density []int `json:"density"`
+	// Whether the density comes from the book file. Otherwise only the annotated chapters are known
+	// and the book is spread over them
+	Exact bool `json:"exact"`
+}
+
+type ColorStats struct {
+	Code       int    `json:"code"`
+	Name       string `json:"name"`
+	Highlights int    `json:"highlights"`
+}
+
+type MonthStats struct {
+	// e.g. 2024-03
+	Month string `json:"month"`
+	Count
+}
+
+type Stats struct {
+	Total Count `json:"total"`
+	// Most annotated first
+	Books  []*BookStats  `json:"books"`
+	Colors []*ColorStats `json:"colors"`
+	// Every month from the first annotation to the last, even the ones without
+	Months []*MonthStats `json:"months"`
+	// Annotations by day (2006-01-02) they were made
+	Days map[string]int `json:"days"`
+	// Annotations without a DateCreated, left out of Months and Days
+	Undated int `json:"undated"`
+}
+
+// Where an annotation is through its book, in [0,1], from the chapter file and how far into it.
+// ok is false when the book file can't tell
+type Locator func(bm *bookmark.Bookmarks, chapterHref string, chapterProgress float64) (position float64, ok bool)
+
+// An annotation of either kind, as far as stats care
+type annotation struct {
+	kind     string
+	section  string
+	href     string
+	orderId  float64
+	progress float64
+	created  time.Time
+}
+
+// Computes the stats of the library. locate may be nil, then density is always spread over the
+// annotated chapters
+func Compute(library []*bookmark.Bookmarks, locate Locator) *Stats {
+	stats := &Stats{Days: map[string]int{}}
+	colors := map[int]int{}
+	months := map[string]*MonthStats{}
+
+	for _, bm := range library {
+		book := &BookStats{Book: bm.Book, Author: bm.Author}
+		annotations := []*annotation{}
+		for _, h := range bm.Highlights {
+			colors[h.Color()]++
+			annotations = append(annotations, &annotation{
+				kind: bookmark.HIGHLIGHT, section: h.Section, href: h.ChapterHref(), orderId: h.OrderId,
+				progress: h.ChapterProgress, created: h.Created,
+			})
+		}
+		for _, m := range bm.Markups {
+			href := (&bookmark.Highlight{ContentId: m.ContentId, VolumeId: m.VolumeId}).ChapterHref()
+			annotations = append(annotations, &annotation{
+				kind: bookmark.MARKUP, section: m.Section, href: href, orderId: m.OrderId,
+				progress: m.ChapterProgress, created: m.Created,
+			})
+		}
+		slices.SortStableFunc(annotations, func(a, b *annotation) int { return cmp.Compare(a.orderId, b.orderId) })
+
+		for _, a := range annotations {
+			book.add(a.kind)
+			stats.Total.add(a.kind)
+			if len(book.Chapters) == 0 || book.Chapters[len(book.Chapters)-1].Section != a.section {
+				book.Chapters = append(book.Chapters, &ChapterStats{Section: a.section})
+			}
+			book.Chapters[len(book.Chapters)-1].add(a.kind)
+
+			if a.created.IsZero() {
+				stats.Undated++
+				continue
+			}
+			local := a.created.Local()
+			month := local.Format("2006-01")
+			if months[month] == nil {
+				months[month] = &MonthStats{Month: month}
+			}
+			months[month].add(a.kind)
+			stats.Days[local.Format("2006-01-02")]++
+		}
+		book.Density, book.Exact = density(bm, annotations, book.Chapters, locate)
+		stats.Books = append(stats.Books, book)
+	}
+
+	slices.SortStableFunc(stats.Books, func(a, b *BookStats) int {
+		return cmp.Or(cmp.Compare(b.Total(), a.Total()), cmp.Compare(a.Book, b.Book))
+	})
+	h := &bookmark.Highlight{}
+	for _, code := range slices.Sorted(maps.Keys(colors)) {
+		stats.Colors = append(stats.Colors, &ColorStats{Code: code, Name: h.ColorName(code), Highlights: colors[code]})
+	}
+	stats.Months = fillMonths(months)
+	return stats
+}
+
+// Annotations in each part of the book. Without a locator, or when it can't place every annotation,
+// each annotated chapter takes the same share of the book
+func density(bm *bookmark.Bookmarks, annotations []*annotation, chapters []*ChapterStats, locate Locator) ([]int, bool) {
+	bins := make([]int, DENSITY_BINS)
+	positions := make([]float64, len(annotations))
+
+	exact := locate != nil && len(annotations) > 0
+	for i, a := range annotations {
+		if !exact {
+			break
+		}
+		positions[i], exact = locate(bm, a.href, a.progress)
+	}
+	if !exact {
+		chapter := -1
+		section := ""
+		for i, a := range annotations {
+			if i == 0 || a.section != section {
+				chapter++
+				section = a.section
+			}
+			positions[i] = (float64(chapter) + min(max(a.progress, 0), 1)) / float64(len(chapters))
+		}
+	}
+
+	for _, p := range positions {
+		bin := int(p * DENSITY_BINS)
+		bins[min(max(bin, 0), DENSITY_BINS-1)]++
+	}
+	return bins, exact
+}
+
+func fillMonths(months map[string]*MonthStats) []*MonthStats {
+	filled := []*MonthStats{}
+	if len(months) == 0 {
+		return filled
+	}
+	keys := slices.Sorted(maps.Keys(months))
+	first, _ := time.Parse("2006-01", keys[0])
+	last, _ := time.Parse("2006-01", keys[len(keys)-1])
+	for t := first; !t.After(last); t = t.AddDate(0, 1, 0) {
+		month := t.Format("2006-01")
+		if m, ok := months[month]; ok {
+			filled = append(filled, m)
+		} else {
+			filled = append(filled, &MonthStats{Month: month})
+		}
+	}
+	return filled
+}
@@ -0,0 +1,66 @@
+package stats
+
+import (
+	"kme/internal/bookmark"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompute(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.ParseInLocation("2006-01-02", s, time.Local)
+		return d
+	}
+	library := []*bookmark.Bookmarks{
+		{
+			Book: "Dune",
+			Highlights: []*bookmark.Highlight{
+				{Section: "One", OrderId: 1, ChapterProgress: 0.1, Created: day("2024-01-05")},
+				{Section: "One", OrderId: 2, ChapterProgress: 0.9, Created: day("2024-01-05")},
+				{Section: "Two", OrderId: 3, ChapterProgress: 0.5},
+			},
+			Markups: []*bookmark.Markup{
+				{Id: "m1", Section: "Two", OrderId: 4, ChapterProgress: 0.99, Created: day("2024-04-20")},
+			},
+		},
+		{Book: "Emma", Highlights: []*bookmark.Highlight{{Section: "I", Created: day("2024-02-01")}}},
+	}
+
+	stats := Compute(library, nil)
+	if stats.Total != (Count{Highlights: 4, Markups: 1}) {
+		t.Errorf("Total = %+v", stats.Total)
+	}
+	if stats.Books[0].Book != "Dune" || len(stats.Books[0].Chapters) != 2 || stats.Books[0].Chapters[1].Markups != 1 {
+		t.Errorf("Books = %+v", stats.Books[0])
+	}
+	months := []string{}
+	for _, m := range stats.Months {
+		months = append(months, m.Month)
+	}
+	if !slices.Equal(months, []string{"2024-01", "2024-02", "2024-03", "2024-04"}) {
+		t.Errorf("Months = %v, want every month from the first to the last", months)
+	}
+	if stats.Days["2024-01-05"] != 2 || stats.Undated != 1 {
+		t.Errorf("Days = %v, Undated = %d", stats.Days, stats.Undated)
+	}
+
+	// two chapters, each half of the book
+	if d := stats.Books[0].Density; d[1] != 1 || d[9] != 1 || d[15] != 1 || d[DENSITY_BINS-1] != 1 || stats.Books[0].Exact {
+		t.Errorf("Density = %v", d)
+	}
+
+	exact := Compute(library[:1], func(bm *bookmark.Bookmarks, href string, progress float64) (float64, bool) {
+		return 0, true
+	})
+	if exact.Books[0].Density[0] != 4 || !exact.Books[0].Exact {
+		t.Errorf("Density with a locator = %v", exact.Books[0].Density)
+	}
+
+	for name, svg := range map[string]string{"density": stats.DensityChart(), "calendar": stats.CalendarChart()} {
+		if !strings.HasPrefix(svg, "<svg") || !strings.HasSuffix(svg, "</svg>\n") {
+			t.Errorf("%s chart is not a standalone SVG", name)
+		}
+	}
+}
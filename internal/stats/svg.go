@@ -0,0 +1,359 @@
+package stats
+
+import (
+	"fmt"
+	"html"
+	"kme/internal/export"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files WriteCharts writes
+const (
+	BOOKS_SVG    = "books.svg"
+	CHAPTERS_SVG = "chapters.svg"
+	COLORS_SVG   = "colors.svg"
+	MONTHS_SVG   = "months.svg"
+	DENSITY_SVG  = "density.svg"
+	CALENDAR_SVG = "calendar.svg"
+)
+
+const (
+	HIGHLIGHT_FILL = "#4a7fb5"
+	MARKUP_FILL    = "#d9822b"
+	EMPTY_FILL     = "#ebedf0"
+
+	font       = `font-family="sans-serif" font-size="12"`
+	rowHeight  = 20
+	labelWidth = 260
+	barsWidth  = 420
+	margin     = 16
+	labelChars = 40
+)
+
+// Writes every chart to dir as a standalone SVG, returns their paths
+func (self *Stats) WriteCharts(dir string, palette export.Palette) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create %s: %w", dir, err)
+	}
+	charts := []struct {
+		name string
+		svg  string
+	}{
+		{BOOKS_SVG, self.BooksChart()},
+		{CHAPTERS_SVG, self.ChaptersChart()},
+		{COLORS_SVG, self.ColorsChart(palette)},
+		{MONTHS_SVG, self.MonthsChart()},
+		{DENSITY_SVG, self.DensityChart()},
+		{CALENDAR_SVG, self.CalendarChart()},
+	}
+	paths := []string{}
+	for _, c := range charts {
+		p := filepath.Join(dir, c.name)
+		if err := os.WriteFile(p, []byte(c.svg), 0644); err != nil {
+			return nil, fmt.Errorf("Could not write %s: %w", p, err)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// Highlights and markups of each book, as stacked bars
+func (self *Stats) BooksChart() string {
+	rows := []barRow{}
+	for _, b := range self.Books {
+		rows = append(rows, countRow(b.Book, b.Count))
+	}
+	return barChart("Annotations per book", rows, countLegend())
+}
+
+// Highlights and markups of each annotated chapter, book after book
+func (self *Stats) ChaptersChart() string {
+	rows := []barRow{}
+	for _, b := range self.Books {
+		rows = append(rows, barRow{label: b.Book, heading: true})
+		for _, c := range b.Chapters {
+			rows = append(rows, countRow(c.Section, c.Count))
+		}
+	}
+	return barChart("Annotations per chapter", rows, countLegend())
+}
+
+// Highlights of each color, filled with its palette color
+func (self *Stats) ColorsChart(palette export.Palette) string {
+	rows := []barRow{}
+	for _, c := range self.Colors {
+		fill := HIGHLIGHT_FILL
+		if sw, ok := palette[c.Code]; ok {
+			fill = sw.Background
+		}
+		rows = append(rows, barRow{label: c.Name, values: []int{c.Highlights}, fills: []string{fill}})
+	}
+	return barChart("Highlights per color", rows, nil)
+}
+
+// Highlights and markups made each month, as stacked columns
+func (self *Stats) MonthsChart() string {
+	const colWidth, height = 24, 200
+	top := margin + 2*rowHeight
+	width := max(2*margin+len(self.Months)*colWidth, 2*margin+barsWidth)
+	svg := newSVG(width, top+height+3*rowHeight)
+	svg.title("Annotations per month")
+	svg.legend(margin, margin+rowHeight+4, countLegend())
+
+	most := 1
+	for _, m := range self.Months {
+		most = max(most, m.Total())
+	}
+	// only January is labelled when there are many months
+	yearly := len(self.Months) > 24
+	for i, m := range self.Months {
+		x := margin + i*colWidth
+		y := top + height
+		for j, v := range []int{m.Highlights, m.Markups} {
+			h := v * height / most
+			y -= h
+			svg.rect(x+2, y, colWidth-4, h, countLegend()[j].fill, fmt.Sprintf("%s: %d %s", m.Month, v, countLegend()[j].label))
+		}
+		if !yearly || i == 0 || strings.HasSuffix(m.Month, "-01") {
+			lx, ly := x+colWidth/2, top+height+14
+			svg.text(lx, ly, m.Month, fmt.Sprintf(`text-anchor="end" transform="rotate(-45 %d %d)"`, lx, ly))
+		}
+	}
+	svg.line(margin, top+height, margin+len(self.Months)*colWidth, top+height)
+	return svg.end()
+}
+
+// One row per book, from its start to its end, darker where it has more annotations
+func (self *Stats) DensityChart() string {
+	const cell = 18
+	top := margin + 2*rowHeight
+	width := 2*margin + labelWidth + DENSITY_BINS*cell
+	svg := newSVG(width, top+len(self.Books)*rowHeight+3*rowHeight)
+	svg.title("Annotation density through each book")
+
+	x0 := margin + labelWidth
+	svg.text(x0, top-6, "start", "")
+	svg.text(x0+DENSITY_BINS*cell, top-6, "end", `text-anchor="end"`)
+	approx := false
+	for i, b := range self.Books {
+		y := top + i*rowHeight
+		label := truncate(b.Book)
+		if !b.Exact {
+			label += " *"
+			approx = true
+		}
+		svg.text(x0-8, y+rowHeight-6, label, `text-anchor="end"`)
+		most := 1
+		for _, n := range b.Density {
+			most = max(most, n)
+		}
+		for j, n := range b.Density {
+			tip := fmt.Sprintf("%d%%–%d%%: %d", j*100/DENSITY_BINS, (j+1)*100/DENSITY_BINS, n)
+			svg.shade(x0+j*cell, y+1, cell-2, rowHeight-2, 0.2+0.8*float64(n)/float64(most), n > 0, tip)
+		}
+	}
+	if approx {
+		svg.text(margin, top+len(self.Books)*rowHeight+rowHeight,
+			"* book file not found, spread over the annotated chapters only", `fill="#666"`)
+	}
+	return svg.end()
+}
+
+// Annotations made each day, one block of weeks per year
+func (self *Stats) CalendarChart() string {
+	const cell, yearHeight = 12, 8*12 + 30
+	first, last := self.dayRange()
+	years := last.Year() - first.Year() + 1
+	if first.IsZero() {
+		years = 0
+	}
+	top := margin + 2*rowHeight
+	width := 2*margin + 40 + 54*cell
+	svg := newSVG(width, top+years*yearHeight+rowHeight)
+	svg.title("Annotation activity")
+
+	most := 1
+	for _, n := range self.Days {
+		most = max(most, n)
+	}
+	for i := range years {
+		year := first.Year() + i
+		y0 := top + i*yearHeight
+		svg.text(margin, y0+12, fmt.Sprint(year), `font-weight="bold"`)
+		for d, name := range []string{"Mon", "Wed", "Fri"} {
+			svg.text(margin+30, y0+20+(2*d+1)*cell+cell-2, name, `text-anchor="end" font-size="9"`)
+		}
+
+		start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local)
+		offset := (int(start.Weekday()) + 6) % 7 // weeks start on Monday
+		for day := start; day.Year() == year; day = day.AddDate(0, 0, 1) {
+			n := day.YearDay() - 1 + offset
+			week, weekday := n/7, n%7
+			x := margin + 40 + week*cell
+			y := y0 + 20 + weekday*cell
+			if day.Day() == 1 {
+				svg.text(x, y0+16, day.Format("Jan"), `font-size="9"`)
+			}
+			key := day.Format("2006-01-02")
+			count := self.Days[key]
+			// four steps, like most activity calendars
+			level := 1 + 3*max(count-1, 0)/max(most-1, 1)
+			svg.shade(x, y, cell-2, cell-2, float64(level)/4, count > 0, fmt.Sprintf("%s: %d", key, count))
+		}
+	}
+	return svg.end()
+}
+
+// First and last day with annotations, zero when none has a date
+func (self *Stats) dayRange() (time.Time, time.Time) {
+	var first, last time.Time
+	for key := range self.Days {
+		day, err := time.ParseInLocation("2006-01-02", key, time.Local)
+		if err != nil {
+			continue
+		}
+		if first.IsZero() || day.Before(first) {
+			first = day
+		}
+		if day.After(last) {
+			last = day
+		}
+	}
+	return first, last
+}
+
+type barRow struct {
+	label   string
+	values  []int
+	fills   []string
+	heading bool
+}
+
+type legendItem struct {
+	label string
+	fill  string
+}
+
+func countLegend() []legendItem {
+	return []legendItem{{"highlights", HIGHLIGHT_FILL}, {"markups", MARKUP_FILL}}
+}
+
+func countRow(label string, c Count) barRow {
+	return barRow{label: label, values: []int{c.Highlights, c.Markups}, fills: []string{HIGHLIGHT_FILL, MARKUP_FILL}}
+}
+
+// Horizontal bars, stacked when a row has many values, scaled to the longest
+func barChart(title string, rows []barRow, legend []legendItem) string {
+	top := margin + rowHeight
+	if legend != nil {
+		top += rowHeight
+	}
+	svg := newSVG(2*margin+labelWidth+barsWidth+40, top+len(rows)*rowHeight+margin)
+	svg.title(title)
+	if legend != nil {
+		svg.legend(margin, margin+rowHeight+4, legend)
+	}
+
+	most := 1
+	for _, r := range rows {
+		total := 0
+		for _, v := range r.values {
+			total += v
+		}
+		most = max(most, total)
+	}
+	x0 := margin + labelWidth
+	for i, r := range rows {
+		y := top + i*rowHeight
+		if r.heading {
+			svg.text(margin, y+rowHeight-6, truncate(r.label), `font-weight="bold"`)
+			continue
+		}
+		svg.text(x0-8, y+rowHeight-6, truncate(r.label), `text-anchor="end"`)
+		x, total := x0, 0
+		for j, v := range r.values {
+			w := v * barsWidth / most
+			svg.rect(x, y+3, w, rowHeight-6, r.fills[j], fmt.Sprintf("%s: %d", r.label, v))
+			x += w
+			total += v
+		}
+		svg.text(x+4, y+rowHeight-6, fmt.Sprint(total), `fill="#666"`)
+	}
+	return svg.end()
+}
+
+func truncate(label string) string {
+	if label == "" {
+		return "(untitled)"
+	}
+	runes := []rune(label)
+	if len(runes) > labelChars {
+		return string(runes[:labelChars-1]) + "…"
+	}
+	return label
+}
+
+// Just enough SVG for the charts
+type svgWriter struct {
+	b strings.Builder
+}
+
+func newSVG(width, height int) *svgWriter {
+	svg := &svgWriter{}
+	fmt.Fprintf(&svg.b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" %s>`+"\n",
+		width, height, width, height, font)
+	fmt.Fprintf(&svg.b, `<rect width="100%%" height="100%%" fill="white"/>`+"\n")
+	return svg
+}
+
+func (self *svgWriter) title(title string) {
+	self.text(margin, margin+4, title, `font-size="16" font-weight="bold"`)
+}
+
+func (self *svgWriter) legend(x, y int, items []legendItem) {
+	for _, it := range items {
+		self.rect(x, y-10, 10, 10, it.fill, "")
+		self.text(x+14, y, it.label, "")
+		x += 14 + 8*len(it.label) + 12
+	}
+}
+
+// attrs are written as is, text is escaped
+func (self *svgWriter) text(x, y int, text string, attrs string) {
+	fmt.Fprintf(&self.b, `<text x="%d" y="%d" %s>%s</text>`+"\n", x, y, attrs, html.EscapeString(text))
+}
+
+// A tooltip is shown on hover when tip isn't empty
+func (self *svgWriter) rect(x, y, w, h int, fill string, tip string) {
+	if w <= 0 || h <= 0 {
+		return
+	}
+	if tip == "" {
+		fmt.Fprintf(&self.b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"/>`+"\n", x, y, w, h, fill)
+		return
+	}
+	fmt.Fprintf(&self.b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"><title>%s</title></rect>`+"\n",
+		x, y, w, h, fill, html.EscapeString(tip))
+}
+
+// A cell of a heatmap, HIGHLIGHT_FILL as strong as opacity or EMPTY_FILL when there is nothing
+func (self *svgWriter) shade(x, y, w, h int, opacity float64, filled bool, tip string) {
+	if !filled {
+		self.rect(x, y, w, h, EMPTY_FILL, tip)
+		return
+	}
+	fmt.Fprintf(&self.b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s" fill-opacity="%.2f"><title>%s</title></rect>`+"\n",
+		x, y, w, h, HIGHLIGHT_FILL, opacity, html.EscapeString(tip))
+}
+
+func (self *svgWriter) line(x1, y1, x2, y2 int) {
+	fmt.Fprintf(&self.b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"/>`+"\n", x1, y1, x2, y2)
+}
+
+func (self *svgWriter) end() string {
+	self.b.WriteString("</svg>\n")
+	return self.b.String()
+}
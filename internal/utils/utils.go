@@ -1 +1,52 @@
 package utils
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+)
+
+func CopyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Splits text in lines of at most width columns, at spaces when possible
+func Wrap(text string, width int) []string {
+	lines := []string{}
+	for _, para := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			switch {
+			case line == "":
+				line = word
+			case runewidth.StringWidth(line)+1+runewidth.StringWidth(word) <= width:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+			for runewidth.StringWidth(line) > width {
+				cut := runewidth.Truncate(line, width, "")
+				lines = append(lines, cut)
+				line = line[len(cut):]
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+		want  []string
+	}{
+		{"", 10, []string{""}},
+		{"short one", 10, []string{"short one"}},
+		{"a few words that need wrapping", 10, []string{"a few", "words that", "need", "wrapping"}},
+		{"incomprehensibilities", 8, []string{"incompre", "hensibil", "ities"}},
+		{"first\nsecond", 20, []string{"first", "second"}},
+		// wide runes take two columns
+		{"日本語の本", 4, []string{"日本", "語の", "本"}},
+	}
+	for _, tt := range tests {
+		if got := Wrap(tt.text, tt.width); !slices.Equal(got, tt.want) {
+			t.Errorf("Wrap(%q, %d) = %q, want %q", tt.text, tt.width, got, tt.want)
+		}
+	}
+}
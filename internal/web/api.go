@@ -0,0 +1,303 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kme/internal/bookmark"
+	"kme/internal/export"
+	"kme/internal/search"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the API reads the library from, again every time Version changes
+type Source struct {
+	// The whole library and where its markup images are
+	Load func() ([]*bookmark.Bookmarks, string, error)
+	// Anything that changes when the library may have, e.g. the modification time of the Kobo DB
+	Version func() string
+}
+
+type apiBook struct {
+	Id string `json:"id"`
+	*export.JSONBook
+	Modified time.Time `json:"modified,omitzero"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// The library as read at some version of the source
+type apiLibrary struct {
+	version  string
+	books    []*bookmark.Bookmarks
+	markPath string
+	ids      map[*bookmark.Bookmarks]string
+	byId     map[string]*bookmark.Bookmarks
+}
+
+// Read-only JSON API of a library that may change while it runs, like a Kobo plugged in. Every
+// response has an ETag from the DateModified of the bookmarks in it, so clients polling with
+// If-None-Match get a 304 until something changes
+type API struct {
+	source  Source
+	quality int
+
+	mu      sync.Mutex
+	library *apiLibrary
+}
+
+func NewAPI(source Source, quality int) *API {
+	return &API{source: source, quality: quality}
+}
+
+func (self *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", self.handleIndex)
+	mux.HandleFunc("GET /books", self.handleBooks)
+	mux.HandleFunc("GET /books/{book}", self.handleBook)
+	mux.HandleFunc("GET /books/{book}/highlights", self.handleHighlights)
+	mux.HandleFunc("GET /books/{book}/markups", self.handleMarkups)
+	mux.HandleFunc("GET /books/{book}/markups/{file}", self.handleMarkupImage)
+	mux.HandleFunc("GET /search", self.handleSearch)
+	return mux
+}
+
+// The library as of now, read again if the source changed. The bookmark package reads from one
+// database at a time, so loads can't overlap
+func (self *API) current() (*apiLibrary, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	version := self.source.Version()
+	if self.library != nil && self.library.version == version {
+		return self.library, nil
+	}
+	books, markPath, err := self.source.Load()
+	if err != nil {
+		return nil, err
+	}
+	lib := &apiLibrary{version: version, books: books, markPath: markPath, ids: BookIds(books)}
+	lib.byId = map[string]*bookmark.Bookmarks{}
+	for bm, id := range lib.ids {
+		lib.byId[id] = bm
+	}
+	self.library = lib
+	return lib, nil
+}
+
+func (self *API) book(w http.ResponseWriter, r *http.Request) (*bookmark.Bookmarks, *apiLibrary, bool) {
+	lib, err := self.current()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return nil, nil, false
+	}
+	bm, ok := lib.byId[r.PathValue("book")]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown book %s", r.PathValue("book")))
+		return nil, nil, false
+	}
+	return bm, lib, true
+}
+
+func (self *API) handleIndex(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, "", map[string][]string{
+		"endpoints": {
+			"/books",
+			"/books/{id}",
+			"/books/{id}/highlights",
+			"/books/{id}/markups",
+			"/books/{id}/markups/{markup id}.jpg?thumb",
+			"/search?q=&book=&color=&limit=",
+		},
+	})
+}
+
+func (self *API) handleBooks(w http.ResponseWriter, r *http.Request) {
+	lib, err := self.current()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	books := []*apiBook{}
+	for _, bm := range lib.books {
+		books = append(books, newAPIBook(bm, lib.ids[bm], lib.markPath, false))
+	}
+	slices.SortFunc(books, func(a, b *apiBook) int { return strings.Compare(a.Id, b.Id) })
+	writeJSON(w, r, etag(lib.books...), map[string]any{"books": books})
+}
+
+func (self *API) handleBook(w http.ResponseWriter, r *http.Request) {
+	bm, lib, ok := self.book(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, etag(bm), newAPIBook(bm, lib.ids[bm], lib.markPath, false))
+}
+
+func (self *API) handleHighlights(w http.ResponseWriter, r *http.Request) {
+	bm, lib, ok := self.book(w, r)
+	if !ok {
+		return
+	}
+	book := newAPIBook(bm, lib.ids[bm], lib.markPath, true)
+	writeJSON(w, r, etag(bm), map[string]any{"book_id": book.Id, "highlights": book.Highlights})
+}
+
+func (self *API) handleMarkups(w http.ResponseWriter, r *http.Request) {
+	bm, lib, ok := self.book(w, r)
+	if !ok {
+		return
+	}
+	book := newAPIBook(bm, lib.ids[bm], lib.markPath, true)
+	for _, m := range book.Markups {
+		m.Image = fmt.Sprintf("/books/%s/markups/%s.jpg", book.Id, m.Id)
+	}
+	writeJSON(w, r, etag(bm), map[string]any{"book_id": book.Id, "markups": book.Markups})
+}
+
+func (self *API) handleMarkupImage(w http.ResponseWriter, r *http.Request) {
+	bm, lib, ok := self.book(w, r)
+	if !ok {
+		return
+	}
+	id, isJpg := strings.CutSuffix(r.PathValue("file"), ".jpg")
+	i := slices.IndexFunc(bm.Markups, func(m *bookmark.Markup) bool { return m.Id == id })
+	if !isJpg || i < 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown markup %s", r.PathValue("file")))
+		return
+	}
+	m := bm.Markups[i]
+
+	tag := fmt.Sprintf(`"%s-%d"`, m.Id, latest(m.Created, m.Modified).UnixMilli())
+	if notModified(w, r, tag) {
+		return
+	}
+	// rendered before writing anything, so a failure can still be a JSON error
+	buf := &bytes.Buffer{}
+	if err := writeMarkupImage(buf, m, lib.markPath, self.quality, r.URL.Query().Has("thumb")); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(buf.Bytes())
+}
+
+func (self *API) handleSearch(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := strings.TrimSpace(params.Get("q"))
+	if query == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Provide something to search for with ?q="))
+		return
+	}
+	filter := search.Filter{Book: params.Get("book"), Limit: SEARCH_LIMIT}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid limit %s", limit))
+			return
+		}
+		filter.Limit = n
+	}
+	h := &bookmark.Highlight{}
+	for _, c := range params["color"] {
+		code, ok := h.ColorCode(c)
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Unknown color %s", c))
+			return
+		}
+		filter.Colors = append(filter.Colors, code)
+	}
+
+	lib, err := self.current()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	tag := etag(lib.books...)
+	if notModified(w, r, tag) {
+		return
+	}
+	// as quick as in kme search, and nothing to keep in sync with the library
+	index, err := search.NewIndex(lib.books)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer index.Close()
+	results, err := index.Search(query, filter)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// the ETag is already set
+	writeJSON(w, r, "", map[string]any{"query": query, "results": results})
+}
+
+func newAPIBook(bm *bookmark.Bookmarks, id string, markPath string, full bool) *apiBook {
+	book := &apiBook{Id: id, JSONBook: export.NewJSONBook(bm, markPath, full)}
+	for _, h := range bm.Highlights {
+		book.Modified = latest(book.Modified, h.Created, h.Modified)
+	}
+	for _, m := range bm.Markups {
+		book.Modified = latest(book.Modified, m.Created, m.Modified)
+	}
+	return book
+}
+
+// From the latest DateModified (or DateCreated, when never modified) of the bookmarks, and how
+// many there are so deletions count too
+func etag(library ...*bookmark.Bookmarks) string {
+	last := time.Time{}
+	count := 0
+	for _, bm := range library {
+		for _, h := range bm.Highlights {
+			last = latest(last, h.Created, h.Modified)
+		}
+		for _, m := range bm.Markups {
+			last = latest(last, m.Created, m.Modified)
+		}
+		count += len(bm.Highlights) + len(bm.Markups)
+	}
+	return fmt.Sprintf(`"%d-%d"`, last.UnixMilli(), count)
+}
+
+// Sets the ETag, and answers 304 if the client already has it
+func notModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if t = strings.TrimSpace(t); t == tag || t == "W/"+tag || t == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, tag string, body any) {
+	if tag != "" && notModified(w, r, tag) {
+		return
+	}
+	data, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	data, _ := json.Marshal(apiError{Error: err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("ETag")
+	w.WriteHeader(code)
+	w.Write(append(data, '\n'))
+}
@@ -0,0 +1,251 @@
+package web
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"kme/internal/bookmark"
+	"kme/internal/export"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	SITE_INDEX        = "index.html"
+	SITE_PAGE_EXT     = ".html"
+	SITE_SEARCH_INDEX = "search.json"
+)
+
+// WriteSite wraps it with the errors of the markups whose images couldn't be written. The site is
+// complete otherwise, those markups only miss their images like in the html format
+var ErrMissingImages = errors.New("Some markups have no images in the site")
+
+// Entry of search.json, what the search page of the static site looks into
+type siteEntry struct {
+	Id      string `json:"id"`
+	Book    string `json:"book"`
+	Author  string `json:"author"`
+	Section string `json:"section"`
+	// Kobo name of the color, which is the CSS class of the highlight
+	Color     string `json:"color"`
+	ColorName string `json:"color_name"`
+	Text      string `json:"text"`
+	Note      string `json:"note"`
+	// Permalink of the highlight, relative to the site root
+	Url string `json:"url"`
+}
+
+// Writes the same pages as the server, as files in out so they can go to any static host or be
+// opened from disk (search needs http though). shelves, by name with the titles of their books,
+// adds an index by shelf, nil when they are unknown.
+// Nothing in the pages depends on when they were written, so a site kept in git only changes
+// when the annotations do. Files left in out/books by books no longer in the library are removed.
+// See ErrMissingImages for the one error that doesn't mean the site is unfinished
+func (self *Server) WriteSite(out string, shelves map[string][]string) error {
+	site := &siteWriter{out: out, written: map[string]bool{}}
+
+	// the library page is already by author
+	nav := []link{}
+	if len(shelves) > 0 {
+		nav = append(nav, link{Name: "Shelves", Href: "shelves" + SITE_PAGE_EXT})
+	}
+	layout := func(title string, root string) layoutView {
+		l := self.layout(title, root)
+		l.PageExt, l.Index, l.Nav = SITE_PAGE_EXT, SITE_INDEX, nav
+		return l
+	}
+
+	library := self.libraryView("")
+	library.layoutView = layout("Library", "")
+	library.Groups = groupBy(library.Books, func(b *bookItem) []string {
+		return []string{cmp.Or(b.Author, "Unknown author")}
+	})
+	if err := site.file(SITE_INDEX, func(w io.Writer) error { return self.render(w, "library", library) }); err != nil {
+		return err
+	}
+
+	if len(shelves) > 0 {
+		byShelf := self.libraryView("")
+		byShelf.layoutView = layout("Shelves", "")
+		byShelf.Groups = groupBy(byShelf.Books, func(b *bookItem) []string {
+			in := []string{}
+			for shelf, titles := range shelves {
+				if slices.Contains(titles, b.Book) {
+					in = append(in, shelf)
+				}
+			}
+			if len(in) == 0 {
+				return []string{"Not in a shelf"}
+			}
+			return in
+		})
+		err := site.file("shelves"+SITE_PAGE_EXT, func(w io.Writer) error { return self.render(w, "library", byShelf) })
+		if err != nil {
+			return err
+		}
+	}
+
+	searchPage := &searchView{layoutView: layout("Search", ""), ClientSide: true}
+	if err := site.file("search"+SITE_PAGE_EXT, func(w io.Writer) error { return self.render(w, "search", searchPage) }); err != nil {
+		return err
+	}
+	if err := site.file(SITE_SEARCH_INDEX, func(w io.Writer) error { return self.writeSearchIndex(w) }); err != nil {
+		return err
+	}
+
+	for _, b := range library.Books {
+		if err := self.writeBookPages(site, b, layout); err != nil {
+			return err
+		}
+	}
+	if err := site.removeStale(filepath.Join(out, "books")); err != nil {
+		return err
+	}
+	if len(site.missing) > 0 {
+		return fmt.Errorf("%w: %w", ErrMissingImages, errors.Join(site.missing...))
+	}
+	return nil
+}
+
+func (self *Server) writeBookPages(site *siteWriter, b *bookItem, layout func(string, string) layoutView) error {
+	dir := filepath.Join("books", b.Id)
+	book := self.bookView(b.Bookmarks, "")
+	book.layoutView = layout(b.Book, "../../")
+	err := site.file(filepath.Join(dir, SITE_INDEX), func(w io.Writer) error { return self.render(w, "book", book) })
+	if err != nil {
+		return err
+	}
+
+	for _, m := range book.Markups {
+		view, _ := self.markupView(b.Bookmarks, m.Id, "")
+		view.layoutView = layout(b.Book, "../../../")
+		markDir := filepath.Join(dir, "markups")
+		err := site.file(filepath.Join(markDir, m.Id+SITE_PAGE_EXT), func(w io.Writer) error {
+			return self.render(w, "markup", view)
+		})
+		if err != nil {
+			return err
+		}
+		// a markup that can't be rendered only misses its images, see ErrMissingImages
+		for _, thumb := range []bool{false, true} {
+			name := "image.jpg"
+			if thumb {
+				name = "thumb.jpg"
+			}
+			err := site.file(filepath.Join(markDir, m.Id, name), func(w io.Writer) error {
+				return self.WriteMarkupImage(w, m, thumb)
+			})
+			if err != nil {
+				site.missing = append(site.missing, err)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (self *Server) writeSearchIndex(w io.Writer) error {
+	entries := []*siteEntry{}
+	h := &bookmark.Highlight{}
+	for _, bm := range slices.SortedFunc(maps.Keys(self.ids), func(a, b *bookmark.Bookmarks) int {
+		return strings.Compare(self.ids[a], self.ids[b])
+	}) {
+		for _, c := range export.Chapters(bm) {
+			for _, hl := range c.Highlights {
+				entries = append(entries, &siteEntry{
+					Id:        hl.Id,
+					Book:      bm.Book,
+					Author:    bm.Author,
+					Section:   hl.Section,
+					Color:     h.KoboColorName(hl.Color()),
+					ColorName: h.ColorName(hl.Color()),
+					Text:      hl.Text(),
+					Note:      hl.Note,
+					Url:       fmt.Sprintf("books/%s/%s#%s", self.ids[bm], SITE_INDEX, hl.Id),
+				})
+			}
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	if err := enc.Encode(entries); err != nil {
+		return fmt.Errorf("Could not write search index: %w", err)
+	}
+	return nil
+}
+
+// Books in groups sorted by name, a book goes in every group keys gives for it
+func groupBy(books []*bookItem, keys func(*bookItem) []string) []*bookGroup {
+	groups := map[string]*bookGroup{}
+	for _, b := range books {
+		for _, k := range keys(b) {
+			if groups[k] == nil {
+				groups[k] = &bookGroup{Name: k}
+			}
+			groups[k].Books = append(groups[k].Books, b)
+		}
+	}
+	sorted := []*bookGroup{}
+	for _, k := range slices.Sorted(maps.Keys(groups)) {
+		sorted = append(sorted, groups[k])
+	}
+	return sorted
+}
+
+// Writes files under out, remembering which so the stale ones can be removed
+type siteWriter struct {
+	out     string
+	written map[string]bool
+	// why the images of some markups are not there
+	missing []error
+}
+
+// Renders the whole file before writing it, so a failed render never leaves half a file
+func (self *siteWriter) file(name string, write func(io.Writer) error) error {
+	buf := &bytes.Buffer{}
+	if err := write(buf); err != nil {
+		return err
+	}
+	path := filepath.Join(self.out, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Could not create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Could not write %s: %w", path, err)
+	}
+	self.written[path] = true
+	return nil
+}
+
+// Removes the files under dir that were not written, and the directories left empty
+func (self *siteWriter) removeStale(dir string) error {
+	dirs := []string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		if !self.written[path] {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not clean up %s: %w", dir, err)
+	}
+	// deepest first, os.Remove fails on the ones that are not empty
+	for _, d := range slices.Backward(dirs) {
+		os.Remove(d)
+	}
+	return nil
+}
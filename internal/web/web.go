@@ -0,0 +1,418 @@
+package web
+
+import (
+	"bytes"
+	"cmp"
+	"embed"
+	"fmt"
+	"html/template"
+	"image/jpeg"
+	"io"
+	"kme/internal/bookmark"
+	"kme/internal/convert"
+	"kme/internal/export"
+	"kme/internal/search"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+//go:embed templates/*.tmpl
+var templatesFS embed.FS
+
+var slugRgx = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+const (
+	SEARCH_LIMIT = 100
+	THUMB_WIDTH  = export.THUMB_WIDTH
+)
+
+// What every page gets besides its own data
+type layoutView struct {
+	Title   string
+	Palette []swatch
+	// Path to the library page, with the trailing /
+	Root       string
+	Query      string
+	Searchable bool
+	// Added to links to other pages, e.g. .html in a static site
+	PageExt string
+	// Page of a directory, e.g. index.html in a static site. Empty when the server finds it
+	Index      string
+	Nav        []link
+	ThumbWidth int
+}
+
+type swatch struct {
+	Code int
+	export.Swatch
+}
+
+type bookItem struct {
+	*bookmark.Bookmarks
+	Id            string
+	LastAnnotated time.Time
+}
+
+type bookGroup struct {
+	Name  string
+	Books []*bookItem
+}
+
+type libraryView struct {
+	layoutView
+	Books  []*bookItem
+	Groups []*bookGroup
+}
+
+type link struct {
+	Name string
+	Href string
+}
+
+type bookView struct {
+	layoutView
+	*export.BookView
+	Downloads []link
+}
+
+type markupView struct {
+	layoutView
+	Book   string
+	Markup *bookmark.Markup
+	Prev   *bookmark.Markup
+	Next   *bookmark.Markup
+	Number int
+	Total  int
+}
+
+type searchView struct {
+	layoutView
+	Results []*search.Result
+	BookIds map[string]string
+	Error   string
+	// Search runs in the browser, with the search.json of the static site
+	ClientSide bool
+}
+
+// Web UI of a library, everything is read once when created
+type Server struct {
+	library  []*bookmark.Bookmarks
+	markPath string
+	palette  []swatch
+	quality  int
+	// book by its id in the URLs, and the other way around
+	books map[string]*bookmark.Bookmarks
+	ids   map[*bookmark.Bookmarks]string
+	index *search.Index
+	pages map[string]*template.Template
+}
+
+func New(library []*bookmark.Bookmarks, markPath string, palette export.Palette, quality int) (*Server, error) {
+	pages, err := parsePages()
+	if err != nil {
+		return nil, err
+	}
+	index, err := search.NewIndex(library)
+	if err != nil {
+		return nil, err
+	}
+
+	self := &Server{
+		library:  library,
+		markPath: markPath,
+		quality:  quality,
+		books:    map[string]*bookmark.Bookmarks{},
+		ids:      BookIds(library),
+		index:    index,
+		pages:    pages,
+	}
+	for bm, id := range self.ids {
+		self.books[id] = bm
+	}
+	for _, code := range slices.Sorted(maps.Keys(palette)) {
+		self.palette = append(self.palette, swatch{Code: code, Swatch: palette[code]})
+	}
+	return self, nil
+}
+
+func (self *Server) Close() error {
+	return self.index.Close()
+}
+
+func (self *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", self.handleLibrary)
+	mux.HandleFunc("GET /search", self.handleSearch)
+	mux.HandleFunc("GET /books/{book}/{$}", self.handleBook)
+	mux.HandleFunc("GET /books/{book}/download/{format}", self.handleDownload)
+	mux.HandleFunc("GET /books/{book}/markups/{markup}", self.handleMarkup)
+	mux.HandleFunc("GET /books/{book}/markups/{markup}/image.jpg", self.handleMarkupImage)
+	mux.HandleFunc("GET /books/{book}/markups/{markup}/thumb.jpg", self.handleMarkupImage)
+	return mux
+}
+
+// Short, readable and stable ids for the books, from their titles. Books with the same title get
+// a number after the first one
+func BookIds(library []*bookmark.Bookmarks) map[*bookmark.Bookmarks]string {
+	ids := map[*bookmark.Bookmarks]string{}
+	used := map[string]bool{}
+	for _, bm := range library {
+		base := strings.Trim(slugRgx.ReplaceAllString(strings.ToLower(bm.Book), "-"), "-")
+		if base == "" {
+			base = "book"
+		}
+		id := base
+		for n := 2; used[id]; n++ {
+			id = fmt.Sprintf("%s-%d", base, n)
+		}
+		used[id] = true
+		ids[bm] = id
+	}
+	return ids
+}
+
+func parsePages() (map[string]*template.Template, error) {
+	pages := map[string]*template.Template{}
+	for _, name := range []string{"library", "book", "markup", "search"} {
+		tmpl, err := template.New(name).Funcs(template.FuncMap(export.TemplateFuncs())).
+			ParseFS(templatesFS, "templates/layout.tmpl", "templates/"+name+".tmpl")
+		if err != nil {
+			return nil, fmt.Errorf("Could not load %s template: %w", name, err)
+		}
+		pages[name] = tmpl
+	}
+	return pages, nil
+}
+
+func (self *Server) layout(title string, root string) layoutView {
+	return layoutView{
+		Title:      title,
+		Palette:    self.palette,
+		Root:       root,
+		Searchable: true,
+		ThumbWidth: THUMB_WIDTH,
+	}
+}
+
+func (self *Server) render(w io.Writer, page string, view any) error {
+	if err := self.pages[page].ExecuteTemplate(w, "layout", view); err != nil {
+		return fmt.Errorf("Could not render %s page: %w", page, err)
+	}
+	return nil
+}
+
+func (self *Server) libraryView(root string) *libraryView {
+	view := &libraryView{layoutView: self.layout("Library", root)}
+	for _, bm := range self.library {
+		last := time.Time{}
+		for _, h := range bm.Highlights {
+			last = latest(last, h.Created, h.Modified)
+		}
+		for _, m := range bm.Markups {
+			last = latest(last, m.Created, m.Modified)
+		}
+		view.Books = append(view.Books, &bookItem{Bookmarks: bm, Id: self.ids[bm], LastAnnotated: last})
+	}
+	slices.SortFunc(view.Books, func(a, b *bookItem) int {
+		return strings.Compare(strings.ToLower(a.Book), strings.ToLower(b.Book))
+	})
+	view.Groups = []*bookGroup{{Books: view.Books}}
+	return view
+}
+
+func (self *Server) bookView(bm *bookmark.Bookmarks, root string) *bookView {
+	view := &bookView{layoutView: self.layout(bm.Book, root), BookView: export.NewBookView(bm)}
+	view.Markups = sortedMarkups(bm)
+	return view
+}
+
+func (self *Server) markupView(bm *bookmark.Bookmarks, markupId string, root string) (*markupView, bool) {
+	marks := sortedMarkups(bm)
+	i := slices.IndexFunc(marks, func(m *bookmark.Markup) bool { return m.Id == markupId })
+	if i < 0 {
+		return nil, false
+	}
+	view := &markupView{
+		layoutView: self.layout(bm.Book, root),
+		Book:       bm.Book,
+		Markup:     marks[i],
+		Number:     i + 1,
+		Total:      len(marks),
+	}
+	if i > 0 {
+		view.Prev = marks[i-1]
+	}
+	if i < len(marks)-1 {
+		view.Next = marks[i+1]
+	}
+	return view, true
+}
+
+func (self *Server) handleLibrary(w http.ResponseWriter, r *http.Request) {
+	self.respond(w, "library", self.libraryView("/"))
+}
+
+func (self *Server) handleBook(w http.ResponseWriter, r *http.Request) {
+	bm, ok := self.books[r.PathValue("book")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	view := self.bookView(bm, "/")
+	view.Downloads = []link{
+		{Name: "Markdown", Href: "download/markdown"},
+		{Name: "JSON", Href: "download/json"},
+	}
+	if len(bm.Markups) > 0 {
+		view.Downloads = append(view.Downloads, link{Name: "PDF of the markups", Href: "download/pdf"})
+	}
+	self.respond(w, "book", view)
+}
+
+func (self *Server) handleMarkup(w http.ResponseWriter, r *http.Request) {
+	bm, ok := self.books[r.PathValue("book")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	view, ok := self.markupView(bm, r.PathValue("markup"), "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	self.respond(w, "markup", view)
+}
+
+// The markup over its page, rendered on every request. Small when asked for the thumbnail
+func (self *Server) handleMarkupImage(w http.ResponseWriter, r *http.Request) {
+	bm, ok := self.books[r.PathValue("book")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	i := slices.IndexFunc(bm.Markups, func(m *bookmark.Markup) bool { return m.Id == r.PathValue("markup") })
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	thumb := strings.HasSuffix(r.URL.Path, "/thumb.jpg")
+	w.Header().Set("Content-Type", "image/jpeg")
+	if err := self.WriteMarkupImage(w, bm.Markups[i], thumb); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Renders the markup as JPG, scaled down to THUMB_WIDTH for thumbnails
+func (self *Server) WriteMarkupImage(w io.Writer, m *bookmark.Markup, thumb bool) error {
+	return writeMarkupImage(w, m, self.markPath, self.quality, thumb)
+}
+
+func writeMarkupImage(w io.Writer, m *bookmark.Markup, markPath string, quality int, thumb bool) error {
+	img, err := convert.RenderMarkup(m, markPath)
+	if err != nil {
+		return err
+	}
+	if thumb {
+		img = convert.Thumbnail(img, THUMB_WIDTH)
+	}
+	if err := jpeg.Encode(w, img, &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("Could not encode markup %s: %w", m.Id, err)
+	}
+	return nil
+}
+
+func (self *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	bm, ok := self.books[r.PathValue("book")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	id := self.ids[bm]
+
+	// rendered in memory first, so errors can still be told with the right status
+	buf := &bytes.Buffer{}
+	var err error
+	var contentType, ext string
+	switch r.PathValue("format") {
+	case "markdown":
+		contentType, ext = "text/markdown; charset=utf-8", "md"
+		tmpl, tmplErr := export.MarkdownTemplate("")
+		if err = tmplErr; err == nil {
+			err = export.WriteMarkdown(buf, bm, tmpl, nil)
+		}
+	case "json":
+		contentType, ext = "application/json", "json"
+		err = export.WriteJSON(buf, []*bookmark.Bookmarks{bm}, self.markPath, true)
+	case "pdf":
+		contentType, ext = "application/pdf", "pdf"
+		err = convert.WritePDF(buf, bm, self.markPath, self.quality)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+"."+ext))
+	w.Write(buf.Bytes())
+}
+
+func (self *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	view := &searchView{layoutView: self.layout("Search", "/"), BookIds: map[string]string{}}
+	view.Query = query
+	for bm, id := range self.ids {
+		view.BookIds[bm.Book] = id
+	}
+
+	if query != "" {
+		filter := search.Filter{Limit: SEARCH_LIMIT}
+		h := &bookmark.Highlight{}
+		for _, c := range r.URL.Query()["color"] {
+			if code, ok := h.ColorCode(c); ok {
+				filter.Colors = append(filter.Colors, code)
+			}
+		}
+		results, err := self.index.Search(query, filter)
+		if err != nil {
+			view.Error = err.Error()
+		}
+		view.Results = results
+	}
+	self.respond(w, "search", view)
+}
+
+func (self *Server) respond(w http.ResponseWriter, page string, view any) {
+	buf := &bytes.Buffer{}
+	if err := self.render(buf, page, view); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func sortedMarkups(bm *bookmark.Bookmarks) []*bookmark.Markup {
+	marks := slices.Clone(bm.Markups)
+	slices.SortFunc(marks, func(a, b *bookmark.Markup) int {
+		return cmp.Compare(a.OrderId, b.OrderId)
+	})
+	return marks
+}
+
+func latest(times ...time.Time) time.Time {
+	max := time.Time{}
+	for _, t := range times {
+		if t.After(max) {
+			max = t
+		}
+	}
+	return max
+}
@@ -0,0 +1,139 @@
+package web
+
+import (
+	"errors"
+	"kme/internal/bookmark"
+	"kme/internal/export"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBookIds(t *testing.T) {
+	library := []*bookmark.Bookmarks{
+		{Book: "Thinking, Fast and Slow"},
+		{Book: "Thinking Fast & Slow"},
+		{Book: "¿Qué es la vida?"},
+		{Book: "!!!"},
+	}
+	ids := BookIds(library)
+	want := []string{"thinking-fast-and-slow", "thinking-fast-slow", "qué-es-la-vida", "book"}
+	for i, bm := range library {
+		if ids[bm] != want[i] {
+			t.Errorf("Id of %q = %q, want %q", bm.Book, ids[bm], want[i])
+		}
+	}
+
+	same := BookIds([]*bookmark.Bookmarks{{Book: "Dune"}, {Book: "Dune"}})
+	seen := map[string]bool{}
+	for _, id := range same {
+		seen[id] = true
+	}
+	if !seen["dune"] || !seen["dune-2"] {
+		t.Errorf("Books with the same title should get different ids, got %v", same)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	palette, _ := export.LoadPalette(export.DEFAULT_PALETTE)
+	server, err := New([]*bookmark.Bookmarks{{Book: "Dune", Author: "Frank Herbert"}}, "", palette, 75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/", http.StatusOK},
+		{"/books/dune/", http.StatusOK},
+		{"/books/dune/download/markdown", http.StatusOK},
+		{"/books/dune/download/docx", http.StatusNotFound},
+		{"/books/dune/markups/nope", http.StatusNotFound},
+		{"/books/unknown/", http.StatusNotFound},
+		{"/search?q=spice", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.code {
+			t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.code)
+		}
+	}
+}
+
+func TestWriteSite(t *testing.T) {
+	palette, _ := export.LoadPalette(export.DEFAULT_PALETTE)
+	// a markup without its files, the site is written without its images
+	markups := []*bookmark.Markup{{Id: "m1", Section: "chapter01", Location: "1.2"}}
+	server, err := New([]*bookmark.Bookmarks{{Book: "Dune", Author: "Frank Herbert", Markups: markups}}, t.TempDir(), palette, 75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	out := t.TempDir()
+	stale := filepath.Join(out, "books", "gone", SITE_INDEX)
+	os.MkdirAll(filepath.Dir(stale), 0755)
+	os.WriteFile(stale, []byte("old"), 0644)
+
+	if err := server.WriteSite(out, map[string][]string{"Sci-fi": {"Dune"}}); !errors.Is(err, ErrMissingImages) {
+		t.Fatalf("Want the missing markup images reported, got %v", err)
+	}
+	for _, name := range []string{SITE_INDEX, "shelves.html", "search.html", SITE_SEARCH_INDEX, "books/dune/index.html", "books/dune/markups/m1.html"} {
+		if _, err := os.Stat(filepath.Join(out, name)); err != nil {
+			t.Errorf("Expected %s in the site: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Dir(stale)); !os.IsNotExist(err) {
+		t.Errorf("Pages of books no longer in the library should be removed")
+	}
+}
+
+func TestAPI(t *testing.T) {
+	version, loads := "1", 0
+	api := NewAPI(Source{
+		Load: func() ([]*bookmark.Bookmarks, string, error) {
+			loads++
+			return []*bookmark.Bookmarks{{Book: "Dune"}}, "", nil
+		},
+		Version: func() string { return version },
+	}, 75)
+
+	get := func(path string, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/books", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET /books = %d with ETag %q", rec.Code, etag)
+	}
+	if rec := get("/books", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("GET /books with its ETag = %d, want 304", rec.Code)
+	}
+	if rec := get("/books/dune/highlights", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /books/dune/highlights = %d", rec.Code)
+	}
+	if rec := get("/books/dune/markups/nope.jpg", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET of an unknown markup = %d, want 404", rec.Code)
+	}
+	if loads != 1 {
+		t.Errorf("The library should be read once while the source doesn't change, read %d times", loads)
+	}
+
+	version = "2"
+	get("/books", etag)
+	if loads != 2 {
+		t.Errorf("The library should be read again when the source changes")
+	}
+}